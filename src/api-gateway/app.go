@@ -1,137 +1,153 @@
-package main
+package apigateway
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
-	"log"
+	"log/slog"
+	"main/shared"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"sync"
 )
 
-var cp sync.Mutex
-var channelMap = make(map[string](chan int))
-
-const ORDER_SERVICE = "http://order-service:5000/checkout/"
-
-func main() {
-
-	router := mux.NewRouter()
-	router.HandleFunc("/{order_id}", checkoutHandler)
-	router.HandleFunc("/release/{order_id}/{status}", unblockCheckout)
-	router.HandleFunc("/", homeHandler)
+// Run serves the api gateway, which blocks checkouts until their saga ends or
+// tracks them for polling in the async mode. The replicas share the state of
+// all checkouts through the checkout-result topic.
+func Run() {
+	shared.ServiceName = "api-gateway"
+	defer shared.SetUpTracing("api-gateway")()
+	setUpCheckoutListener()
+	shared.MarkReady()
 
 	port := os.Getenv("PORT")
-	fmt.Printf("\nCurrent port is: %s", port)
 	if port == "" {
 		port = "5000"
 	}
 
 	// Set the listening address and port for the server
 	addr := fmt.Sprintf(":%s", port)
-	fmt.Printf("\nStarting api gateway service at %s", addr)
-	log.Fatal(http.ListenAndServe(addr, router))
+	slog.Info("Starting api gateway service", "addr", addr)
+	serveErr := http.ListenAndServe(addr, NewRouter())
+	shared.Fatal("Serve error", shared.LogError, serveErr)
+
+}
+
+// StartLocal returns the routes of the api gateway, for the local mode. The
+// checkout results come from the in-memory topics, otherwise it is the same
+// as in Run.
+func StartLocal() http.Handler {
+	setUpCheckoutListener()
+	return NewRouter()
+}
 
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+	shared.InstrumentRouter(router, "api-gateway")
+	router.HandleFunc("/{order_id}", checkoutHandler)
+	router.HandleFunc("/release/{order_id}/{status}", unblockCheckout)
+	router.HandleFunc("/checkout/{checkout_id}", checkoutStatusHandler).Methods(http.MethodGet)
+	// the route of the status before /checkout/{checkout_id}
+	router.HandleFunc("/status/{checkout_id}", checkoutStatusHandler).Methods(http.MethodGet)
+	router.HandleFunc("/", homeHandler)
+	return router
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Welcome to the home page..!")
 }
 
+// checkoutHandler starts the checkout saga of the order. By default it blocks
+// until the saga ends and answers with its status. In the async mode
+// (?async=true or Prefer: respond-async) it answers 202 with the checkout,
+// whose state can be polled at /checkout/{checkout_id}. An optional
+// ?callback_url= on an allowed host gets the finished checkout posted to it
+// in both modes.
+//
+// A request with the Idempotency-Key of an earlier checkout joins that
+// checkout and gets its outcome. Any other checkout of an order with a checkout
+// in progress is refused with 409 and the running checkout.
 func checkoutHandler(w http.ResponseWriter, r *http.Request) {
-	log.Print("Checkout handler called")
+	slog.DebugContext(r.Context(), "Checkout handler called")
 
 	order_id := mux.Vars(r)["order_id"]
-	immediateResp := routeCheckoutCall(order_id)
-	if immediateResp == http.StatusBadRequest {
-		w.WriteHeader(http.StatusBadRequest)
+	callback_url, valid_callback := getCallbackURL(r)
+	if !valid_callback {
+		http.Error(w, "invalid callback_url", http.StatusBadRequest)
 		return
-	} else {
-		created_channel := createChannel(order_id)
-		if created_channel {
-			select {
-			case status := <-channelMap[order_id]:
-				log.Printf("Channel released for order: %s and status $d", order_id, status)
-				w.WriteHeader(status)
-			}
-		} else {
-			log.Printf("Channel not created for order: %s", order_id)
-			w.WriteHeader(http.StatusBadRequest)
+	}
+
+	startErr, checkout, created := startCheckout(order_id, r.Header.Get("Idempotency-Key"), callback_url)
+	if errors.Is(startErr, errIdempotencyKeyReused) {
+		http.Error(w, startErr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(startErr, errCheckoutInProgress) {
+		slog.InfoContext(r.Context(), "Checkout of order already in progress", shared.LogCheckoutID, checkout.CheckoutID)
+		writeCheckout(w, http.StatusConflict, checkout)
+		return
+	}
+
+	if created {
+		immediateResp := routeCheckoutCall(r.Context(), order_id, checkout.CheckoutID)
+		if immediateResp != http.StatusOK {
+			finishCheckout(checkout.CheckoutID, order_id, shared.CHECKOUT_STATE_FAILED, immediateResp)
+			w.WriteHeader(immediateResp)
+			return
 		}
 	}
 
+	if wantsAsync(r) {
+		status := http.StatusOK
+		if checkout.State == shared.CHECKOUT_STATE_PENDING {
+			status = http.StatusAccepted
+			w.Header().Set("Location", "checkout/"+checkout.CheckoutID)
+		}
+		writeCheckout(w, status, checkout)
+		return
+	}
+	checkout = awaitCheckout(checkout.CheckoutID)
+	w.WriteHeader(checkout.Status)
 }
 
 func unblockCheckout(w http.ResponseWriter, r *http.Request) {
-	log.Print("Unblock checkout handler called")
+	slog.DebugContext(r.Context(), "Unblock checkout handler called")
 	order_id := mux.Vars(r)["order_id"]
 	status := mux.Vars(r)["status"]
 	statusi, err := strconv.Atoi(status)
 	if err != nil {
-		log.Printf("Error converting status to int: %s", err)
+		slog.InfoContext(r.Context(), "Invalid status", shared.LogError, err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	s := releaseChannel(order_id, statusi)
-	if s {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
-	}
-
-}
-
-func createChannel(orderId string) bool {
-	cp.Lock()
-	_, ok := channelMap[orderId]
-	if !ok {
-		log.Printf("\nChannel creating for order: %s", orderId)
-		channelMap[orderId] = make(chan int)
-	} else {
-		log.Printf("\nChannel already exist %s", orderId)
-		return false
-	}
-	cp.Unlock()
-	return true
-}
-
-func deleteChannel(orderId string) bool {
-	cp.Lock()
-	_, ok := channelMap[orderId]
-	if ok {
-		log.Printf("\nChannel deleting for order: %s", orderId)
-		close(channelMap[orderId])
-		delete(channelMap, orderId)
-	} else {
-		log.Printf("\nChannel does not exist %s", orderId)
-		return false
+	// the replica waiting for the order may be another one
+	publishErr := shared.PublishCheckoutResult(order_id, "", statusi)
+	if publishErr != nil {
+		slog.ErrorContext(r.Context(), "Publish checkout result error", shared.LogError, publishErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	cp.Unlock()
-	return true
+	w.WriteHeader(http.StatusOK)
 
 }
 
-func releaseChannel(orderId string, status int) bool {
-	_, ok := channelMap[orderId]
-	if ok {
-		channelMap[orderId] <- status
-		log.Printf("Released channel for order: %s", orderId)
-		deleteChannel(orderId)
-		return true
-	} else {
-		log.Printf("Channel does not exist for order: %s", orderId)
-		return false
+// routeCheckoutCall asks the order service to start the checkout saga under
+// the ID of the checkout, in the trace of the checkout request
+func routeCheckoutCall(ctx context.Context, orderID string, checkoutID string) int {
+	backendURL := shared.AppConfig.Services.Order + "/checkout/" + orderID + "?checkout_id=" + url.QueryEscape(checkoutID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendURL, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Order service call error", shared.LogCheckoutID, checkoutID, shared.LogError, err)
+		return http.StatusBadRequest
 	}
-}
-
-func routeCheckoutCall(orderID string) int {
-	backendURL := ORDER_SERVICE + orderID
-	resp, err := http.Get(backendURL)
+	resp, err := shared.HTTPClient.Do(req)
 	if err != nil {
-		log.Printf("\nFailed to make service call: %v", err)
+		slog.ErrorContext(ctx, "Order service call error", shared.LogCheckoutID, checkoutID, shared.LogError, err)
 		return http.StatusBadRequest
 	}
+	resp.Body.Close()
 	return resp.StatusCode
 
 }
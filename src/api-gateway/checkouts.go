@@ -0,0 +1,386 @@
+package apigateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"main/shared"
+)
+
+// checkouts can be polled for this long after they started
+const checkoutRetention = time.Hour
+
+const callbackAttempts = 3
+const callbackTimeout = 5 * time.Second
+
+// callbackClient only connects to public addresses, and does not follow
+// redirects, which could lead anywhere
+var callbackClient = &http.Client{
+	Timeout: callbackTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: callbackTimeout, Control: checkCallbackAddress}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sharedAddressSpace is 100.64.0.0/10, which some clusters use for pods
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// suffixes of the names of the cluster and the local network
+var internalHostSuffixes = []string{".local", ".internal", ".svc", ".localhost"}
+
+// gatewayCheckout is a checkout known to this replica, from its own requests
+// or from the checkout-result topic
+type gatewayCheckout struct {
+	shared.Checkout
+	// accepted by this replica, which times it out and posts its callback
+	local bool
+	// closed when the checkout finishes
+	done chan struct{}
+}
+
+var checkoutsLock sync.Mutex
+var checkouts = make(map[string]*gatewayCheckout)
+
+// pending checkout of every order
+var pendingCheckouts = make(map[string]string)
+
+// checkout of every Idempotency-Key
+var idempotentCheckouts = make(map[string]string)
+
+var errCheckoutInProgress = errors.New("another checkout of the order is in progress")
+var errIdempotencyKeyReused = errors.New("idempotency key was used for another order")
+
+// wantsAsync reports whether the client asked for the async mode, with
+// ?async=true or Prefer: respond-async
+func wantsAsync(r *http.Request) bool {
+	return r.URL.Query().Get("async") == "true" || r.Header.Get("Prefer") == "respond-async"
+}
+
+// getCallbackURL returns the optional ?callback_url=, which has to be an
+// absolute http or https URL on one of checkout.callback_hosts
+func getCallbackURL(r *http.Request) (string, bool) {
+	callbackURL := r.URL.Query().Get("callback_url")
+	if callbackURL == "" {
+		return "", true
+	}
+	parsedURL, parseErr := url.Parse(callbackURL)
+	if parseErr != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.User != nil {
+		return "", false
+	}
+	if !isAllowedCallbackHost(parsedURL.Hostname()) {
+		return "", false
+	}
+	return callbackURL, true
+}
+
+// isAllowedCallbackHost reports whether host is on the allow-list and not a
+// name or address inside the cluster. The address a name resolves to is
+// checked when the callback connects, see checkCallbackAddress.
+func isAllowedCallbackHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return false
+		}
+	} else if !strings.Contains(host, ".") {
+		// names without a domain are resolved in the namespace of the pod
+		return false
+	}
+	for _, suffix := range internalHostSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return false
+		}
+	}
+	for _, allowed := range shared.AppConfig.Checkout.CallbackHosts {
+		if host == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCallbackAddress refuses to connect a callback to an address that is
+// not public, also when an allowed name resolves to one
+func checkCallbackAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return splitErr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("callback to non-public address %s refused", host)
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is outside the loopback, private, link-local
+// and shared address ranges
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// setUpCheckoutListener applies the checkout changes of all replicas and the
+// lockmaster. Every replica reads all of them, starting with the checkouts
+// of the retention, so any replica can serve checkouts, status polls and
+// Idempotency-Keys, also after a restart.
+func setUpCheckoutListener() {
+	subscribeErr, subscription := shared.SubscribeReplay(shared.CHECKOUT_RESULT_TOPIC, time.Now().Add(-checkoutRetention))
+	if subscribeErr != nil {
+		shared.Fatal("Subscribe error", shared.LogTopic, shared.CHECKOUT_RESULT_TOPIC, shared.LogError, subscribeErr)
+	}
+	go receiveCheckoutChanges(subscription)
+}
+
+func receiveCheckoutChanges(subscription shared.Subscription) {
+	defer subscription.Close()
+	topicCtx := shared.WithLogFields(context.Background(), slog.String(shared.LogTopic, shared.CHECKOUT_RESULT_TOPIC))
+	for {
+		receiveErr, m := subscription.Receive(topicCtx)
+		if receiveErr != nil {
+			slog.ErrorContext(topicCtx, "Read message error", shared.LogError, receiveErr)
+			continue
+		}
+		parseErr, change := shared.ParseCheckout(m.Value)
+		if parseErr != nil {
+			slog.WarnContext(topicCtx, "Dropping checkout change that cannot be parsed", shared.LogError, parseErr, "payload", string(m.Value))
+			continue
+		}
+
+		checkout, local := applyCheckoutChange(change, false)
+		if checkout == nil || !local || checkout.State == shared.CHECKOUT_STATE_PENDING {
+			continue
+		}
+		slog.InfoContext(topicCtx, "Checkout finished", shared.LogCheckoutID, checkout.CheckoutID, shared.LogOrderID, checkout.OrderID, "status", checkout.Status)
+		if checkout.CallbackURL != "" {
+			go postCallback(*checkout)
+		}
+	}
+}
+
+// applyCheckoutChange stores a new checkout or finishes a pending one. A
+// change without checkout ID, the result of a saga, applies to the pending
+// checkout of its order. It returns the changed checkout, or nil when nothing
+// changed, and whether this replica accepted it.
+func applyCheckoutChange(change *shared.Checkout, local bool) (*shared.Checkout, bool) {
+	checkoutsLock.Lock()
+	defer checkoutsLock.Unlock()
+
+	checkoutID := change.CheckoutID
+	if checkoutID == "" {
+		checkoutID = pendingCheckouts[change.OrderID]
+	}
+	stored, found := checkouts[checkoutID]
+
+	if change.State == shared.CHECKOUT_STATE_PENDING {
+		if found {
+			// our own checkout, read back from the topic
+			return nil, false
+		}
+		storeCheckout(&gatewayCheckout{Checkout: *change, local: local, done: make(chan struct{})})
+		checkout := *change
+		return &checkout, local
+	}
+
+	// finished checkouts stay as they are, e.g. a saga that ended after its
+	// checkout timed out
+	if !found || stored.State != shared.CHECKOUT_STATE_PENDING {
+		return nil, false
+	}
+	stored.State = change.State
+	stored.Status = change.Status
+	stored.Finished = change.Finished
+	if pendingCheckouts[stored.OrderID] == checkoutID {
+		delete(pendingCheckouts, stored.OrderID)
+	}
+	close(stored.done)
+	checkout := stored.Checkout
+	return &checkout, stored.local
+}
+
+// storeCheckout adds a pending checkout and drops the ones past the
+// retention. It is called with checkoutsLock held.
+func storeCheckout(checkout *gatewayCheckout) {
+	for storedID, old := range checkouts {
+		if time.Since(old.Created) > checkoutRetention {
+			delete(checkouts, storedID)
+			if old.IdempotencyKey != "" && idempotentCheckouts[old.IdempotencyKey] == storedID {
+				delete(idempotentCheckouts, old.IdempotencyKey)
+			}
+		}
+	}
+	checkouts[checkout.CheckoutID] = checkout
+	pendingCheckouts[checkout.OrderID] = checkout.CheckoutID
+	if checkout.IdempotencyKey != "" {
+		idempotentCheckouts[checkout.IdempotencyKey] = checkout.CheckoutID
+	}
+}
+
+// startCheckout stores a pending checkout of the order accepted by this
+// replica and announces it to the others. A request with the Idempotency-Key
+// of a known checkout gets that checkout back instead, created is false then.
+// A pending checkout of the order with another key is errCheckoutInProgress
+// and is returned as well.
+func startCheckout(orderID string, idempotencyKey string, callbackURL string) (error, shared.Checkout, bool) {
+	checkoutsLock.Lock()
+	if idempotencyKey != "" {
+		if stored, found := checkouts[idempotentCheckouts[idempotencyKey]]; found {
+			checkoutsLock.Unlock()
+			if stored.OrderID != orderID {
+				return errIdempotencyKeyReused, shared.Checkout{}, false
+			}
+			return nil, stored.Checkout, false
+		}
+	}
+	// a checkout whose replica went away stays pending, the order service
+	// takes it over after twice the checkout timeout as well
+	stored, found := checkouts[pendingCheckouts[orderID]]
+	if found && time.Since(stored.Created) < 2*shared.AppConfig.Timeouts.Checkout {
+		checkoutsLock.Unlock()
+		return errCheckoutInProgress, stored.Checkout, false
+	}
+
+	checkout := shared.Checkout{
+		CheckoutID:     shared.GetNewID().String(),
+		OrderID:        orderID,
+		State:          shared.CHECKOUT_STATE_PENDING,
+		IdempotencyKey: idempotencyKey,
+		CallbackURL:    callbackURL,
+		Created:        time.Now().UTC(),
+	}
+	storeCheckout(&gatewayCheckout{Checkout: checkout, local: true, done: make(chan struct{})})
+	checkoutsLock.Unlock()
+
+	publishErr := shared.PublishCheckout(&checkout)
+	if publishErr != nil {
+		slog.Error("Publish checkout error", shared.LogCheckoutID, checkout.CheckoutID, shared.LogOrderID, orderID, shared.LogError, publishErr)
+	}
+	// the saga result may never come
+	time.AfterFunc(shared.AppConfig.Timeouts.Checkout, func() {
+		if finishCheckout(checkout.CheckoutID, orderID, shared.CHECKOUT_STATE_TIMED_OUT, http.StatusGatewayTimeout) {
+			slog.Warn("Checkout timed out", shared.LogCheckoutID, checkout.CheckoutID, shared.LogOrderID, orderID)
+		}
+	})
+	return nil, checkout, true
+}
+
+// finishCheckout ends a checkout of this replica without a saga result, and
+// announces it to the others. It returns false when the checkout was already
+// finished.
+func finishCheckout(checkoutID string, orderID string, state string, status int) bool {
+	finished := time.Now().UTC()
+	change := shared.Checkout{
+		CheckoutID: checkoutID,
+		OrderID:    orderID,
+		State:      state,
+		Status:     status,
+		Finished:   &finished,
+	}
+	checkout, _ := applyCheckoutChange(&change, true)
+	if checkout == nil {
+		return false
+	}
+	publishErr := shared.PublishCheckout(&change)
+	if publishErr != nil {
+		slog.Error("Publish checkout error", shared.LogCheckoutID, checkoutID, shared.LogOrderID, orderID, shared.LogError, publishErr)
+	}
+	if checkout.CallbackURL != "" {
+		go postCallback(*checkout)
+	}
+	return true
+}
+
+func getCheckout(checkoutID string) (shared.Checkout, bool) {
+	checkoutsLock.Lock()
+	defer checkoutsLock.Unlock()
+	stored, found := checkouts[checkoutID]
+	if !found {
+		return shared.Checkout{}, false
+	}
+	return stored.Checkout, true
+}
+
+// awaitCheckout waits until the checkout finishes and returns it. A checkout
+// of another replica that does not finish in time, e.g. because that replica
+// went away, is answered with 504 without finishing it.
+func awaitCheckout(checkoutID string) shared.Checkout {
+	checkoutsLock.Lock()
+	stored, found := checkouts[checkoutID]
+	checkoutsLock.Unlock()
+	if !found {
+		return shared.Checkout{CheckoutID: checkoutID, State: shared.CHECKOUT_STATE_TIMED_OUT, Status: http.StatusGatewayTimeout}
+	}
+
+	select {
+	case <-stored.done:
+	case <-time.After(shared.AppConfig.Timeouts.Checkout):
+	}
+	checkout, _ := getCheckout(checkoutID)
+	if checkout.State == shared.CHECKOUT_STATE_PENDING {
+		checkout.Status = http.StatusGatewayTimeout
+	}
+	return checkout
+}
+
+// postCallback posts the finished checkout as JSON to its callback URL. Any
+// 2xx answer is taken as delivered, otherwise it is tried a few times.
+func postCallback(checkout shared.Checkout) {
+	body, encodeErr := json.Marshal(checkout)
+	if encodeErr != nil {
+		slog.Error("Encode callback error", shared.LogCheckoutID, checkout.CheckoutID, shared.LogError, encodeErr)
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		resp, postErr := callbackClient.Post(checkout.CallbackURL, "application/json", bytes.NewReader(body))
+		if postErr == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			slog.Warn("Callback answered with an error", shared.LogCheckoutID, checkout.CheckoutID, "status", resp.StatusCode)
+		} else {
+			slog.Warn("Callback error", shared.LogCheckoutID, checkout.CheckoutID, shared.LogError, postErr)
+		}
+		if attempt < callbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	slog.Error("Giving up on the callback", shared.LogCheckoutID, checkout.CheckoutID, "callback_url", checkout.CallbackURL)
+}
+
+func writeCheckout(w http.ResponseWriter, status int, checkout shared.Checkout) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	jsonEncodeErr := json.NewEncoder(w).Encode(checkout)
+	if jsonEncodeErr != nil {
+		slog.Error("Encode checkout error", shared.LogCheckoutID, checkout.CheckoutID, shared.LogError, jsonEncodeErr)
+	}
+}
+
+func checkoutStatusHandler(w http.ResponseWriter, r *http.Request) {
+	checkout, found := getCheckout(mux.Vars(r)["checkout_id"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeCheckout(w, http.StatusOK, checkout)
+}
@@ -0,0 +1,73 @@
+// Package local runs all services in one process on in-memory backends, for
+// development without Kafka, Mongo or MySQL.
+package local
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	apigateway "main/api-gateway"
+	"main/lockmaster"
+	"main/order"
+	"main/payment"
+	"main/shared"
+	"main/stock"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Run serves all services on PORT with the same paths as nginx.
+func Run() {
+	// one tracer provider for the process, the spans tell the services apart
+	// by their names and routes
+	defer shared.SetUpTracing("local")()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	addr := fmt.Sprintf(":%s", port)
+	slog.Info("Starting local mode", "addr", addr)
+	serveErr := http.ListenAndServe(addr, Start("http://localhost"+addr))
+	shared.Fatal("Serve error", shared.LogError, serveErr)
+}
+
+// Start starts all services on in-memory backends and topics and returns one
+// handler that routes to them like nginx. The services call each other at
+// baseURL, so it must be where the handler is served.
+func Start(baseURL string) http.Handler {
+	shared.ServiceName = "local"
+	shared.UseTransport(shared.NewMemoryTransport())
+
+	gatewayRoutes := apigateway.StartLocal()
+	orderRoutes := order.StartLocal()
+	stockRoutes := stock.StartLocal()
+	paymentRoutes := payment.StartLocal()
+	lockmasterRoutes := lockmaster.StartLocal()
+
+	mux := http.NewServeMux()
+	// the metrics of all services, they share the registry of the process
+	mux.Handle("/metrics", promhttp.Handler())
+	// the probes of the process, every service has them under its prefix too
+	mux.HandleFunc("/healthz", shared.HealthzHandler)
+	mux.HandleFunc("/readyz", shared.ReadyzHandler)
+	// the public paths of nginx
+	mux.Handle("/orders/checkout/", http.StripPrefix("/orders/checkout", gatewayRoutes))
+	mux.Handle("/orders/", http.StripPrefix("/orders", orderRoutes))
+	mux.Handle("/stock/", http.StripPrefix("/stock", stockRoutes))
+	mux.Handle("/payment/", http.StripPrefix("/payment", paymentRoutes))
+	mux.Handle("/lockmaster/", http.StripPrefix("/lockmaster", lockmasterRoutes))
+
+	// the services call each other directly like the k8s services, nginx
+	// sends /orders/checkout/ to the gateway and not to the order service
+	mux.Handle("/services/order/", http.StripPrefix("/services/order", orderRoutes))
+	mux.Handle("/services/stock/", http.StripPrefix("/services/stock", stockRoutes))
+	shared.AppConfig.Services.Order = baseURL + "/services/order"
+	shared.AppConfig.Services.Stock = baseURL + "/services/stock"
+	shared.AppConfig.Services.Lockmaster = baseURL + "/lockmaster"
+
+	return mux
+}
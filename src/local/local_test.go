@@ -0,0 +1,163 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"main/shared"
+)
+
+// findConfigDir returns the config directory above the working directory, it
+// is next to src in the repo and next to the sources in the image
+func findConfigDir(t *testing.T) string {
+	t.Helper()
+	dir, wdErr := os.Getwd()
+	if wdErr != nil {
+		t.Fatalf("working directory: %v", wdErr)
+	}
+	for {
+		configDir := filepath.Join(dir, "config")
+		if _, statErr := os.Stat(filepath.Join(configDir, "sagas.yaml")); statErr == nil {
+			return configDir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatalf("no config directory above the working directory")
+		}
+		dir = parent
+	}
+}
+
+// startTestServer serves Start on an httptest server with the config of the
+// repo on the memory transport
+func startTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	configDir := findConfigDir(t)
+	t.Setenv("MESSAGING_TRANSPORT", "memory")
+	t.Setenv("SAGA_STEP_TIMEOUT", "5s")
+	t.Setenv("CHECKOUT_TIMEOUT", "10s")
+	t.Setenv("SAGA_DEFINITIONS", filepath.Join(configDir, "sagas.yaml"))
+	loadErr, config := shared.LoadConfig(filepath.Join(configDir, "config.yaml"))
+	if loadErr != nil {
+		t.Fatalf("load config: %v", loadErr)
+	}
+	shared.AppConfig = config
+
+	// Start needs the URL of the server, which exists only once it serves
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	handler = Start(server.URL)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call sends a request to the server and decodes the JSON answer into
+// response unless it is nil. It returns the status code.
+func call(t *testing.T, server *httptest.Server, method string, path string, response interface{}) int {
+	t.Helper()
+	request, requestErr := http.NewRequest(method, server.URL+path, nil)
+	if requestErr != nil {
+		t.Fatalf("request %s: %v", path, requestErr)
+	}
+	httpResponse, doErr := server.Client().Do(request)
+	if doErr != nil {
+		t.Fatalf("%s %s: %v", method, path, doErr)
+	}
+	defer httpResponse.Body.Close()
+	if response != nil && httpResponse.StatusCode == http.StatusOK {
+		decodeErr := json.NewDecoder(httpResponse.Body).Decode(response)
+		if decodeErr != nil {
+			t.Fatalf("decode %s: %v", path, decodeErr)
+		}
+	}
+	return httpResponse.StatusCode
+}
+
+func mustCall(t *testing.T, server *httptest.Server, method string, path string, response interface{}) {
+	t.Helper()
+	if status := call(t, server, method, path, response); status != http.StatusOK {
+		t.Fatalf("%s %s answered %d", method, path, status)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	server := startTestServer(t)
+
+	tests := []struct {
+		name       string
+		stock      int64
+		credit     int64
+		quantity   int64
+		wantStatus int
+		wantStock  int64
+		wantCredit int64
+		wantPaid   bool
+	}{
+		{
+			name:       "enough stock and credit",
+			stock:      5,
+			credit:     100,
+			quantity:   2,
+			wantStatus: http.StatusOK,
+			wantStock:  3,
+			wantCredit: 80,
+			wantPaid:   true,
+		},
+		{
+			name:       "not enough stock",
+			stock:      1,
+			credit:     100,
+			quantity:   2,
+			wantStatus: http.StatusBadRequest,
+			wantStock:  1,
+			wantCredit: 100,
+		},
+		{
+			name:       "not enough credit",
+			stock:      5,
+			credit:     10,
+			quantity:   2,
+			wantStatus: http.StatusBadRequest,
+			wantStock:  5,
+			wantCredit: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var user shared.User
+			mustCall(t, server, http.MethodPost, "/payment/create_user", &user)
+			mustCall(t, server, http.MethodPost, fmt.Sprintf("/payment/add_funds/%s/%d", user.UserID, test.credit), nil)
+			var item shared.Item
+			mustCall(t, server, http.MethodPost, "/stock/item/create/10", &item)
+			mustCall(t, server, http.MethodPost, fmt.Sprintf("/stock/add/%s/%d", item.ItemID, test.stock), nil)
+			var order shared.Order
+			mustCall(t, server, http.MethodPost, "/orders/create/"+user.UserID, &order)
+			mustCall(t, server, http.MethodPost, fmt.Sprintf("/orders/addItem/%s/%s/%d", order.OrderID, item.ItemID, test.quantity), nil)
+
+			if status := call(t, server, http.MethodPost, "/orders/checkout/"+order.OrderID, nil); status != test.wantStatus {
+				t.Fatalf("checkout answered %d, want %d", status, test.wantStatus)
+			}
+
+			mustCall(t, server, http.MethodGet, "/stock/find/"+item.ItemID, &item)
+			if item.Stock != test.wantStock {
+				t.Errorf("stock is %d, want %d", item.Stock, test.wantStock)
+			}
+			mustCall(t, server, http.MethodGet, "/payment/find_user/"+user.UserID, &user)
+			if user.Credit != test.wantCredit {
+				t.Errorf("credit is %d, want %d", user.Credit, test.wantCredit)
+			}
+			mustCall(t, server, http.MethodGet, "/orders/find/"+order.OrderID, &order)
+			if order.Paid != test.wantPaid {
+				t.Errorf("order is paid %v, want %v", order.Paid, test.wantPaid)
+			}
+		})
+	}
+}
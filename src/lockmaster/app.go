@@ -1,8 +1,13 @@
-package main
+package lockmaster
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 
 	"main/shared"
 )
@@ -12,79 +17,253 @@ type Action struct {
 	topic       string
 }
 
-// Maps incoming message to outgoing message
-var successfulActionMap = map[string]Action{
-	// Normal checkout
-	"START-CHECKOUT-SAGA": {"START-SUBTRACT-STOCK", "stock-syn"},
-	"END-SUBTRACT-STOCK":  {"START-MAKE-PAYMENT", "payment-syn"},
-	"END-MAKE-PAYMENT":    {"START-UPDATE-ORDER", "order-syn"},
-	"END-UPDATE-ORDER":    {"END-CHECKOUT-SAGA", ""},
-	// Rollback checkout
-	"END-CANCEL-PAYMENT": {"START-READD-STOCK", "stock-syn"},
-	"END-READD-STOCK":    {"END-CHECKOUT-SAGA", ""},
-}
+var dbConn SagaStore
+
+// Run orchestrates the sagas with the saga log in MySQL, stores the dead
+// letters of all services and serves the saga inspection API.
+func Run() {
+	shared.ServiceName = "lockmaster"
+	defer shared.SetUpTracing("lockmaster")()
+
+	definitionsErr := loadSagaDefinitions(getSagaDefinitionsPath())
+	if definitionsErr != nil {
+		shared.Fatal("Failed to load the saga definitions", shared.LogError, definitionsErr)
+	}
+
+	mysqlConn := makeMySQLConnection()
+	defer mysqlConn.close()
+	dbConn = mysqlConn
+	deadLetters = mysqlConn
+
+	recoverSagas()
+	startTimeoutScheduler()
+	setUpDeadLetterListener()
+	go serveSagaAPI()
 
-// Maps message before ABORT to outgoing message
-var failActionMap = map[string]Action{
-	// Stock Fails
-	"START-SUBTRACT-STOCK": {"END-CHECKOUT-SAGA", ""},
-	// Payment Fails
-	"START-MAKE-PAYMENT": {"START-READD-STOCK", "stock-syn"},
-	// Order Fails
-	"START-UPDATE-ORDER": {"START-CANCEL-PAYMENT", "payment-syn"},
+	setUpSagaListener()
 }
 
-var dbConn MySQLConnection
+// StartLocal orchestrates the sagas with an in-memory saga log and returns
+// the routes of the saga inspection API, for the local mode.
+func StartLocal() http.Handler {
+	definitionsErr := loadSagaDefinitions(getSagaDefinitionsPath())
+	if definitionsErr != nil {
+		shared.Fatal("Failed to load the saga definitions", shared.LogError, definitionsErr)
+	}
 
-func main() {
-	dbConn = makeMySQLConnection()
-	defer dbConn.db.Close()
+	dbConn = newMemorySagaStore()
+	deadLetters = newMemoryDeadLetterStore()
+	startTimeoutScheduler()
+	setUpDeadLetterListener()
+	go setUpSagaListener()
+	return NewRouter()
+}
 
-	shared.SetUpKafkaListener(
+func setUpSagaListener() {
+	shared.SetUpSagaListener(
 		[]string{"order", "stock", "payment"}, true,
-		func(message *shared.SagaMessage) (*shared.SagaMessage, string) {
-
-			var nextAction Action
-			var messageResponseAvailable bool
-			statusCallback := http.StatusOK
-
-			if message.Name == "ABORT-CHECKOUT-SAGA" {
-				_, previousLog := dbConn.getLatestSagaLog(message.SagaID)
-				_, previousMessage := sagaLogToSagaMessage(previousLog)
-
-				nextAction, messageResponseAvailable = failActionMap[previousMessage.Name]
-				statusCallback = shared.RouteCheckoutCall(message.Order.OrderID, http.StatusBadRequest)
-			} else {
-				nextAction, messageResponseAvailable = successfulActionMap[message.Name]
-				if nextAction.nextMessage == "END-CHECKOUT-SAGA" {
-					statusCallback = shared.RouteCheckoutCall(message.Order.OrderID, http.StatusOK)
-				}
-			}
-
-			log.Print(message.Order.OrderID, http.StatusBadRequest, statusCallback)
-
-			if !messageResponseAvailable {
-				return nil, ""
-			}
-
-			if message.SagaID == -1 {
-				_, sagaID := dbConn.createSaga()
-				message.SagaID = *sagaID
-			}
-
-			_, sagaLogIn := sagaMessageToSagaLog(message)
-			dbConn.insertSagaLog(sagaLogIn)
-
-			outMessage := shared.SagaMessage{
-				Name:   nextAction.nextMessage,
-				SagaID: message.SagaID,
-				Order:  message.Order,
-			}
-
-			_, sagaLogOut := sagaMessageToSagaLog(&outMessage)
-			dbConn.insertSagaLog(sagaLogOut)
-
-			return &outMessage, nextAction.topic
-		},
+		handleSagaMessage,
 	)
 }
+
+// handleSagaMessage advances the saga of a message. A database error is
+// returned, the listener tries the message again and dead-letters it when it
+// keeps failing.
+func handleSagaMessage(ctx context.Context, message *shared.SagaMessage) (error, *shared.SagaMessage, string) {
+	var sagaConn SagaConnection
+	if message.SagaID == -1 {
+		if _, found := getSagaStateMachineOfStart(message.Name); !found {
+			slog.InfoContext(ctx, "Ignoring message without saga", "message", message.Name)
+			return nil, nil, ""
+		}
+		// the saga is only created with the logs of its START
+		createErr, sagaID, createdConn := dbConn.createSaga(ctx)
+		if createErr != nil {
+			return fmt.Errorf("create saga: %w", createErr), nil, ""
+		}
+		message.SagaID = *sagaID
+		ctx = shared.WithLogFields(ctx, slog.Int64(shared.LogSagaID, *sagaID))
+		sagaConn = createdConn
+	} else {
+		lockErr, lockedConn := dbConn.lockSaga(ctx, message.SagaID)
+		if lockErr != nil {
+			return fmt.Errorf("lock saga: %w", lockErr), nil, ""
+		}
+		sagaConn = lockedConn
+	}
+	defer sagaConn.rollback()
+
+	latestErr, latestLog := sagaConn.getLatestSagaLog(message.SagaID)
+	if latestErr != nil && !errors.Is(latestErr, sql.ErrNoRows) {
+		return fmt.Errorf("get latest saga log: %w", latestErr), nil, ""
+	}
+	if !isExpectedMessage(latestLog, message) {
+		slog.InfoContext(ctx, "Ignoring stale message", "message", message.Name)
+		return nil, nil, ""
+	}
+
+	machineErr, stateMachine := getSagaStateMachine(sagaConn, message.SagaID)
+	if machineErr != nil && !errors.Is(machineErr, sql.ErrNoRows) {
+		return fmt.Errorf("get saga state machine: %w", machineErr), nil, ""
+	}
+	if stateMachine == nil {
+		// the START message of a new saga is not logged yet
+		stateMachine, _ = getSagaStateMachineOfStart(message.Name)
+	}
+
+	advanceErr, transition := advanceSaga(sagaConn, stateMachine, message)
+	if advanceErr != nil {
+		return fmt.Errorf("advance saga: %w", advanceErr), nil, ""
+	}
+	if transition == nil {
+		return nil, nil, ""
+	}
+
+	commitErr := sagaConn.commit()
+	if commitErr != nil {
+		return fmt.Errorf("commit saga: %w", commitErr), nil, ""
+	}
+	transition.applyEffects()
+	return nil, transition.message, transition.topic
+}
+
+// sagaTransition is a logged but not yet committed step of a saga: the message
+// to send next and the effects outside the saga log. Both only happen once the
+// saga log is committed.
+type sagaTransition struct {
+	message *shared.SagaMessage
+	topic   string
+	// status the checkout is released with, 0 to leave the gateway waiting
+	releaseStatus int
+	// records the metrics of the transition, read from the log before the
+	// commit
+	observe func()
+}
+
+// applyEffects releases the gateway and records the metrics of a committed
+// transition
+func (transition *sagaTransition) applyEffects() {
+	if transition.releaseStatus != 0 {
+		releaseGateway(&transition.message.Order, transition.releaseStatus)
+	}
+	if transition.observe != nil {
+		transition.observe()
+	}
+}
+
+// advanceSaga looks up the transition for an incoming message and logs both
+// the incoming and the outgoing message. It returns the transition, or nil
+// when the message has none. The saga has to be locked by the caller, who
+// commits before applying the transition.
+func advanceSaga(sagaConn SagaConnection, stateMachine *SagaStateMachine, message *shared.SagaMessage) (error, *sagaTransition) {
+	return advanceSagaOnFail(sagaConn, stateMachine, message, stateMachine.failActionMap)
+}
+
+// abortSagaStep aborts the pending step of the saga without an answer of its
+// participant. The step may have run, its compensation runs first.
+func abortSagaStep(sagaConn SagaConnection, stateMachine *SagaStateMachine, latestMessage *shared.SagaMessage) (error, *sagaTransition) {
+	abortMessage := shared.SagaMessage{
+		Name:   "ABORT-" + stateMachine.name,
+		SagaID: latestMessage.SagaID,
+		Order:  latestMessage.Order,
+	}
+	return advanceSagaOnFail(sagaConn, stateMachine, &abortMessage, stateMachine.timeoutActionMap)
+}
+
+// advanceSagaOnFail is advanceSaga with the transitions of an ABORT from
+// failActions
+func advanceSagaOnFail(sagaConn SagaConnection, stateMachine *SagaStateMachine, message *shared.SagaMessage, failActions map[string]Action) (error, *sagaTransition) {
+	var nextAction Action
+	var messageResponseAvailable bool
+	releaseStatus := 0
+
+	if strings.HasPrefix(message.Name, "ABORT-") {
+		previousErr, previousLog := sagaConn.getLatestSagaLogOfType(message.SagaID, messageTypeMapStringToInt["START"])
+		if previousErr != nil {
+			return previousErr, nil
+		}
+		convErr, previousMessage := sagaLogToSagaMessage(previousLog)
+		if convErr != nil {
+			return convErr, nil
+		}
+
+		nextAction, messageResponseAvailable = failActions[previousMessage.Name]
+		if stateMachine.releaseGateway {
+			releaseStatus = http.StatusBadRequest
+		}
+	} else {
+		nextAction, messageResponseAvailable = stateMachine.successfulActionMap[message.Name]
+		if stateMachine.releaseGateway && nextAction.nextMessage == "END-"+stateMachine.name {
+			releaseStatus = http.StatusOK
+		}
+	}
+
+	if !messageResponseAvailable {
+		return nil, nil
+	}
+	observe := observeSagaAdvance(sagaConn, stateMachine, message, nextAction.nextMessage)
+
+	inErr, sagaLogIn := sagaMessageToSagaLog(message)
+	if inErr != nil {
+		return inErr, nil
+	}
+	insertInErr := sagaConn.insertSagaLog(sagaLogIn)
+	if insertInErr != nil {
+		return insertInErr, nil
+	}
+
+	outMessage := shared.SagaMessage{
+		Name:          nextAction.nextMessage,
+		SagaID:        message.SagaID,
+		Order:         message.Order,
+		Saga:          stateMachine.name,
+		CorrelationID: message.CorrelationID,
+	}
+
+	outErr, sagaLogOut := sagaMessageToSagaLog(&outMessage)
+	if outErr != nil {
+		return outErr, nil
+	}
+	insertOutErr := sagaConn.insertSagaLog(sagaLogOut)
+	if insertOutErr != nil {
+		return insertOutErr, nil
+	}
+
+	return nil, &sagaTransition{
+		message:       &outMessage,
+		topic:         nextAction.topic,
+		releaseStatus: releaseStatus,
+		observe:       observe,
+	}
+}
+
+// releaseGateway sends the result of a checkout saga to the api gateway
+// replicas, the one that holds the checkout answers it. The order service
+// clears the checkout of the order with it.
+func releaseGateway(order *shared.Order, status int) {
+	checkoutID := ""
+	if order.Checkout != nil {
+		checkoutID = order.Checkout.CheckoutID
+	}
+	publishErr := shared.PublishCheckoutResult(order.OrderID, checkoutID, status)
+	if publishErr != nil {
+		slog.Error("Release checkout error", shared.LogOrderID, order.OrderID, shared.LogError, publishErr)
+	}
+}
+
+// isExpectedMessage reports whether a message answers the step the saga is
+// currently waiting for. Redelivered or late replies, e.g. for a step that
+// recovery already resent, are not expected and must be ignored.
+func isExpectedMessage(latestLog *SagaLog, message *shared.SagaMessage) bool {
+	if latestLog == nil {
+		return strings.HasPrefix(message.Name, "START-")
+	}
+	_, latestMessage := sagaLogToSagaMessage(latestLog)
+	if latestMessage == nil || !strings.HasPrefix(latestMessage.Name, "START-") {
+		return false
+	}
+	if strings.HasPrefix(message.Name, "ABORT-") {
+		return true
+	}
+	return message.Name == shared.SagaMessageConvertStartToEnd(latestMessage).Name
+}
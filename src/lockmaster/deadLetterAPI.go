@@ -0,0 +1,110 @@
+package lockmaster
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"main/shared"
+)
+
+// listDeadLettersHandler lists the newest dead letters, optionally filtered by
+// ?service=, ?replayed=true|false and at most ?limit= of them.
+func listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	service := query.Get("service")
+
+	var replayed *bool
+	switch query.Get("replayed") {
+	case "":
+	case "true", "false":
+		replayedValue := query.Get("replayed") == "true"
+		replayed = &replayedValue
+	default:
+		http.Error(w, "invalid replayed", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSagaListLimit
+	if query.Get("limit") != "" {
+		convErr, parsedLimit := shared.ConvertStringToInt(query.Get("limit"))
+		if convErr != nil || *parsedLimit <= 0 || *parsedLimit > maxSagaListLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = int(*parsedLimit)
+	}
+
+	queryErr, entries := deadLetters.getDeadLetters(service, replayed, limit)
+	if queryErr != nil {
+		slog.ErrorContext(r.Context(), "List dead letters error", shared.LogError, queryErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []DeadLetterEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncodeErr := json.NewEncoder(w).Encode(entries)
+	if jsonEncodeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func findDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	convErr, deadLetterID := shared.ConvertStringToInt(vars["dead_letter_id"])
+	if convErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	getErr, entry := deadLetters.getDeadLetter(*deadLetterID)
+	if errors.Is(getErr, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if getErr != nil {
+		slog.ErrorContext(r.Context(), "Get dead letter error", shared.LogError, getErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncodeErr := json.NewEncoder(w).Encode(entry)
+	if jsonEncodeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// replayDeadLetterHandler sends the payload of a dead letter to its topic
+// again. A dead letter is replayed once, later replays are refused with 409.
+func replayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	convErr, deadLetterID := shared.ConvertStringToInt(vars["dead_letter_id"])
+	if convErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	replayErr, replayed := replayDeadLetter(*deadLetterID)
+	if errors.Is(replayErr, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if replayErr != nil {
+		slog.ErrorContext(r.Context(), "Replay dead letter error", shared.LogError, replayErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !replayed {
+		http.Error(w, "dead letter was already replayed", http.StatusConflict)
+		return
+	}
+	findDeadLetterHandler(w, r)
+}
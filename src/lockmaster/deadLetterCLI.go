@@ -0,0 +1,95 @@
+package lockmaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"main/shared"
+)
+
+const deadLetterUsage = `usage: dlq list [service] | dlq show <id> | dlq replay <id>`
+
+// RunDeadLetterCLI inspects and replays dead letters through the API of the
+// lockmaster at services.lockmaster, replays with the admin token, e.g. after
+// a port-forward:
+//
+//	LOCKMASTER_URL=http://localhost:5000 go run . dlq list stock
+//	LOCKMASTER_URL=http://localhost:5000 go run . dlq replay 12
+func RunDeadLetterCLI() {
+	var args []string
+	if len(os.Args) > 2 {
+		args = os.Args[2:]
+	}
+	if len(args) == 0 {
+		log.Fatal(deadLetterUsage)
+	}
+	baseURL := strings.TrimSuffix(shared.AppConfig.Services.Lockmaster, "/")
+
+	switch {
+	case args[0] == "list" && len(args) <= 2:
+		listURL := baseURL + "/dead-letters?replayed=false"
+		if len(args) == 2 {
+			listURL += "&service=" + url.QueryEscape(args[1])
+		}
+		var entries []DeadLetterEntry
+		json.Unmarshal(callLockmaster(http.MethodGet, listURL), &entries)
+		printDeadLetters(entries)
+	case args[0] == "show" && len(args) == 2:
+		printJSON(callLockmaster(http.MethodGet, baseURL+"/dead-letters/"+url.PathEscape(args[1])))
+	case args[0] == "replay" && len(args) == 2:
+		printJSON(callLockmaster(http.MethodPost, baseURL+"/dead-letters/"+url.PathEscape(args[1])+"/replay"))
+	default:
+		log.Fatal(deadLetterUsage)
+	}
+}
+
+// callLockmaster returns the body of a successful response and exits on
+// anything else
+func callLockmaster(method string, requestURL string) []byte {
+	request, requestErr := http.NewRequest(method, requestURL, nil)
+	if requestErr != nil {
+		log.Fatal(requestErr)
+	}
+	if token := shared.AppConfig.Admin.Token; token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, responseErr := http.DefaultClient.Do(request)
+	if responseErr != nil {
+		log.Fatal(responseErr)
+	}
+	defer response.Body.Close()
+	body, readErr := io.ReadAll(response.Body)
+	if readErr != nil {
+		log.Fatal(readErr)
+	}
+	if response.StatusCode != http.StatusOK {
+		log.Fatalf("%s %s: %s %s", method, requestURL, response.Status, strings.TrimSpace(string(body)))
+	}
+	return body
+}
+
+func printDeadLetters(entries []DeadLetterEntry) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSERVICE\tTOPIC\tKEY\tATTEMPTS\tFAILED AT\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n", entry.ID, entry.Service, entry.Topic, entry.Key, entry.Attempts, entry.FailedAt.Format("2006-01-02 15:04:05"), entry.Error)
+	}
+	writer.Flush()
+}
+
+func printJSON(body []byte) {
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") != nil {
+		os.Stdout.Write(body)
+		return
+	}
+	fmt.Println(indented.String())
+}
@@ -0,0 +1,175 @@
+package lockmaster
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"main/shared"
+)
+
+// DeadLetterStore keeps the dead letters of all services, in MySQL or in
+// memory in local mode. Missing dead letters are reported as sql.ErrNoRows.
+type DeadLetterStore interface {
+	insertDeadLetter(deadLetter *shared.DeadLetter) error
+	// getDeadLetters returns the newest dead letters, of one service and
+	// replay state when they are set
+	getDeadLetters(service string, replayed *bool, limit int) (error, []DeadLetterEntry)
+	getDeadLetter(deadLetterID int64) (error, *DeadLetterEntry)
+	// setDeadLetterReplayed marks the dead letter replayed or not and reports
+	// whether it was in the other state, so a dead letter is replayed once.
+	setDeadLetterReplayed(deadLetterID int64, replayed bool) (error, bool)
+}
+
+// DeadLetterEntry is a stored dead letter
+type DeadLetterEntry struct {
+	ID int64 `json:"id"`
+	shared.DeadLetter
+	Received time.Time  `json:"received"`
+	Replayed *time.Time `json:"replayed,omitempty"`
+}
+
+var deadLetters DeadLetterStore
+
+// memoryDeadLetterStore keeps the dead letters in memory, they are lost with
+// the process
+type memoryDeadLetterStore struct {
+	mu      sync.Mutex
+	entries []DeadLetterEntry
+}
+
+func newMemoryDeadLetterStore() *memoryDeadLetterStore {
+	return &memoryDeadLetterStore{}
+}
+
+func (store *memoryDeadLetterStore) insertDeadLetter(deadLetter *shared.DeadLetter) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.entries = append(store.entries, DeadLetterEntry{
+		ID:         int64(len(store.entries) + 1),
+		DeadLetter: *deadLetter,
+		Received:   time.Now(),
+	})
+	return nil
+}
+
+func (store *memoryDeadLetterStore) getDeadLetters(service string, replayed *bool, limit int) (error, []DeadLetterEntry) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var entries []DeadLetterEntry
+	for i := len(store.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := store.entries[i]
+		if service != "" && entry.Service != service {
+			continue
+		}
+		if replayed != nil && (entry.Replayed != nil) != *replayed {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return nil, entries
+}
+
+func (store *memoryDeadLetterStore) getDeadLetter(deadLetterID int64) (error, *DeadLetterEntry) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if deadLetterID <= 0 || deadLetterID > int64(len(store.entries)) {
+		return sql.ErrNoRows, nil
+	}
+	entry := store.entries[deadLetterID-1]
+	return nil, &entry
+}
+
+func (store *memoryDeadLetterStore) setDeadLetterReplayed(deadLetterID int64, replayed bool) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if deadLetterID <= 0 || deadLetterID > int64(len(store.entries)) {
+		return sql.ErrNoRows, false
+	}
+	entry := &store.entries[deadLetterID-1]
+	if (entry.Replayed != nil) == replayed {
+		return nil, false
+	}
+	entry.Replayed = nil
+	if replayed {
+		now := time.Now()
+		entry.Replayed = &now
+	}
+	return nil, true
+}
+
+// setUpDeadLetterListener stores the dead letters of all services, so they
+// can be inspected and replayed through the API. The lockmaster replicas share
+// a group, so every dead letter is stored once.
+func setUpDeadLetterListener() {
+	for _, service := range shared.DeadLetterServices {
+		topic := shared.DeadLetterTopic(service)
+		subscribeErr, subscription := shared.Subscribe(topic, "lockmaster-dlq-group")
+		if subscribeErr != nil {
+			shared.Fatal("Subscribe error", shared.LogTopic, topic, shared.LogError, subscribeErr)
+		}
+		go receiveDeadLetters(topic, subscription)
+	}
+}
+
+func receiveDeadLetters(topic string, subscription shared.Subscription) {
+	defer subscription.Close()
+	topicCtx := shared.WithLogFields(context.Background(), slog.String(shared.LogTopic, topic))
+	for {
+		receiveErr, m := subscription.Receive(topicCtx)
+		if receiveErr != nil {
+			slog.ErrorContext(topicCtx, "Read message error", shared.LogError, receiveErr)
+			continue
+		}
+		storeDeadLetter(topicCtx, m)
+		commitErr := subscription.Commit(topicCtx, m)
+		if commitErr != nil {
+			slog.ErrorContext(topicCtx, "Commit message error", shared.LogError, commitErr)
+		}
+	}
+}
+
+// storeDeadLetter returns once the dead letter is stored, it is only kept in
+// the database
+func storeDeadLetter(ctx context.Context, m *shared.Message) {
+	parseErr, deadLetter := shared.ParseDeadLetter(m.Value)
+	if parseErr != nil {
+		slog.WarnContext(ctx, "Dropping dead letter that cannot be parsed", shared.LogError, parseErr, "payload", string(m.Value))
+		return
+	}
+	slog.WarnContext(ctx, "Received dead letter", "dead_letter_topic", deadLetter.Topic, shared.LogError, deadLetter.Error)
+
+	for {
+		insertErr := deadLetters.insertDeadLetter(deadLetter)
+		if insertErr == nil {
+			return
+		}
+		slog.ErrorContext(ctx, "Store dead letter error", "dead_letter_topic", deadLetter.Topic, shared.LogError, insertErr)
+		time.Sleep(shared.AppConfig.Messaging.MaxBackoff)
+	}
+}
+
+// replayDeadLetter sends a dead letter to its topic again. It returns false
+// when the dead letter was already replayed.
+func replayDeadLetter(deadLetterID int64) (error, bool) {
+	getErr, entry := deadLetters.getDeadLetter(deadLetterID)
+	if getErr != nil {
+		return getErr, false
+	}
+	markErr, marked := deadLetters.setDeadLetterReplayed(deadLetterID, true)
+	if markErr != nil || !marked {
+		return markErr, false
+	}
+
+	replayErr := shared.ReplayDeadLetter(&entry.DeadLetter)
+	if replayErr != nil {
+		// allow another replay
+		unmarkErr, _ := deadLetters.setDeadLetterReplayed(deadLetterID, false)
+		return errors.Join(replayErr, unmarkErr), false
+	}
+	slog.Info("Replayed dead letter", "dead_letter_id", deadLetterID, shared.LogTopic, entry.Topic)
+	return nil, true
+}
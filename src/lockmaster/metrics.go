@@ -0,0 +1,67 @@
+package lockmaster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"main/shared"
+)
+
+var (
+	sagasTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lockmaster_sagas_total",
+		Help: "Sagas by outcome: started, succeeded or aborted.",
+	}, []string{"saga", "outcome"})
+
+	sagaStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lockmaster_saga_step_duration_seconds",
+		Help:    "Time from the START of a saga step to its END or ABORT.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"saga", "step", "result"})
+)
+
+// observeSagaAdvance reads a saga that starts or ends and the duration of the
+// step the message answers from the log, before the message and the next one
+// are logged. It returns the function that records them once the transition is
+// committed. A saga ends aborted when an ABORT arrived at any point, even if
+// all its compensations ran.
+func observeSagaAdvance(sagaConn SagaConnection, stateMachine *SagaStateMachine, message *shared.SagaMessage, nextMessage string) func() {
+	var observations []func()
+	if message.Name == "START-"+stateMachine.name {
+		observations = append(observations, sagasTotal.WithLabelValues(stateMachine.name, "started").Inc)
+	} else {
+		startErr, startLog := sagaConn.getLatestSagaLogOfType(message.SagaID, messageTypeMapStringToInt["START"])
+		if startErr == nil {
+			_, startMessage := sagaLogToSagaMessage(startLog)
+			if startMessage != nil {
+				result := "end"
+				if strings.HasPrefix(message.Name, "ABORT-") {
+					result = "abort"
+				}
+				step := strings.TrimPrefix(startMessage.Name, "START-")
+				duration := time.Since(startLog.Timestamp).Seconds()
+				observations = append(observations, func() {
+					sagaStepDuration.WithLabelValues(stateMachine.name, step, result).Observe(duration)
+				})
+			}
+		}
+	}
+
+	if nextMessage == "END-"+stateMachine.name {
+		outcome := "succeeded"
+		abortErr, _ := sagaConn.getLatestSagaLogOfType(message.SagaID, messageTypeMapStringToInt["ABORT"])
+		if abortErr == nil || strings.HasPrefix(message.Name, "ABORT-") {
+			outcome = "aborted"
+		}
+		observations = append(observations, sagasTotal.WithLabelValues(stateMachine.name, outcome).Inc)
+	}
+
+	return func() {
+		for _, observe := range observations {
+			observe()
+		}
+	}
+}
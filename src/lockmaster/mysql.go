@@ -1,12 +1,20 @@
-package main
+package lockmaster
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"log"
+	"database/sql/driver"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
 	"time"
 
+	"main/shared"
+
+	"github.com/XSAM/otelsql"
 	_ "github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 type Saga struct {
@@ -21,45 +29,62 @@ type SagaLog struct {
 	MessageEvent int64
 	SagaContents string
 	Timestamp    time.Time
+	// who ran a manual saga command and why, only set on its audit log
+	Actor  string
+	Reason string
 }
 
 type MySQLConnection struct {
 	db *sql.DB
+	tx *sql.Tx
+	// the queries of a locked saga run in the trace of its message
+	ctx context.Context
+}
+
+// sqlExecutor is implemented by both *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 }
 
-func makeMySQLConnection() MySQLConnection {
-	dbConn = MySQLConnection{}
-	dbConn.init()
-	return dbConn
+func makeMySQLConnection() *MySQLConnection {
+	mysqlConn := &MySQLConnection{}
+	mysqlConn.init()
+	return mysqlConn
 }
 
 func (dbConn *MySQLConnection) init() {
 	err := dbConn.connectDB()
 	if err != nil {
-		log.Fatal("Failed to connect to the database:", err)
+		shared.Fatal("Failed to connect to the database", shared.LogError, err)
 	}
 
 	err = dbConn.db.Ping()
 	if err != nil {
-		log.Fatal("Failed to ping the database:", err)
+		shared.Fatal("Failed to ping the database", shared.LogError, err)
 	}
-	fmt.Println("Connected to the MySQL database!")
+	slog.Info("Connected to the MySQL database")
+	shared.AddHealthCheck("mysql", dbConn.db.PingContext)
 	createTablesErr := dbConn.createTables()
 	if createTablesErr != nil {
-		log.Fatal("Failed to create the MySQL tables:\n", createTablesErr)
+		shared.Fatal("Failed to create the MySQL tables", shared.LogError, createTablesErr)
 	}
 }
 
 func (dbConn *MySQLConnection) connectDB() error {
-	dbUser := "user"
-	dbPass := "pass"
-	dbName := "lockmaster"
-	dbHost := "lockmasterdb-service-0"
-	dbPort := 3306
-	connString := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", dbUser, dbPass, dbHost, dbPort, dbName)
-
 	var err error
-	dbConn.db, err = sql.Open("mysql", connString)
+	// only queries in a traced context get spans, not the polling of the
+	// timeouts and the recovery
+	dbConn.db, err = otelsql.Open("mysql", shared.AppConfig.MySQL.DSN(),
+		otelsql.WithAttributes(semconv.DBSystemMySQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableErrSkip: true,
+			OmitRows:       true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return shared.TracedContext(ctx)
+			},
+		}),
+	)
 	if err != nil {
 		return err
 	}
@@ -67,7 +92,7 @@ func (dbConn *MySQLConnection) connectDB() error {
 }
 
 func (dbConn *MySQLConnection) createTables() error {
-	fmt.Println("Creating the MySQL tables...")
+	slog.Info("Creating the MySQL tables")
 
 	createMsgTypesTable := `
 	CREATE TABLE IF NOT EXISTS message_types (
@@ -84,7 +109,10 @@ func (dbConn *MySQLConnection) createTables() error {
 	VALUES 
 	  (1, 'START'),
 	  (2, 'END'),
-	  (3, 'ABORT');
+	  (3, 'ABORT'),
+	  (4, 'RETRY'),
+	  (5, 'COMPENSATE'),
+	  (6, 'RESOLVE');
     `
 	_, insertMsgTypeErr := dbConn.db.Exec(insertMsgTypes)
 	if insertMsgTypeErr != nil {
@@ -101,17 +129,21 @@ func (dbConn *MySQLConnection) createTables() error {
 		return createMsgErr
 	}
 
-	insertMsgEvents := `INSERT IGNORE INTO message_events (ID, event)
-	VALUES 
-	  (1, 'MAKE-PAYMENT'),
-	  (2, 'CANCEL-PAYMENT'),
-	  (3, 'CHECKOUT-SAGA'),
-	  (4, 'CANCEL-SAGA'),
-	  (5, 'SUBTRACT-STOCK'),
-	  (6, 'READD-STOCK'),
-	  (7, 'UPDATE-ORDER');
-    `
-	_, insertMsgErr := dbConn.db.Exec(insertMsgEvents)
+	// events come from the saga definitions
+	eventIDs := make([]int64, 0, len(messageEventMapIntToString))
+	for eventID := range messageEventMapIntToString {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Slice(eventIDs, func(i, j int) bool { return eventIDs[i] < eventIDs[j] })
+
+	eventValues := make([]string, len(eventIDs))
+	eventArgs := make([]any, 0, 2*len(eventIDs))
+	for i, eventID := range eventIDs {
+		eventValues[i] = "(?, ?)"
+		eventArgs = append(eventArgs, eventID, messageEventMapIntToString[eventID])
+	}
+	insertMsgEvents := "INSERT IGNORE INTO message_events (ID, event) VALUES " + strings.Join(eventValues, ", ")
+	_, insertMsgErr := dbConn.db.Exec(insertMsgEvents, eventArgs...)
 	if insertMsgErr != nil {
 		return insertMsgErr
 	}
@@ -132,6 +164,8 @@ func (dbConn *MySQLConnection) createTables() error {
 			message_event INT,
 			saga_contents TEXT,
 			timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			actor varchar(255) NULL,
+			reason TEXT NULL,
 			FOREIGN KEY (saga_id) REFERENCES sagas(ID),
 			FOREIGN KEY (message_type) REFERENCES message_types(ID),
 			FOREIGN KEY (message_event) REFERENCES message_events(ID)
@@ -140,103 +174,355 @@ func (dbConn *MySQLConnection) createTables() error {
 	if createMessagesErr != nil {
 		return createMessagesErr
 	}
+	// messages tables from before the audit columns
+	for _, column := range []struct{ name, definition string }{
+		{"actor", "varchar(255) NULL"},
+		{"reason", "TEXT NULL"},
+	} {
+		addErr := dbConn.addMissingColumn("messages", column.name, column.definition)
+		if addErr != nil {
+			return addErr
+		}
+	}
+
+	createDeadLetters := `CREATE TABLE IF NOT EXISTS dead_letters (
+			ID INT AUTO_INCREMENT PRIMARY KEY,
+			service varchar(32),
+			topic varchar(255),
+			message_key varchar(255),
+			payload MEDIUMTEXT,
+			headers TEXT,
+			error TEXT,
+			attempts INT,
+			failed_at TIMESTAMP NULL,
+			received TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			replayed TIMESTAMP NULL
+	) ENGINE=InnoDB;`
+	_, createDeadLettersErr := dbConn.db.Exec(createDeadLetters)
+	if createDeadLettersErr != nil {
+		return createDeadLettersErr
+	}
 
-	fmt.Printf("Successfully created all tables!\n")
+	slog.Info("Created the MySQL tables")
 	return nil
 }
 
-func (dbConn *MySQLConnection) createSaga() (error, *int64) {
-	query, prepareQueryErr := dbConn.db.Prepare("INSERT INTO sagas (ID, timestamp) VALUES (DEFAULT, DEFAULT)")
-	if prepareQueryErr != nil {
-		return prepareQueryErr, nil
+// addMissingColumn adds the column to the table unless it has it already
+func (dbConn *MySQLConnection) addMissingColumn(table string, column string, definition string) error {
+	var count int
+	countErr := dbConn.db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&count)
+	if countErr != nil || count > 0 {
+		return countErr
 	}
-	defer query.Close()
+	slog.Info("Adding MySQL column", "table", table, "column", column)
+	_, alterErr := dbConn.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return alterErr
+}
+
+// executor returns the open transaction of a locked saga, or the plain
+// connection pool when no saga is locked.
+func (dbConn *MySQLConnection) executor() sqlExecutor {
+	if dbConn.tx != nil {
+		return dbConn.tx
+	}
+	return dbConn.db
+}
 
-	sagaResult, execQueryErr := query.Exec()
+func (dbConn *MySQLConnection) queryContext() context.Context {
+	if dbConn.ctx != nil {
+		return dbConn.ctx
+	}
+	return context.Background()
+}
+
+// lockSaga starts a transaction holding a row lock on the saga, so that the
+// Kafka listener, crash recovery and other lockmaster replicas cannot advance
+// the same saga concurrently. The lock is released by commit or rollback.
+func (dbConn *MySQLConnection) lockSaga(ctx context.Context, sagaID int64) (error, SagaConnection) {
+	tx, beginErr := dbConn.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return beginErr, nil
+	}
+
+	var lockedID int64
+	lockErr := tx.QueryRowContext(ctx, "SELECT ID FROM sagas WHERE ID = ? FOR UPDATE", sagaID).Scan(&lockedID)
+	if lockErr != nil {
+		tx.Rollback()
+		return lockErr, nil
+	}
+	return nil, &MySQLConnection{db: dbConn.db, tx: tx, ctx: ctx}
+}
+
+func (dbConn *MySQLConnection) close() error {
+	return dbConn.db.Close()
+}
+
+func (dbConn *MySQLConnection) commit() error {
+	return dbConn.tx.Commit()
+}
+
+func (dbConn *MySQLConnection) rollback() {
+	// error ignored, rollback after commit is a no-op
+	dbConn.tx.Rollback()
+}
+
+// createSaga inserts the saga in a transaction, which holds the lock of the
+// new row until commit or rollback like lockSaga.
+func (dbConn *MySQLConnection) createSaga(ctx context.Context) (error, *int64, SagaConnection) {
+	tx, beginErr := dbConn.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return beginErr, nil, nil
+	}
+
+	sagaResult, execQueryErr := tx.ExecContext(ctx, "INSERT INTO sagas (ID, timestamp) VALUES (DEFAULT, DEFAULT)")
 	if execQueryErr != nil {
-		return execQueryErr, nil
+		tx.Rollback()
+		return execQueryErr, nil, nil
 	}
 	insertedID, insertedErr := sagaResult.LastInsertId()
 	if insertedErr != nil {
-		return insertedErr, nil
+		tx.Rollback()
+		return insertedErr, nil, nil
 	}
-	// fmt.Printf("SAGA: %d\n", insertedID)
-	return nil, &insertedID
+	return nil, &insertedID, &MySQLConnection{db: dbConn.db, tx: tx, ctx: ctx}
 }
 
 func (dbConn *MySQLConnection) insertSagaLog(sagaLog *SagaLog) error {
-	// fmt.Println("Inserting SAGA log...")
-	query, prepareQueryErr := dbConn.db.Prepare("INSERT INTO messages (saga_id, message_type, message_event, saga_contents) VALUES (?, ?, ?, ?)")
+	query, prepareQueryErr := dbConn.executor().PrepareContext(dbConn.queryContext(), "INSERT INTO messages (saga_id, message_type, message_event, saga_contents, actor, reason) VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))")
 	if prepareQueryErr != nil {
-		fmt.Println("Prepare Query error!")
 		return prepareQueryErr
 	}
 	defer query.Close()
 
-	_, execQueryErr := query.Exec(sagaLog.SagaID, sagaLog.MessageType, sagaLog.MessageEvent, sagaLog.SagaContents)
+	_, execQueryErr := query.ExecContext(dbConn.queryContext(), sagaLog.SagaID, sagaLog.MessageType, sagaLog.MessageEvent, sagaLog.SagaContents, sagaLog.Actor, sagaLog.Reason)
 	if execQueryErr != nil {
-		fmt.Println("Execute query error!")
 		return execQueryErr
 	}
 	return nil
 }
 
 func (dbConn *MySQLConnection) getLatestSagaLog(sagaID int64) (error, *SagaLog) {
-	qString := "SELECT ID, saga_id, message_type, message_event, saga_contents, timestamp FROM messages WHERE saga_id = ? ORDER BY timestamp DESC LIMIT 1"
-	query, prepareQueryErr := dbConn.db.Prepare(qString)
+	// ID instead of timestamp, several messages are logged within the same second
+	qString := "SELECT ID, saga_id, message_type, message_event, saga_contents, timestamp FROM messages WHERE saga_id = ? ORDER BY ID DESC LIMIT 1"
+	query, prepareQueryErr := dbConn.executor().PrepareContext(dbConn.queryContext(), qString)
 	if prepareQueryErr != nil {
 		return prepareQueryErr, nil
 	}
 	defer query.Close()
 
 	var sagaLog SagaLog
-	queryErr := query.QueryRow(sagaID).Scan(&sagaLog.ID, &sagaLog.SagaID, &sagaLog.MessageType, &sagaLog.MessageEvent, &sagaLog.SagaContents, &sagaLog.Timestamp)
+	queryErr := query.QueryRowContext(dbConn.queryContext(), sagaID).Scan(&sagaLog.ID, &sagaLog.SagaID, &sagaLog.MessageType, &sagaLog.MessageEvent, &sagaLog.SagaContents, &sagaLog.Timestamp)
 	if queryErr != nil {
 		return queryErr, nil
 	}
 
-	// fmt.Println("Retrieved latest document:")
-	// fmt.Println("Saga ID:", sagaLog.SagaID)
-	// fmt.Println("Saga Contents:", sagaLog.SagaContents)
-	// fmt.Println("Timestamp:", sagaLog.Timestamp)
 	return nil, &sagaLog
 }
 
-// DEBUG METHODS
-func (dbConn *MySQLConnection) printAllSAGAs() error {
-	fmt.Printf("Printing all SAGAs!\n")
-	rows, err := dbConn.db.Query("SELECT * FROM sagas")
-	if err != nil {
-		fmt.Printf("Query err: %s\n", err)
-		return err
+func (dbConn *MySQLConnection) getLatestSagaLogOfType(sagaID int64, messageType int64) (error, *SagaLog) {
+	qString := "SELECT ID, saga_id, message_type, message_event, saga_contents, timestamp FROM messages WHERE saga_id = ? AND message_type = ? ORDER BY ID DESC LIMIT 1"
+	query, prepareQueryErr := dbConn.executor().PrepareContext(dbConn.queryContext(), qString)
+	if prepareQueryErr != nil {
+		return prepareQueryErr, nil
+	}
+	defer query.Close()
+
+	var sagaLog SagaLog
+	queryErr := query.QueryRowContext(dbConn.queryContext(), sagaID, messageType).Scan(&sagaLog.ID, &sagaLog.SagaID, &sagaLog.MessageType, &sagaLog.MessageEvent, &sagaLog.SagaContents, &sagaLog.Timestamp)
+	if queryErr != nil {
+		return queryErr, nil
+	}
+	return nil, &sagaLog
+}
+
+// getFirstSagaLog returns the START message the saga was created for.
+func (dbConn *MySQLConnection) getFirstSagaLog(sagaID int64) (error, *SagaLog) {
+	qString := "SELECT ID, saga_id, message_type, message_event, saga_contents, timestamp FROM messages WHERE saga_id = ? ORDER BY ID ASC LIMIT 1"
+	query, prepareQueryErr := dbConn.executor().PrepareContext(dbConn.queryContext(), qString)
+	if prepareQueryErr != nil {
+		return prepareQueryErr, nil
+	}
+	defer query.Close()
+
+	var sagaLog SagaLog
+	queryErr := query.QueryRowContext(dbConn.queryContext(), sagaID).Scan(&sagaLog.ID, &sagaLog.SagaID, &sagaLog.MessageType, &sagaLog.MessageEvent, &sagaLog.SagaContents, &sagaLog.Timestamp)
+	if queryErr != nil {
+		return queryErr, nil
+	}
+	return nil, &sagaLog
+}
+
+// getUnfinishedSagaIDs returns every saga that has not logged the END message
+// of one of the given saga events yet.
+func (dbConn *MySQLConnection) getUnfinishedSagaIDs(endType int64, sagaEvents []int64) (error, []int64) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(sagaEvents)), ", ")
+	qString := "SELECT ID FROM sagas WHERE NOT EXISTS (SELECT 1 FROM messages WHERE messages.saga_id = sagas.ID AND message_type = ? AND message_event IN (" + placeholders + ")) ORDER BY ID"
+	args := []any{endType}
+	for _, sagaEvent := range sagaEvents {
+		args = append(args, sagaEvent)
+	}
+	return dbConn.querySagaIDs(qString, args...)
+}
+
+// getIdleSagaIDs filters the sagas in the query, so only the sagas that may
+// have timed out are locked afterwards
+func (dbConn *MySQLConnection) getIdleSagaIDs(endType int64, sagaEvents []int64, idleFor time.Duration) (error, []int64) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(sagaEvents)), ", ")
+	qString := "SELECT saga_id FROM messages GROUP BY saga_id HAVING MAX(timestamp) <= CURRENT_TIMESTAMP - INTERVAL ? MICROSECOND AND SUM(message_type = ? AND message_event IN (" + placeholders + ")) = 0 ORDER BY saga_id"
+	args := []any{idleFor.Microseconds(), endType}
+	for _, sagaEvent := range sagaEvents {
+		args = append(args, sagaEvent)
+	}
+	return dbConn.querySagaIDs(qString, args...)
+}
+
+// Queries of the saga inspection API
+
+func (dbConn *MySQLConnection) getSaga(sagaID int64) (error, *Saga) {
+	var saga Saga
+	queryErr := dbConn.db.QueryRow("SELECT ID, timestamp FROM sagas WHERE ID = ?", sagaID).Scan(&saga.ID, &saga.Timestamp)
+	if queryErr != nil {
+		return queryErr, nil
+	}
+	return nil, &saga
+}
+
+func (dbConn *MySQLConnection) getSagaLogs(sagaID int64) (error, []SagaLog) {
+	rows, queryErr := dbConn.db.Query("SELECT ID, saga_id, message_type, message_event, saga_contents, timestamp, COALESCE(actor, ''), COALESCE(reason, '') FROM messages WHERE saga_id = ? ORDER BY ID", sagaID)
+	if queryErr != nil {
+		return queryErr, nil
 	}
 	defer rows.Close()
 
+	var sagaLogs []SagaLog
 	for rows.Next() {
-		var saga Saga
-		err := rows.Scan(&saga.ID, &saga.Timestamp)
-		if err != nil {
-			return err
+		var sagaLog SagaLog
+		scanErr := rows.Scan(&sagaLog.ID, &sagaLog.SagaID, &sagaLog.MessageType, &sagaLog.MessageEvent, &sagaLog.SagaContents, &sagaLog.Timestamp, &sagaLog.Actor, &sagaLog.Reason)
+		if scanErr != nil {
+			return scanErr, nil
 		}
-		fmt.Printf("SAGA: %+v\n", saga)
+		sagaLogs = append(sagaLogs, sagaLog)
 	}
-	return nil
+	return rows.Err(), sagaLogs
 }
 
-func (dbConn *MySQLConnection) printAllSAGALogs() error {
-	rows, err := dbConn.db.Query("SELECT * FROM messages")
-	if err != nil {
-		return err
+func (dbConn *MySQLConnection) getRecentSagaIDs(limit int) (error, []int64) {
+	return dbConn.querySagaIDs("SELECT ID FROM sagas ORDER BY ID DESC LIMIT ?", limit)
+}
+
+// getSagaIDsOfOrder returns the sagas that ran for an order. The order ID has
+// to be a valid UUID, it is matched against the logged order JSON.
+func (dbConn *MySQLConnection) getSagaIDsOfOrder(orderID string, limit int) (error, []int64) {
+	pattern := `%"order_id":"` + orderID + `"%`
+	return dbConn.querySagaIDs("SELECT DISTINCT saga_id FROM messages WHERE saga_contents LIKE ? ORDER BY saga_id DESC LIMIT ?", pattern, limit)
+}
+
+func (dbConn *MySQLConnection) querySagaIDs(query string, args ...any) (error, []int64) {
+	rows, queryErr := dbConn.executor().QueryContext(dbConn.queryContext(), query, args...)
+	if queryErr != nil {
+		return queryErr, nil
 	}
 	defer rows.Close()
 
+	var sagaIDs []int64
 	for rows.Next() {
-		var sagaLog SagaLog
-		err := rows.Scan(&sagaLog.ID, &sagaLog.SagaID, &sagaLog.MessageType, &sagaLog.MessageEvent, &sagaLog.SagaContents, &sagaLog.Timestamp)
-		if err != nil {
-			return err
+		var sagaID int64
+		scanErr := rows.Scan(&sagaID)
+		if scanErr != nil {
+			return scanErr, nil
 		}
-		fmt.Printf("SAGALog: %+v\n", sagaLog)
+		sagaIDs = append(sagaIDs, sagaID)
 	}
-	return nil
+	return rows.Err(), sagaIDs
+}
+
+// Dead letters of the services
+
+func (dbConn *MySQLConnection) insertDeadLetter(deadLetter *shared.DeadLetter) error {
+	headersBytes, encodeErr := json.Marshal(deadLetter.Headers)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	qString := "INSERT INTO dead_letters (service, topic, message_key, payload, headers, error, attempts, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, execErr := dbConn.db.Exec(qString, deadLetter.Service, deadLetter.Topic, deadLetter.Key, deadLetter.Payload, string(headersBytes), deadLetter.Error, deadLetter.Attempts, deadLetter.FailedAt)
+	return execErr
+}
+
+const deadLetterColumns = "ID, service, topic, message_key, payload, headers, error, attempts, failed_at, received, replayed"
+
+func (dbConn *MySQLConnection) getDeadLetters(service string, replayed *bool, limit int) (error, []DeadLetterEntry) {
+	var conditions []string
+	var args []any
+	if service != "" {
+		conditions = append(conditions, "service = ?")
+		args = append(args, service)
+	}
+	if replayed != nil && *replayed {
+		conditions = append(conditions, "replayed IS NOT NULL")
+	} else if replayed != nil {
+		conditions = append(conditions, "replayed IS NULL")
+	}
+	qString := "SELECT " + deadLetterColumns + " FROM dead_letters"
+	if len(conditions) > 0 {
+		qString += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	qString += " ORDER BY ID DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, queryErr := dbConn.db.Query(qString, args...)
+	if queryErr != nil {
+		return queryErr, nil
+	}
+	defer rows.Close()
+
+	var entries []DeadLetterEntry
+	for rows.Next() {
+		scanErr, entry := scanDeadLetter(rows)
+		if scanErr != nil {
+			return scanErr, nil
+		}
+		entries = append(entries, *entry)
+	}
+	return rows.Err(), entries
+}
+
+func (dbConn *MySQLConnection) getDeadLetter(deadLetterID int64) (error, *DeadLetterEntry) {
+	row := dbConn.db.QueryRow("SELECT "+deadLetterColumns+" FROM dead_letters WHERE ID = ?", deadLetterID)
+	return scanDeadLetter(row)
+}
+
+func (dbConn *MySQLConnection) setDeadLetterReplayed(deadLetterID int64, replayed bool) (error, bool) {
+	qString := "UPDATE dead_letters SET replayed = CURRENT_TIMESTAMP WHERE ID = ? AND replayed IS NULL"
+	if !replayed {
+		qString = "UPDATE dead_letters SET replayed = NULL WHERE ID = ? AND replayed IS NOT NULL"
+	}
+	result, execErr := dbConn.db.Exec(qString, deadLetterID)
+	if execErr != nil {
+		return execErr, false
+	}
+	affected, affectedErr := result.RowsAffected()
+	if affectedErr != nil {
+		return affectedErr, false
+	}
+	return nil, affected > 0
+}
+
+// scanDeadLetter reads a row of deadLetterColumns, from *sql.Row or *sql.Rows
+func scanDeadLetter(row interface{ Scan(dest ...any) error }) (error, *DeadLetterEntry) {
+	var entry DeadLetterEntry
+	var headers string
+	var failedAt, replayed sql.NullTime
+	scanErr := row.Scan(&entry.ID, &entry.Service, &entry.Topic, &entry.Key, &entry.Payload, &headers, &entry.Error, &entry.Attempts, &failedAt, &entry.Received, &replayed)
+	if scanErr != nil {
+		return scanErr, nil
+	}
+	decodeErr := json.Unmarshal([]byte(headers), &entry.Headers)
+	if decodeErr != nil {
+		return decodeErr, nil
+	}
+	entry.FailedAt = failedAt.Time
+	if replayed.Valid {
+		entry.Replayed = &replayed.Time
+	}
+	return nil, &entry
 }
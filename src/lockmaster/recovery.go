@@ -0,0 +1,123 @@
+package lockmaster
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"main/shared"
+)
+
+// recoverSagas re-drives every saga that was left unfinished by a crash or a
+// restart of the lockmaster.
+func recoverSagas() {
+	queryErr, sagaIDs := dbConn.getUnfinishedSagaIDs(messageTypeMapStringToInt["END"], sagaEventIDs())
+	if queryErr != nil {
+		slog.Error("Recovery: get unfinished sagas error", shared.LogError, queryErr)
+		return
+	}
+	slog.Info("Recovery: found unfinished sagas", "sagas", len(sagaIDs))
+
+	for _, sagaID := range sagaIDs {
+		recoverSaga(sagaID)
+	}
+}
+
+func recoverSaga(sagaID int64) {
+	ctx := shared.WithLogFields(context.Background(), slog.Int64(shared.LogSagaID, sagaID))
+	lockErr, sagaConn := dbConn.lockSaga(ctx, sagaID)
+	if lockErr != nil {
+		slog.ErrorContext(ctx, "Recovery: lock saga error", shared.LogError, lockErr)
+		return
+	}
+	defer sagaConn.rollback()
+
+	latestErr, latestLog := sagaConn.getLatestSagaLog(sagaID)
+	if latestErr != nil {
+		// saga was created but its first message was never logged
+		slog.WarnContext(ctx, "Recovery: saga has no log", shared.LogError, latestErr)
+		return
+	}
+	// sagas that made progress within the grace period are assumed to be
+	// driven by another lockmaster replica
+	if time.Since(latestLog.Timestamp) < shared.AppConfig.Timeouts.RecoveryGracePeriod {
+		return
+	}
+
+	convErr, latestMessage := sagaLogToSagaMessage(latestLog)
+	if convErr != nil {
+		slog.ErrorContext(ctx, "Recovery: saga log conversion error", shared.LogError, convErr)
+		return
+	}
+	machineErr, stateMachine := getSagaStateMachine(sagaConn, sagaID)
+	if machineErr != nil {
+		slog.ErrorContext(ctx, "Recovery: saga state machine error", shared.LogError, machineErr)
+		return
+	}
+
+	var advanceErr error
+	var transition *sagaTransition
+
+	if strings.HasPrefix(latestMessage.Name, "START-") && stateMachine.topicOfMessage(latestMessage.Name) != "" {
+		// the participant may never have received the step, send it again
+		advanceErr, transition = resendSagaStep(sagaConn, stateMachine, latestMessage)
+	} else {
+		// the incoming message was logged but its transition was not, either
+		// continue the saga or begin the compensation after an ABORT
+		advanceErr, transition = advanceSaga(sagaConn, stateMachine, latestMessage)
+	}
+	if advanceErr != nil {
+		slog.ErrorContext(ctx, "Recovery: advance saga error", shared.LogError, advanceErr)
+		return
+	}
+
+	commitAndPublish(sagaConn, transition)
+}
+
+// resendSagaStep logs a pending step again, which restarts its timeout, and
+// returns the transition that sends it again.
+func resendSagaStep(sagaConn SagaConnection, stateMachine *SagaStateMachine, message *shared.SagaMessage) (error, *sagaTransition) {
+	convErr, sagaLog := sagaMessageToSagaLog(message)
+	if convErr != nil {
+		return convErr, nil
+	}
+	insertErr := sagaConn.insertSagaLog(sagaLog)
+	if insertErr != nil {
+		return insertErr, nil
+	}
+	message.Saga = stateMachine.name
+	return nil, &sagaTransition{message: message, topic: stateMachine.topicOfMessage(message.Name)}
+}
+
+// commitAndPublish commits the transition and only then applies it, so a fast
+// reply never waits on the lock of its own saga and nothing outside the saga
+// log sees a transition that was rolled back.
+func commitAndPublish(sagaConn SagaConnection, transition *sagaTransition) error {
+	if transition == nil {
+		return nil
+	}
+	message := transition.message
+	commitErr := sagaConn.commit()
+	if commitErr != nil {
+		slog.Error("Commit saga error", shared.LogSagaID, message.SagaID, shared.LogError, commitErr)
+		return commitErr
+	}
+	transition.applyEffects()
+
+	topic := transition.topic
+	if topic == "" {
+		return nil
+	}
+	slog.Info("Sending saga message", "message", message.Name, shared.LogSagaID, message.SagaID, shared.LogTopic, topic)
+	sendErr := publishSagaMessage(message, topic)
+	if sendErr != nil {
+		slog.Error("Send saga message error", shared.LogSagaID, message.SagaID, shared.LogTopic, topic, shared.LogError, sendErr)
+	}
+	return nil
+}
+
+func publishSagaMessage(message *shared.SagaMessage, topic string) error {
+	message.ReplyTo = shared.ReplyTopic(topic)
+	return shared.SendSagaMessage(message, topic)
+}
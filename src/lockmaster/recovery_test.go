@@ -0,0 +1,212 @@
+package lockmaster
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"main/shared"
+)
+
+func TestMain(m *testing.M) {
+	shared.UseTransport(shared.NewMemoryTransport())
+	configDir, found := findConfigDir()
+	if !found {
+		panic("no config directory above the working directory")
+	}
+	definitionsErr := loadSagaDefinitions(filepath.Join(configDir, "sagas.yaml"))
+	if definitionsErr != nil {
+		panic(definitionsErr)
+	}
+	os.Exit(m.Run())
+}
+
+// findConfigDir returns the config directory above the working directory, it
+// is next to src in the repo and next to the sources in the image
+func findConfigDir() (string, bool) {
+	dir, wdErr := os.Getwd()
+	if wdErr != nil {
+		return "", false
+	}
+	for {
+		configDir := filepath.Join(dir, "config")
+		if _, statErr := os.Stat(filepath.Join(configDir, "sagas.yaml")); statErr == nil {
+			return configDir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// createTestSaga creates a saga in a new memory store with the given messages
+// logged and committed, and makes the store the store of the lockmaster
+func createTestSaga(t *testing.T, messageNames ...string) (*memorySagaStore, int64) {
+	t.Helper()
+	store := newMemorySagaStore()
+	dbConn = store
+	createErr, sagaID, sagaConn := store.createSaga(context.Background())
+	if createErr != nil {
+		t.Fatalf("create saga: %v", createErr)
+	}
+	for _, name := range messageNames {
+		message := shared.SagaMessage{Name: name, SagaID: *sagaID, Order: shared.Order{OrderID: shared.GetNewID().String()}}
+		convErr, sagaLog := sagaMessageToSagaLog(&message)
+		if convErr != nil {
+			t.Fatalf("saga log of %s: %v", name, convErr)
+		}
+		insertErr := sagaConn.insertSagaLog(sagaLog)
+		if insertErr != nil {
+			t.Fatalf("insert %s: %v", name, insertErr)
+		}
+	}
+	commitErr := sagaConn.commit()
+	if commitErr != nil {
+		t.Fatalf("commit: %v", commitErr)
+	}
+	return store, *sagaID
+}
+
+// getLoggedNames returns the names of the committed messages of the saga
+func getLoggedNames(t *testing.T, store *memorySagaStore, sagaID int64) []string {
+	t.Helper()
+	_, sagaLogs := store.getSagaLogs(sagaID)
+	names := make([]string, len(sagaLogs))
+	for i := range sagaLogs {
+		convErr, message := sagaLogToSagaMessage(&sagaLogs[i])
+		if convErr != nil {
+			t.Fatalf("saga message of log %d: %v", i, convErr)
+		}
+		names[i] = message.Name
+	}
+	return names
+}
+
+// receiveSagaMessage returns the next saga message of the subscription, or nil
+// when none arrives in time
+func receiveSagaMessage(t *testing.T, subscription shared.Subscription) *shared.SagaMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	receiveErr, received := subscription.Receive(ctx)
+	if receiveErr != nil {
+		return nil
+	}
+	parseErr, message := shared.ParseSagaMessage(string(received.Value))
+	if parseErr != nil {
+		t.Fatalf("parse saga message: %v", parseErr)
+	}
+	return message
+}
+
+func TestRecoverSaga(t *testing.T) {
+	tests := []struct {
+		name        string
+		logged      []string
+		gracePeriod time.Duration
+		// the messages logged by recovery after the logged ones
+		wantLogged []string
+		// the message recovery sends, with its topic
+		wantMessage string
+		wantTopic   string
+	}{
+		{
+			name:        "resend the pending step",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK"},
+			gracePeriod: time.Nanosecond,
+			wantLogged:  []string{"START-SUBTRACT-STOCK"},
+			wantMessage: "START-SUBTRACT-STOCK",
+			wantTopic:   "stock-syn",
+		},
+		{
+			name:        "continue after a logged reply",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK", "END-SUBTRACT-STOCK"},
+			gracePeriod: time.Nanosecond,
+			wantLogged:  []string{"END-SUBTRACT-STOCK", "START-MAKE-PAYMENT"},
+			wantMessage: "START-MAKE-PAYMENT",
+			wantTopic:   "payment-syn",
+		},
+		{
+			name:        "compensate after a logged abort",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK", "END-SUBTRACT-STOCK", "START-MAKE-PAYMENT", "ABORT-MAKE-PAYMENT"},
+			gracePeriod: time.Nanosecond,
+			wantLogged:  []string{"ABORT-MAKE-PAYMENT", "START-READD-STOCK"},
+			wantMessage: "START-READD-STOCK",
+			wantTopic:   "stock-syn",
+		},
+		{
+			name:        "leave a saga that made progress within the grace period",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK"},
+			gracePeriod: time.Hour,
+			wantTopic:   "stock-syn",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared.AppConfig = &shared.Config{Timeouts: shared.TimeoutsConfig{RecoveryGracePeriod: test.gracePeriod}}
+			store, sagaID := createTestSaga(t, test.logged...)
+			subscribeErr, subscription := shared.SubscribeBroadcast(test.wantTopic)
+			if subscribeErr != nil {
+				t.Fatalf("subscribe: %v", subscribeErr)
+			}
+			defer subscription.Close()
+
+			time.Sleep(time.Millisecond)
+			recoverSaga(sagaID)
+
+			logged := getLoggedNames(t, store, sagaID)
+			wantLogged := append(append([]string{}, test.logged...), test.wantLogged...)
+			if len(logged) != len(wantLogged) {
+				t.Fatalf("logged %v, want %v", logged, wantLogged)
+			}
+			for i := range wantLogged {
+				if logged[i] != wantLogged[i] {
+					t.Fatalf("logged %v, want %v", logged, wantLogged)
+				}
+			}
+
+			message := receiveSagaMessage(t, subscription)
+			if test.wantMessage == "" {
+				if message != nil {
+					t.Fatalf("sent %s, want nothing", message.Name)
+				}
+				return
+			}
+			if message == nil || message.Name != test.wantMessage || message.SagaID != sagaID {
+				t.Fatalf("sent %+v, want %s of saga %d", message, test.wantMessage, sagaID)
+			}
+		})
+	}
+}
+
+func TestRecoverSagaWithoutLog(t *testing.T) {
+	shared.AppConfig = &shared.Config{Timeouts: shared.TimeoutsConfig{RecoveryGracePeriod: time.Nanosecond}}
+	store, sagaID := createTestSaga(t)
+
+	recoverSaga(sagaID)
+
+	if logged := getLoggedNames(t, store, sagaID); len(logged) != 0 {
+		t.Fatalf("logged %v, want nothing", logged)
+	}
+}
+
+func TestCreateSagaRollback(t *testing.T) {
+	store := newMemorySagaStore()
+	createErr, sagaID, sagaConn := store.createSaga(context.Background())
+	if createErr != nil {
+		t.Fatalf("create saga: %v", createErr)
+	}
+	sagaConn.rollback()
+
+	if getErr, _ := store.getSaga(*sagaID); getErr == nil {
+		t.Fatalf("saga %d exists after the rollback of its creation", *sagaID)
+	}
+	if _, sagaIDs := store.getUnfinishedSagaIDs(messageTypeMapStringToInt["END"], sagaEventIDs()); len(sagaIDs) != 0 {
+		t.Fatalf("unfinished sagas %v, want none", sagaIDs)
+	}
+}
@@ -0,0 +1,275 @@
+package lockmaster
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"main/shared"
+)
+
+const (
+	SAGA_STATE_RUNNING     = "running"
+	SAGA_STATE_COMPLETED   = "completed"
+	SAGA_STATE_COMPENSATED = "compensated"
+	SAGA_STATE_STUCK       = "stuck"
+)
+
+const defaultSagaListLimit = 100
+const maxSagaListLimit = 1000
+
+type SagaEvent struct {
+	ID        int64        `json:"id"`
+	Name      string       `json:"name"`
+	Timestamp time.Time    `json:"timestamp"`
+	Order     shared.Order `json:"order"`
+	// of the audit logs of manual commands
+	Actor  string `json:"actor,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type SagaSummary struct {
+	SagaID   int64       `json:"saga_id"`
+	Saga     string      `json:"saga"`
+	OrderID  string      `json:"order_id"`
+	State    string      `json:"state"`
+	Step     string      `json:"step"`
+	Created  time.Time   `json:"created"`
+	Updated  time.Time   `json:"updated"`
+	Timeline []SagaEvent `json:"timeline,omitempty"`
+}
+
+func serveSagaAPI() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8083"
+	}
+
+	// Set the listening address and port for the server
+	addr := fmt.Sprintf(":%s", port)
+	slog.Info("Starting lockmaster service", "addr", addr)
+	serveErr := http.ListenAndServe(addr, NewRouter())
+	shared.Fatal("Serve error", shared.LogError, serveErr)
+}
+
+// NewRouter returns the routes of the saga inspection and dead letter API
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+	shared.InstrumentRouter(router, "lockmaster")
+	router.HandleFunc("/sagas", listSagasHandler).Methods(http.MethodGet)
+	router.HandleFunc("/sagas/{saga_id}", findSagaHandler).Methods(http.MethodGet)
+	router.HandleFunc("/sagas/{saga_id}/retry", requireAdminToken(retrySagaHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/sagas/{saga_id}/compensate", requireAdminToken(compensateSagaHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/sagas/{saga_id}/resolve", requireAdminToken(resolveSagaHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/dead-letters", listDeadLettersHandler).Methods(http.MethodGet)
+	router.HandleFunc("/dead-letters/{dead_letter_id}", findDeadLetterHandler).Methods(http.MethodGet)
+	router.HandleFunc("/dead-letters/{dead_letter_id}/replay", requireAdminToken(replayDeadLetterHandler)).Methods(http.MethodPost)
+	return router
+}
+
+// requireAdminToken refuses the commands of the API without the admin token,
+// and all of them while no token is configured
+func requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := shared.AppConfig.Admin.Token
+		if token == "" {
+			http.Error(w, "admin commands are disabled, no admin token is configured", http.StatusForbidden)
+			return
+		}
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			slog.WarnContext(r.Context(), "Admin command without valid token", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// listSagasHandler lists the latest sagas, optionally filtered by ?state= and
+// ?order_id=. Running and stuck sagas are looked up among all unfinished sagas,
+// completed and compensated ones among the latest ?limit= sagas.
+func listSagasHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	state := query.Get("state")
+	orderID := query.Get("order_id")
+
+	switch state {
+	case "", SAGA_STATE_RUNNING, SAGA_STATE_COMPLETED, SAGA_STATE_COMPENSATED, SAGA_STATE_STUCK:
+	default:
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSagaListLimit
+	if query.Get("limit") != "" {
+		convErr, parsedLimit := shared.ConvertStringToInt(query.Get("limit"))
+		if convErr != nil || *parsedLimit <= 0 || *parsedLimit > maxSagaListLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = int(*parsedLimit)
+	}
+
+	var queryErr error
+	var sagaIDs []int64
+	if orderID != "" {
+		convErr, orderUUID := shared.ConvertStringToUUID(orderID)
+		if convErr != nil {
+			http.Error(w, "invalid order_id", http.StatusBadRequest)
+			return
+		}
+		queryErr, sagaIDs = dbConn.getSagaIDsOfOrder(orderUUID.String(), limit)
+	} else if state == SAGA_STATE_RUNNING || state == SAGA_STATE_STUCK {
+		queryErr, sagaIDs = dbConn.getUnfinishedSagaIDs(messageTypeMapStringToInt["END"], sagaEventIDs())
+	} else {
+		queryErr, sagaIDs = dbConn.getRecentSagaIDs(limit)
+	}
+	if queryErr != nil {
+		slog.ErrorContext(r.Context(), "List sagas error", shared.LogError, queryErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	summaries := []SagaSummary{}
+	for _, sagaID := range sagaIDs {
+		summaryErr, summary := getSagaSummary(sagaID, false)
+		if summaryErr != nil {
+			slog.ErrorContext(r.Context(), "Saga summary error", shared.LogSagaID, sagaID, shared.LogError, summaryErr)
+			continue
+		}
+		if state != "" && summary.State != state {
+			continue
+		}
+		summaries = append(summaries, *summary)
+		if len(summaries) == limit {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncodeErr := json.NewEncoder(w).Encode(summaries)
+	if jsonEncodeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func findSagaHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	convErr, sagaID := shared.ConvertStringToInt(vars["saga_id"])
+	if convErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	summaryErr, summary := getSagaSummary(*sagaID, true)
+	if errors.Is(summaryErr, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if summaryErr != nil {
+		slog.ErrorContext(r.Context(), "Saga summary error", shared.LogError, summaryErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncodeErr := json.NewEncoder(w).Encode(summary)
+	if jsonEncodeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func getSagaSummary(sagaID int64, withTimeline bool) (error, *SagaSummary) {
+	sagaErr, saga := dbConn.getSaga(sagaID)
+	if sagaErr != nil {
+		return sagaErr, nil
+	}
+	logsErr, sagaLogs := dbConn.getSagaLogs(sagaID)
+	if logsErr != nil {
+		return logsErr, nil
+	}
+
+	summary := SagaSummary{
+		SagaID:  saga.ID,
+		Created: saga.Timestamp,
+		Updated: saga.Timestamp,
+	}
+	if len(sagaLogs) == 0 {
+		summary.State = SAGA_STATE_STUCK
+		return nil, &summary
+	}
+
+	timeline := make([]SagaEvent, 0, len(sagaLogs))
+	for i := range sagaLogs {
+		convErr, message := sagaLogToSagaMessage(&sagaLogs[i])
+		if convErr != nil {
+			return convErr, nil
+		}
+		timeline = append(timeline, SagaEvent{
+			ID:        sagaLogs[i].ID,
+			Name:      message.Name,
+			Timestamp: sagaLogs[i].Timestamp,
+			Order:     message.Order,
+			Actor:     sagaLogs[i].Actor,
+			Reason:    sagaLogs[i].Reason,
+		})
+	}
+
+	first := timeline[0]
+	latest := timeline[len(timeline)-1]
+	summary.Saga = strings.TrimPrefix(first.Name, "START-")
+	summary.OrderID = first.Order.OrderID
+	summary.Step = latest.Name
+	summary.Updated = latest.Timestamp
+	summary.State = getSagaState(summary.Saga, timeline)
+	if withTimeline {
+		summary.Timeline = timeline
+	}
+	return nil, &summary
+}
+
+// getSagaState derives the state of a saga from its log. An unfinished saga is
+// stuck when its pending step timed out or already had to be sent again.
+func getSagaState(sagaName string, timeline []SagaEvent) string {
+	finished := false
+	aborted := false
+	for _, event := range timeline {
+		if event.Name == "END-"+sagaName {
+			finished = true
+		}
+		if strings.HasPrefix(event.Name, "ABORT-") {
+			aborted = true
+		}
+	}
+	if finished && aborted {
+		return SAGA_STATE_COMPENSATED
+	}
+	if finished {
+		return SAGA_STATE_COMPLETED
+	}
+
+	latest := timeline[len(timeline)-1]
+	if time.Since(latest.Timestamp) > shared.AppConfig.Timeouts.SagaStep {
+		return SAGA_STATE_STUCK
+	}
+	sent := 0
+	for _, event := range timeline {
+		if event.Name == latest.Name {
+			sent++
+		}
+	}
+	if sent > 1 {
+		return SAGA_STATE_STUCK
+	}
+	return SAGA_STATE_RUNNING
+}
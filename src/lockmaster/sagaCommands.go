@@ -0,0 +1,211 @@
+package lockmaster
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"main/shared"
+)
+
+// A sagaCommand changes a locked, unfinished saga by hand. It returns the
+// transition to apply once it is committed, or an error when the command does
+// not apply to the current step of the saga.
+type sagaCommand func(sagaConn SagaConnection, stateMachine *SagaStateMachine, latestMessage *shared.SagaMessage, request *sagaCommandRequest) (error, *sagaTransition)
+
+// sagaCommandRequest is who runs a command and why, kept in its audit log
+type sagaCommandRequest struct {
+	actor  string
+	reason string
+	// outcome of a resolved checkout, succeeded or failed
+	outcome string
+}
+
+var errSagaFinished = errors.New("saga is already finished")
+
+func retrySagaHandler(w http.ResponseWriter, r *http.Request) {
+	runSagaCommand(w, r, "RETRY", retrySaga)
+}
+
+func compensateSagaHandler(w http.ResponseWriter, r *http.Request) {
+	runSagaCommand(w, r, "COMPENSATE", compensateSaga)
+}
+
+func resolveSagaHandler(w http.ResponseWriter, r *http.Request) {
+	runSagaCommand(w, r, "RESOLVE", resolveSaga)
+}
+
+// runSagaCommand runs a command under the saga lock and answers with the
+// updated saga. The caller and an optional ?reason= are kept in the audit log
+// of the command.
+func runSagaCommand(w http.ResponseWriter, r *http.Request, commandName string, command sagaCommand) {
+	vars := mux.Vars(r)
+	convErr, sagaID := shared.ConvertStringToInt(vars["saga_id"])
+	if convErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	request := sagaCommandRequest{
+		actor:   r.RemoteAddr,
+		reason:  r.URL.Query().Get("reason"),
+		outcome: r.URL.Query().Get("outcome"),
+	}
+	if request.outcome != "" && request.outcome != shared.CHECKOUT_STATE_SUCCEEDED && request.outcome != shared.CHECKOUT_STATE_FAILED {
+		http.Error(w, "outcome must be succeeded or failed", http.StatusBadRequest)
+		return
+	}
+
+	lockErr, sagaConn := dbConn.lockSaga(r.Context(), *sagaID)
+	if errors.Is(lockErr, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if lockErr != nil {
+		slog.ErrorContext(r.Context(), "Saga command: lock saga error", "command", commandName, shared.LogError, lockErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer sagaConn.rollback()
+
+	latestErr, latestLog := sagaConn.getLatestSagaLog(*sagaID)
+	if errors.Is(latestErr, sql.ErrNoRows) {
+		http.Error(w, "saga has no log", http.StatusConflict)
+		return
+	}
+	if latestErr != nil {
+		slog.ErrorContext(r.Context(), "Saga command: saga log error", "command", commandName, shared.LogError, latestErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	convErr, latestMessage := sagaLogToSagaMessage(latestLog)
+	if convErr != nil {
+		slog.ErrorContext(r.Context(), "Saga command: saga log conversion error", "command", commandName, shared.LogError, convErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	machineErr, stateMachine := getSagaStateMachine(sagaConn, *sagaID)
+	if machineErr != nil {
+		slog.ErrorContext(r.Context(), "Saga command: saga state machine error", "command", commandName, shared.LogError, machineErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if latestMessage.Name == "END-"+stateMachine.name {
+		http.Error(w, errSagaFinished.Error(), http.StatusConflict)
+		return
+	}
+
+	commandErr, transition := command(sagaConn, stateMachine, latestMessage, &request)
+	if commandErr != nil {
+		http.Error(w, commandErr.Error(), http.StatusConflict)
+		return
+	}
+	slog.InfoContext(r.Context(), "Saga command", "command", commandName, "step", latestMessage.Name, "remote_addr", request.actor, "reason", request.reason)
+
+	commitErr := commitAndPublish(sagaConn, transition)
+	if commitErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	summaryErr, summary := getSagaSummary(*sagaID, true)
+	if summaryErr != nil {
+		slog.ErrorContext(r.Context(), "Saga summary error", shared.LogError, summaryErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncodeErr := json.NewEncoder(w).Encode(summary)
+	if jsonEncodeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// retrySaga sends the pending step of the saga again.
+func retrySaga(sagaConn SagaConnection, stateMachine *SagaStateMachine, latestMessage *shared.SagaMessage, request *sagaCommandRequest) (error, *sagaTransition) {
+	stepName := strings.TrimPrefix(latestMessage.Name, "START-")
+	if !strings.HasPrefix(latestMessage.Name, "START-") || stateMachine.topicOfMessage(latestMessage.Name) == "" {
+		return fmt.Errorf("saga is not waiting for a step at %s", latestMessage.Name), nil
+	}
+
+	auditErr := insertAuditLog(sagaConn, "RETRY-"+stepName, latestMessage, request)
+	if auditErr != nil {
+		return auditErr, nil
+	}
+	return resendSagaStep(sagaConn, stateMachine, latestMessage)
+}
+
+// compensateSaga aborts the pending step of the saga, which starts its
+// compensation with the compensation of the step itself. Compensation steps
+// themselves can only be retried.
+func compensateSaga(sagaConn SagaConnection, stateMachine *SagaStateMachine, latestMessage *shared.SagaMessage, request *sagaCommandRequest) (error, *sagaTransition) {
+	if _, abortable := stateMachine.failActionMap[latestMessage.Name]; !abortable {
+		return fmt.Errorf("saga cannot be compensated at %s", latestMessage.Name), nil
+	}
+
+	auditErr := insertAuditLog(sagaConn, "COMPENSATE-"+stateMachine.name, latestMessage, request)
+	if auditErr != nil {
+		return auditErr, nil
+	}
+	return abortSagaStep(sagaConn, stateMachine, latestMessage)
+}
+
+// resolveSaga ends the saga without sending a step, after its state was fixed
+// by hand in the participants. A checkout is released with the given outcome,
+// which answers the gateway and clears the checkout of the order.
+func resolveSaga(sagaConn SagaConnection, stateMachine *SagaStateMachine, latestMessage *shared.SagaMessage, request *sagaCommandRequest) (error, *sagaTransition) {
+	releaseStatus := 0
+	if stateMachine.releaseGateway {
+		switch request.outcome {
+		case shared.CHECKOUT_STATE_SUCCEEDED:
+			releaseStatus = http.StatusOK
+		case shared.CHECKOUT_STATE_FAILED:
+			releaseStatus = http.StatusBadRequest
+		default:
+			return fmt.Errorf("resolving %s needs ?outcome=succeeded or failed", stateMachine.name), nil
+		}
+	}
+
+	auditErr := insertAuditLog(sagaConn, "RESOLVE-"+stateMachine.name, latestMessage, request)
+	if auditErr != nil {
+		return auditErr, nil
+	}
+
+	endMessage := shared.SagaMessage{
+		Name:   "END-" + stateMachine.name,
+		SagaID: latestMessage.SagaID,
+		Order:  latestMessage.Order,
+	}
+	convErr, sagaLog := sagaMessageToSagaLog(&endMessage)
+	if convErr != nil {
+		return convErr, nil
+	}
+	insertErr := sagaConn.insertSagaLog(sagaLog)
+	if insertErr != nil {
+		return insertErr, nil
+	}
+	return nil, &sagaTransition{message: &endMessage, releaseStatus: releaseStatus}
+}
+
+// insertAuditLog logs a manual command with the order of the saga and who ran
+// it why, so the timeline shows when a saga was changed by hand.
+func insertAuditLog(sagaConn SagaConnection, name string, latestMessage *shared.SagaMessage, request *sagaCommandRequest) error {
+	auditMessage := shared.SagaMessage{
+		Name:   name,
+		SagaID: latestMessage.SagaID,
+		Order:  latestMessage.Order,
+	}
+	convErr, sagaLog := sagaMessageToSagaLog(&auditMessage)
+	if convErr != nil {
+		return convErr
+	}
+	sagaLog.Actor = request.actor
+	sagaLog.Reason = request.reason
+	return sagaConn.insertSagaLog(sagaLog)
+}
@@ -0,0 +1,124 @@
+package lockmaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"main/shared"
+)
+
+const testAdminToken = "admin-token"
+
+// postSagaCommand posts the command of the saga to the router of the
+// lockmaster, with the token unless it is empty
+func postSagaCommand(sagaID int64, command string, query string, token string) *httptest.ResponseRecorder {
+	path := "/sagas/" + strconv.FormatInt(sagaID, 10) + "/" + command + query
+	request := httptest.NewRequest(http.MethodPost, path, nil)
+	request.RemoteAddr = "10.0.0.7:51000"
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	NewRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestSagaCommandAuthorization(t *testing.T) {
+	tests := []struct {
+		name        string
+		configured  string
+		token       string
+		wantStatus  int
+		wantCommand bool
+	}{
+		{name: "no admin token configured", configured: "", token: testAdminToken, wantStatus: http.StatusForbidden},
+		{name: "without token", configured: testAdminToken, token: "", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", configured: testAdminToken, token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "admin token", configured: testAdminToken, token: testAdminToken, wantStatus: http.StatusOK, wantCommand: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared.AppConfig = &shared.Config{Admin: shared.AdminConfig{Token: test.configured}}
+			logged := []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK"}
+			store, sagaID := createTestSaga(t, logged...)
+
+			recorder := postSagaCommand(sagaID, "retry", "", test.token)
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("answered %d, want %d", recorder.Code, test.wantStatus)
+			}
+			names := getLoggedNames(t, store, sagaID)
+			if ran := len(names) > len(logged); ran != test.wantCommand {
+				t.Fatalf("logged %v after the command, want the command run %v", names, test.wantCommand)
+			}
+		})
+	}
+}
+
+func TestResolveSaga(t *testing.T) {
+	shared.AppConfig = &shared.Config{Admin: shared.AdminConfig{Token: testAdminToken}}
+	store, sagaID := createTestSaga(t, "START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK", "END-SUBTRACT-STOCK", "START-MAKE-PAYMENT")
+	_, sagaLogs := store.getSagaLogs(sagaID)
+	_, latestMessage := sagaLogToSagaMessage(&sagaLogs[len(sagaLogs)-1])
+
+	// a checkout is only resolved with its outcome
+	if recorder := postSagaCommand(sagaID, "resolve", "", testAdminToken); recorder.Code != http.StatusConflict {
+		t.Fatalf("resolve without outcome answered %d, want %d", recorder.Code, http.StatusConflict)
+	}
+	if recorder := postSagaCommand(sagaID, "resolve", "?outcome=maybe", testAdminToken); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("resolve with unknown outcome answered %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	subscribeErr, subscription := shared.SubscribeBroadcast(shared.CHECKOUT_RESULT_TOPIC)
+	if subscribeErr != nil {
+		t.Fatalf("subscribe: %v", subscribeErr)
+	}
+	defer subscription.Close()
+	time.Sleep(time.Millisecond)
+
+	recorder := postSagaCommand(sagaID, "resolve", "?outcome=failed&reason=refunded+by+hand", testAdminToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("resolve answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var summary SagaSummary
+	decodeErr := json.NewDecoder(recorder.Body).Decode(&summary)
+	if decodeErr != nil {
+		t.Fatalf("decode summary: %v", decodeErr)
+	}
+	timeline := summary.Timeline
+	if len(timeline) < 2 || timeline[len(timeline)-1].Name != "END-CHECKOUT-SAGA" {
+		t.Fatalf("timeline %+v does not end the saga", timeline)
+	}
+	audit := timeline[len(timeline)-2]
+	if audit.Name != "RESOLVE-CHECKOUT-SAGA" || audit.Actor != "10.0.0.7:51000" || audit.Reason != "refunded by hand" {
+		t.Errorf("audit log %s by %q for %q, want RESOLVE-CHECKOUT-SAGA with the caller and reason", audit.Name, audit.Actor, audit.Reason)
+	}
+
+	// the gateway is answered and the order service clears the checkout, the
+	// results of sagas of other tests are skipped
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for {
+		receiveErr, received := subscription.Receive(ctx)
+		if receiveErr != nil {
+			t.Fatalf("no checkout result for order %s: %v", latestMessage.Order.OrderID, receiveErr)
+		}
+		parseErr, result := shared.ParseCheckout(received.Value)
+		if parseErr != nil {
+			t.Fatalf("parse checkout result: %v", parseErr)
+		}
+		if result.OrderID != latestMessage.Order.OrderID {
+			continue
+		}
+		if result.State != shared.CHECKOUT_STATE_FAILED {
+			t.Errorf("checkout result %s, want %s", result.State, shared.CHECKOUT_STATE_FAILED)
+		}
+		return
+	}
+}
@@ -0,0 +1,246 @@
+package lockmaster
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultSagaDefinitionsPath = "config/sagas.yaml"
+
+type SagaStepDefinition struct {
+	Name         string              `yaml:"name"`
+	ID           int64               `yaml:"id"`
+	Topic        string              `yaml:"topic"`
+	Compensation *SagaStepDefinition `yaml:"compensation"`
+	// the saga goes on with the next step when this one aborts, for steps
+	// after a change that cannot be undone
+	ContinueOnAbort bool `yaml:"continue_on_abort"`
+}
+
+type SagaDefinition struct {
+	Name           string               `yaml:"name"`
+	ID             int64                `yaml:"id"`
+	ReleaseGateway bool                 `yaml:"release_gateway"`
+	RetryOnTimeout bool                 `yaml:"retry_on_timeout"`
+	Steps          []SagaStepDefinition `yaml:"steps"`
+}
+
+type SagaDefinitions struct {
+	Sagas []SagaDefinition `yaml:"sagas"`
+}
+
+type SagaStateMachine struct {
+	name           string
+	releaseGateway bool
+	retryOnTimeout bool
+	// Maps incoming message to outgoing message
+	successfulActionMap map[string]Action
+	// Maps message before ABORT to outgoing message
+	failActionMap map[string]Action
+	// Maps a step that is aborted without an answer, after a timeout or by
+	// hand, to outgoing message. The step may have run, so it is compensated
+	// as well.
+	timeoutActionMap map[string]Action
+}
+
+var sagaStateMachines = map[string]*SagaStateMachine{}
+
+func getSagaDefinitionsPath() string {
+	path := os.Getenv("SAGA_DEFINITIONS")
+	if path == "" {
+		return defaultSagaDefinitionsPath
+	}
+	return path
+}
+
+// loadSagaDefinitions reads the saga definitions and builds the state machines
+// and the message event tables from them.
+func loadSagaDefinitions(path string) error {
+	fileBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return readErr
+	}
+
+	var definitions SagaDefinitions
+	unmarshalErr := yaml.Unmarshal(fileBytes, &definitions)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if len(definitions.Sagas) == 0 {
+		return fmt.Errorf("no sagas defined in %s", path)
+	}
+
+	for _, definition := range definitions.Sagas {
+		registerErr := registerMessageEvent(definition.Name, definition.ID)
+		if registerErr != nil {
+			return registerErr
+		}
+		for _, step := range definition.Steps {
+			registerErr = registerStepEvents(&step)
+			if registerErr != nil {
+				return registerErr
+			}
+		}
+
+		buildErr, stateMachine := buildSagaStateMachine(&definition)
+		if buildErr != nil {
+			return buildErr
+		}
+		sagaStateMachines[definition.Name] = stateMachine
+	}
+	return nil
+}
+
+func registerStepEvents(step *SagaStepDefinition) error {
+	if step.Topic == "" {
+		return fmt.Errorf("saga step %s has no topic", step.Name)
+	}
+	registerErr := registerMessageEvent(step.Name, step.ID)
+	if registerErr != nil {
+		return registerErr
+	}
+	if step.Compensation != nil {
+		return registerStepEvents(step.Compensation)
+	}
+	return nil
+}
+
+// registerMessageEvent adds an event to the message event tables. Sagas may
+// share steps, but a name must always have the same id and the other way round.
+func registerMessageEvent(name string, id int64) error {
+	if name == "" || id <= 0 {
+		return fmt.Errorf("invalid message event %q with id %d", name, id)
+	}
+	if existingID, found := messageEventMapStringToInt[name]; found && existingID != id {
+		return fmt.Errorf("message event %s has ids %d and %d", name, existingID, id)
+	}
+	if existingName, found := messageEventMapIntToString[id]; found && existingName != name {
+		return fmt.Errorf("message event id %d is used by %s and %s", id, existingName, name)
+	}
+	messageEventMapStringToInt[name] = id
+	messageEventMapIntToString[id] = name
+	return nil
+}
+
+func buildSagaStateMachine(definition *SagaDefinition) (error, *SagaStateMachine) {
+	stateMachine := SagaStateMachine{
+		name:                definition.Name,
+		releaseGateway:      definition.ReleaseGateway,
+		retryOnTimeout:      definition.RetryOnTimeout,
+		successfulActionMap: map[string]Action{},
+		failActionMap:       map[string]Action{},
+		timeoutActionMap:    map[string]Action{},
+	}
+	steps := definition.Steps
+	endAction := Action{"END-" + definition.Name, ""}
+
+	// rollbackFrom returns the compensation of the latest step up to and
+	// including index that has one, or the end of the saga
+	rollbackFrom := func(index int) Action {
+		for i := index; i >= 0; i-- {
+			if compensation := steps[i].Compensation; compensation != nil {
+				return Action{"START-" + compensation.Name, compensation.Topic}
+			}
+		}
+		return endAction
+	}
+
+	addAction := func(actionMap map[string]Action, message string, action Action) error {
+		if _, found := actionMap[message]; found {
+			return fmt.Errorf("saga %s handles %s more than once", definition.Name, message)
+		}
+		actionMap[message] = action
+		return nil
+	}
+
+	first := endAction
+	if len(steps) > 0 {
+		first = Action{"START-" + steps[0].Name, steps[0].Topic}
+	}
+	addErr := addAction(stateMachine.successfulActionMap, "START-"+definition.Name, first)
+	if addErr != nil {
+		return addErr, nil
+	}
+
+	for i, step := range steps {
+		next := endAction
+		if i+1 < len(steps) {
+			next = Action{"START-" + steps[i+1].Name, steps[i+1].Topic}
+		}
+		addErr = addAction(stateMachine.successfulActionMap, "END-"+step.Name, next)
+		if addErr != nil {
+			return addErr, nil
+		}
+		failAction := rollbackFrom(i - 1)
+		if step.ContinueOnAbort {
+			failAction = next
+		}
+		addErr = addAction(stateMachine.failActionMap, "START-"+step.Name, failAction)
+		if addErr != nil {
+			return addErr, nil
+		}
+		addErr = addAction(stateMachine.timeoutActionMap, "START-"+step.Name, rollbackFrom(i))
+		if addErr != nil {
+			return addErr, nil
+		}
+		if step.Compensation != nil {
+			addErr = addAction(stateMachine.successfulActionMap, "END-"+step.Compensation.Name, rollbackFrom(i-1))
+			if addErr != nil {
+				return addErr, nil
+			}
+		}
+	}
+	return nil, &stateMachine
+}
+
+// topicOfMessage returns the topic a START message of a saga step is sent to.
+func (stateMachine *SagaStateMachine) topicOfMessage(messageName string) string {
+	for _, action := range stateMachine.successfulActionMap {
+		if action.nextMessage == messageName {
+			return action.topic
+		}
+	}
+	for _, action := range stateMachine.failActionMap {
+		if action.nextMessage == messageName {
+			return action.topic
+		}
+	}
+	return ""
+}
+
+// sagaEventIDs returns the message events of all defined sagas.
+func sagaEventIDs() []int64 {
+	eventIDs := make([]int64, 0, len(sagaStateMachines))
+	for name := range sagaStateMachines {
+		eventIDs = append(eventIDs, messageEventMapStringToInt[name])
+	}
+	return eventIDs
+}
+
+// getSagaStateMachineOfStart returns the state machine of the saga a
+// START-<SAGA> message starts.
+func getSagaStateMachineOfStart(messageName string) (*SagaStateMachine, bool) {
+	if !strings.HasPrefix(messageName, "START-") {
+		return nil, false
+	}
+	stateMachine, found := sagaStateMachines[strings.TrimPrefix(messageName, "START-")]
+	return stateMachine, found
+}
+
+// getSagaStateMachine returns the state machine of an existing saga, which is
+// given by the START message the saga was created for.
+func getSagaStateMachine(sagaConn SagaConnection, sagaID int64) (error, *SagaStateMachine) {
+	firstErr, firstLog := sagaConn.getFirstSagaLog(sagaID)
+	if firstErr != nil {
+		return firstErr, nil
+	}
+	sagaName := messageEventMapIntToString[firstLog.MessageEvent]
+	stateMachine, found := sagaStateMachines[sagaName]
+	if !found {
+		return fmt.Errorf("saga %d has no definition for event %d", sagaID, firstLog.MessageEvent), nil
+	}
+	return nil, stateMachine
+}
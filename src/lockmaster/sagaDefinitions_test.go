@@ -0,0 +1,183 @@
+package lockmaster
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the checkout maps the lockmaster had before the sagas were defined in
+// config/sagas.yaml
+var baselineSuccessfulActionMap = map[string]Action{
+	"START-CHECKOUT-SAGA": {"START-SUBTRACT-STOCK", "stock-syn"},
+	"END-SUBTRACT-STOCK":  {"START-MAKE-PAYMENT", "payment-syn"},
+	"END-MAKE-PAYMENT":    {"START-UPDATE-ORDER", "order-syn"},
+	"END-UPDATE-ORDER":    {"END-CHECKOUT-SAGA", ""},
+	"END-CANCEL-PAYMENT":  {"START-READD-STOCK", "stock-syn"},
+	"END-READD-STOCK":     {"END-CHECKOUT-SAGA", ""},
+}
+
+var baselineFailActionMap = map[string]Action{
+	"START-SUBTRACT-STOCK": {"END-CHECKOUT-SAGA", ""},
+	"START-MAKE-PAYMENT":   {"START-READD-STOCK", "stock-syn"},
+	"START-UPDATE-ORDER":   {"START-CANCEL-PAYMENT", "payment-syn"},
+}
+
+// a step that timed out is compensated as well
+var checkoutTimeoutActionMap = map[string]Action{
+	"START-SUBTRACT-STOCK": {"START-READD-STOCK", "stock-syn"},
+	"START-MAKE-PAYMENT":   {"START-CANCEL-PAYMENT", "payment-syn"},
+	"START-UPDATE-ORDER":   {"START-CANCEL-PAYMENT", "payment-syn"},
+}
+
+func assertActionMap(t *testing.T, name string, got map[string]Action, want map[string]Action) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s has %d actions %v, want %d %v", name, len(got), got, len(want), want)
+	}
+	for message, wantAction := range want {
+		if action, found := got[message]; !found || action != wantAction {
+			t.Errorf("%s maps %s to %v, want %v", name, message, action, wantAction)
+		}
+	}
+}
+
+func TestCheckoutSagaDefinition(t *testing.T) {
+	stateMachine, found := sagaStateMachines["CHECKOUT-SAGA"]
+	if !found {
+		t.Fatalf("config/sagas.yaml defines no CHECKOUT-SAGA")
+	}
+	assertActionMap(t, "successfulActionMap", stateMachine.successfulActionMap, baselineSuccessfulActionMap)
+	assertActionMap(t, "failActionMap", stateMachine.failActionMap, baselineFailActionMap)
+	assertActionMap(t, "timeoutActionMap", stateMachine.timeoutActionMap, checkoutTimeoutActionMap)
+	if !stateMachine.releaseGateway || stateMachine.retryOnTimeout {
+		t.Errorf("checkout releases the gateway %v and retries on timeout %v, want release only", stateMachine.releaseGateway, stateMachine.retryOnTimeout)
+	}
+}
+
+// once the payment is refunded the cancel saga goes on whatever the steps answer
+func TestCancelSagaDefinition(t *testing.T) {
+	stateMachine, found := sagaStateMachines["CANCEL-SAGA"]
+	if !found {
+		t.Fatalf("config/sagas.yaml defines no CANCEL-SAGA")
+	}
+	assertActionMap(t, "successfulActionMap", stateMachine.successfulActionMap, map[string]Action{
+		"START-CANCEL-SAGA":  {"START-CANCEL-PAYMENT", "payment-syn"},
+		"END-CANCEL-PAYMENT": {"START-READD-STOCK", "stock-syn"},
+		"END-READD-STOCK":    {"START-CANCEL-ORDER", "order-syn"},
+		"END-CANCEL-ORDER":   {"END-CANCEL-SAGA", ""},
+	})
+	assertActionMap(t, "failActionMap", stateMachine.failActionMap, map[string]Action{
+		"START-CANCEL-PAYMENT": {"END-CANCEL-SAGA", ""},
+		"START-READD-STOCK":    {"START-CANCEL-ORDER", "order-syn"},
+		"START-CANCEL-ORDER":   {"END-CANCEL-SAGA", ""},
+	})
+	if !stateMachine.retryOnTimeout {
+		t.Errorf("cancel saga does not retry steps that time out")
+	}
+}
+
+// useEmptySagaTables lets a test load definitions of its own, the tables of
+// config/sagas.yaml are restored afterwards
+func useEmptySagaTables(t *testing.T) {
+	t.Helper()
+	stateMachines, eventIDs, eventNames := sagaStateMachines, messageEventMapStringToInt, messageEventMapIntToString
+	sagaStateMachines = map[string]*SagaStateMachine{}
+	messageEventMapStringToInt = map[string]int64{}
+	messageEventMapIntToString = map[int64]string{}
+	t.Cleanup(func() {
+		sagaStateMachines, messageEventMapStringToInt, messageEventMapIntToString = stateMachines, eventIDs, eventNames
+	})
+}
+
+func TestLoadSagaDefinitionsRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		definitions string
+	}{
+		{
+			name:        "no sagas",
+			definitions: "sagas: []\n",
+		},
+		{
+			name:        "broken yaml",
+			definitions: "sagas:\n  - name: [\n",
+		},
+		{
+			name: "saga without id",
+			definitions: `sagas:
+  - name: A-SAGA
+    steps:
+      - {name: STEP, id: 2, topic: t}
+`,
+		},
+		{
+			name: "step without topic",
+			definitions: `sagas:
+  - name: A-SAGA
+    id: 1
+    steps:
+      - {name: STEP, id: 2}
+`,
+		},
+		{
+			name: "compensation without topic",
+			definitions: `sagas:
+  - name: A-SAGA
+    id: 1
+    steps:
+      - name: STEP
+        id: 2
+        topic: t
+        compensation: {name: UNDO, id: 3}
+`,
+		},
+		{
+			name: "step with two ids",
+			definitions: `sagas:
+  - name: A-SAGA
+    id: 1
+    steps:
+      - {name: STEP, id: 2, topic: t}
+  - name: B-SAGA
+    id: 3
+    steps:
+      - {name: STEP, id: 4, topic: t}
+`,
+		},
+		{
+			name: "id of two steps",
+			definitions: `sagas:
+  - name: A-SAGA
+    id: 1
+    steps:
+      - {name: STEP, id: 2, topic: t}
+      - {name: OTHER-STEP, id: 2, topic: t}
+`,
+		},
+		{
+			name: "step twice in a saga",
+			definitions: `sagas:
+  - name: A-SAGA
+    id: 1
+    steps:
+      - {name: STEP, id: 2, topic: t}
+      - {name: STEP, id: 2, topic: t}
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useEmptySagaTables(t)
+			path := filepath.Join(t.TempDir(), "sagas.yaml")
+			writeErr := os.WriteFile(path, []byte(test.definitions), 0o644)
+			if writeErr != nil {
+				t.Fatalf("write definitions: %v", writeErr)
+			}
+			if loadErr := loadSagaDefinitions(path); loadErr == nil {
+				t.Fatalf("definitions were loaded, want an error")
+			}
+		})
+	}
+}
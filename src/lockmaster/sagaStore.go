@@ -0,0 +1,284 @@
+package lockmaster
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SagaStore holds the saga log, in MySQL or in memory in local mode. Missing
+// sagas and logs are reported as sql.ErrNoRows by every implementation.
+type SagaStore interface {
+	// createSaga adds a saga and locks it like lockSaga. The saga only exists
+	// for others once the returned connection is committed, a rollback drops
+	// it again.
+	createSaga(ctx context.Context) (error, *int64, SagaConnection)
+	// lockSaga waits until no one else holds the saga and locks it until the
+	// returned connection is committed or rolled back. The queries of the
+	// connection run in the trace of ctx.
+	lockSaga(ctx context.Context, sagaID int64) (error, SagaConnection)
+	getUnfinishedSagaIDs(endType int64, sagaEvents []int64) (error, []int64)
+	// getIdleSagaIDs returns the unfinished sagas whose latest message was
+	// logged at least idleFor ago
+	getIdleSagaIDs(endType int64, sagaEvents []int64, idleFor time.Duration) (error, []int64)
+	getSaga(sagaID int64) (error, *Saga)
+	getSagaLogs(sagaID int64) (error, []SagaLog)
+	getRecentSagaIDs(limit int) (error, []int64)
+	getSagaIDsOfOrder(orderID string, limit int) (error, []int64)
+	close() error
+}
+
+// SagaConnection reads and writes the log of a locked saga in a transaction
+type SagaConnection interface {
+	getLatestSagaLog(sagaID int64) (error, *SagaLog)
+	getLatestSagaLogOfType(sagaID int64, messageType int64) (error, *SagaLog)
+	getFirstSagaLog(sagaID int64) (error, *SagaLog)
+	insertSagaLog(sagaLog *SagaLog) error
+	commit() error
+	rollback()
+}
+
+// memorySagaStore keeps the saga log in memory, it is lost with the process
+type memorySagaStore struct {
+	mu         sync.Mutex
+	sagas      map[int64]*memorySaga
+	logs       []SagaLog
+	lastSagaID int64
+	lastLogID  int64
+}
+
+type memorySaga struct {
+	saga Saga
+	// holds a value while the saga is locked
+	lock chan struct{}
+}
+
+// memorySagaConnection keeps the logs of its transaction until commit
+type memorySagaConnection struct {
+	store   *memorySagaStore
+	saga    *memorySaga
+	pending []SagaLog
+	// the saga was created by this connection, a rollback removes it
+	created bool
+	done    bool
+}
+
+func newMemorySagaStore() *memorySagaStore {
+	return &memorySagaStore{sagas: map[int64]*memorySaga{}}
+}
+
+func (store *memorySagaStore) createSaga(ctx context.Context) (error, *int64, SagaConnection) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.lastSagaID++
+	sagaID := store.lastSagaID
+	saga := &memorySaga{
+		saga: Saga{ID: sagaID, Timestamp: time.Now()},
+		lock: make(chan struct{}, 1),
+	}
+	saga.lock <- struct{}{}
+	store.sagas[sagaID] = saga
+	return nil, &sagaID, &memorySagaConnection{store: store, saga: saga, created: true}
+}
+
+func (store *memorySagaStore) lockSaga(ctx context.Context, sagaID int64) (error, SagaConnection) {
+	store.mu.Lock()
+	saga, found := store.sagas[sagaID]
+	store.mu.Unlock()
+	if !found {
+		return sql.ErrNoRows, nil
+	}
+	saga.lock <- struct{}{}
+	return nil, &memorySagaConnection{store: store, saga: saga}
+}
+
+func (store *memorySagaStore) close() error {
+	return nil
+}
+
+func (store *memorySagaStore) getUnfinishedSagaIDs(endType int64, sagaEvents []int64) (error, []int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	finished := map[int64]bool{}
+	for _, sagaLog := range store.logs {
+		if sagaLog.MessageType != endType {
+			continue
+		}
+		for _, sagaEvent := range sagaEvents {
+			if sagaLog.MessageEvent == sagaEvent {
+				finished[sagaLog.SagaID] = true
+			}
+		}
+	}
+	var sagaIDs []int64
+	for sagaID := range store.sagas {
+		if !finished[sagaID] {
+			sagaIDs = append(sagaIDs, sagaID)
+		}
+	}
+	sort.Slice(sagaIDs, func(i, j int) bool { return sagaIDs[i] < sagaIDs[j] })
+	return nil, sagaIDs
+}
+
+func (store *memorySagaStore) getIdleSagaIDs(endType int64, sagaEvents []int64, idleFor time.Duration) (error, []int64) {
+	_, unfinishedIDs := store.getUnfinishedSagaIDs(endType, sagaEvents)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	latest := map[int64]time.Time{}
+	for _, sagaLog := range store.logs {
+		latest[sagaLog.SagaID] = sagaLog.Timestamp
+	}
+	var sagaIDs []int64
+	for _, sagaID := range unfinishedIDs {
+		timestamp, logged := latest[sagaID]
+		if logged && time.Since(timestamp) >= idleFor {
+			sagaIDs = append(sagaIDs, sagaID)
+		}
+	}
+	return nil, sagaIDs
+}
+
+func (store *memorySagaStore) getSaga(sagaID int64) (error, *Saga) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	saga, found := store.sagas[sagaID]
+	if !found {
+		return sql.ErrNoRows, nil
+	}
+	sagaCopy := saga.saga
+	return nil, &sagaCopy
+}
+
+func (store *memorySagaStore) getSagaLogs(sagaID int64) (error, []SagaLog) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var sagaLogs []SagaLog
+	for _, sagaLog := range store.logs {
+		if sagaLog.SagaID == sagaID {
+			sagaLogs = append(sagaLogs, sagaLog)
+		}
+	}
+	return nil, sagaLogs
+}
+
+func (store *memorySagaStore) getRecentSagaIDs(limit int) (error, []int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var sagaIDs []int64
+	for sagaID := store.lastSagaID; sagaID > 0 && len(sagaIDs) < limit; sagaID-- {
+		if _, found := store.sagas[sagaID]; found {
+			sagaIDs = append(sagaIDs, sagaID)
+		}
+	}
+	return nil, sagaIDs
+}
+
+func (store *memorySagaStore) getSagaIDsOfOrder(orderID string, limit int) (error, []int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	pattern := `"order_id":"` + orderID + `"`
+	var sagaIDs []int64
+	seen := map[int64]bool{}
+	for i := len(store.logs) - 1; i >= 0; i-- {
+		sagaLog := store.logs[i]
+		if seen[sagaLog.SagaID] || !strings.Contains(sagaLog.SagaContents, pattern) {
+			continue
+		}
+		seen[sagaLog.SagaID] = true
+		sagaIDs = append(sagaIDs, sagaLog.SagaID)
+	}
+	sort.Slice(sagaIDs, func(i, j int) bool { return sagaIDs[i] > sagaIDs[j] })
+	if len(sagaIDs) > limit {
+		sagaIDs = sagaIDs[:limit]
+	}
+	return nil, sagaIDs
+}
+
+// sagaLogs returns the committed and the pending logs of the saga, in order
+func (sagaConn *memorySagaConnection) sagaLogs(sagaID int64) []SagaLog {
+	sagaConn.store.mu.Lock()
+	defer sagaConn.store.mu.Unlock()
+	var sagaLogs []SagaLog
+	for _, sagaLog := range sagaConn.store.logs {
+		if sagaLog.SagaID == sagaID {
+			sagaLogs = append(sagaLogs, sagaLog)
+		}
+	}
+	for _, sagaLog := range sagaConn.pending {
+		if sagaLog.SagaID == sagaID {
+			sagaLogs = append(sagaLogs, sagaLog)
+		}
+	}
+	return sagaLogs
+}
+
+func (sagaConn *memorySagaConnection) getLatestSagaLog(sagaID int64) (error, *SagaLog) {
+	sagaLogs := sagaConn.sagaLogs(sagaID)
+	if len(sagaLogs) == 0 {
+		return sql.ErrNoRows, nil
+	}
+	return nil, &sagaLogs[len(sagaLogs)-1]
+}
+
+func (sagaConn *memorySagaConnection) getLatestSagaLogOfType(sagaID int64, messageType int64) (error, *SagaLog) {
+	sagaLogs := sagaConn.sagaLogs(sagaID)
+	for i := len(sagaLogs) - 1; i >= 0; i-- {
+		if sagaLogs[i].MessageType == messageType {
+			return nil, &sagaLogs[i]
+		}
+	}
+	return sql.ErrNoRows, nil
+}
+
+func (sagaConn *memorySagaConnection) getFirstSagaLog(sagaID int64) (error, *SagaLog) {
+	sagaLogs := sagaConn.sagaLogs(sagaID)
+	if len(sagaLogs) == 0 {
+		return sql.ErrNoRows, nil
+	}
+	return nil, &sagaLogs[0]
+}
+
+func (sagaConn *memorySagaConnection) insertSagaLog(sagaLog *SagaLog) error {
+	pendingLog := *sagaLog
+	pendingLog.Timestamp = time.Now()
+	sagaConn.pending = append(sagaConn.pending, pendingLog)
+	return nil
+}
+
+func (sagaConn *memorySagaConnection) commit() error {
+	if sagaConn.done {
+		return sql.ErrTxDone
+	}
+	sagaConn.store.mu.Lock()
+	for _, sagaLog := range sagaConn.pending {
+		sagaConn.store.lastLogID++
+		sagaLog.ID = sagaConn.store.lastLogID
+		sagaConn.store.logs = append(sagaConn.store.logs, sagaLog)
+	}
+	sagaConn.store.mu.Unlock()
+	sagaConn.pending = nil
+	sagaConn.release()
+	return nil
+}
+
+func (sagaConn *memorySagaConnection) rollback() {
+	// rollback after commit is a no-op
+	if sagaConn.done {
+		return
+	}
+	sagaConn.pending = nil
+	if sagaConn.created {
+		sagaConn.store.mu.Lock()
+		delete(sagaConn.store.sagas, sagaConn.saga.saga.ID)
+		sagaConn.store.mu.Unlock()
+	}
+	sagaConn.release()
+}
+
+func (sagaConn *memorySagaConnection) release() {
+	sagaConn.done = true
+	<-sagaConn.saga.lock
+}
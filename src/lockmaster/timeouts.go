@@ -0,0 +1,79 @@
+package lockmaster
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"main/shared"
+)
+
+const timeoutCheckInterval = 5 * time.Second
+
+// startTimeoutScheduler periodically aborts saga steps whose participant did
+// not answer within the saga step timeout. Every replica checks, but only
+// locks the sagas that were idle for the timeout.
+func startTimeoutScheduler() {
+	slog.Info("Starting saga step timeouts", "timeout", shared.AppConfig.Timeouts.SagaStep.String())
+	go func() {
+		ticker := time.NewTicker(timeoutCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireSagaSteps()
+		}
+	}()
+}
+
+func expireSagaSteps() {
+	queryErr, sagaIDs := dbConn.getIdleSagaIDs(messageTypeMapStringToInt["END"], sagaEventIDs(), shared.AppConfig.Timeouts.SagaStep)
+	if queryErr != nil {
+		slog.Error("Timeout: get idle sagas error", shared.LogError, queryErr)
+		return
+	}
+	for _, sagaID := range sagaIDs {
+		expireSagaStep(sagaID)
+	}
+}
+
+func expireSagaStep(sagaID int64) {
+	ctx := shared.WithLogFields(context.Background(), slog.Int64(shared.LogSagaID, sagaID))
+	lockErr, sagaConn := dbConn.lockSaga(ctx, sagaID)
+	if lockErr != nil {
+		slog.ErrorContext(ctx, "Timeout: lock saga error", shared.LogError, lockErr)
+		return
+	}
+	defer sagaConn.rollback()
+
+	latestErr, latestLog := sagaConn.getLatestSagaLog(sagaID)
+	if latestErr != nil || time.Since(latestLog.Timestamp) < shared.AppConfig.Timeouts.SagaStep {
+		return
+	}
+	convErr, latestMessage := sagaLogToSagaMessage(latestLog)
+	if convErr != nil || !strings.HasPrefix(latestMessage.Name, "START-") {
+		return
+	}
+	machineErr, stateMachine := getSagaStateMachine(sagaConn, sagaID)
+	if machineErr != nil {
+		slog.ErrorContext(ctx, "Timeout: saga state machine error", shared.LogError, machineErr)
+		return
+	}
+
+	var advanceErr error
+	var transition *sagaTransition
+
+	if _, abortable := stateMachine.failActionMap[latestMessage.Name]; abortable && !stateMachine.retryOnTimeout {
+		slog.WarnContext(ctx, "Timeout: saga step timed out, aborting", "step", latestMessage.Name, shared.LogOrderID, latestMessage.Order.OrderID)
+		advanceErr, transition = abortSagaStep(sagaConn, stateMachine, latestMessage)
+	} else if stateMachine.topicOfMessage(latestMessage.Name) != "" {
+		// compensations cannot be aborted, keep retrying them
+		slog.WarnContext(ctx, "Timeout: saga step timed out, retrying", "step", latestMessage.Name, shared.LogOrderID, latestMessage.Order.OrderID)
+		advanceErr, transition = resendSagaStep(sagaConn, stateMachine, latestMessage)
+	}
+	if advanceErr != nil {
+		slog.ErrorContext(ctx, "Timeout: advance saga error", shared.LogError, advanceErr)
+		return
+	}
+
+	commitAndPublish(sagaConn, transition)
+}
@@ -0,0 +1,121 @@
+package lockmaster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"main/shared"
+)
+
+func TestExpireSagaStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		logged   []string
+		sagaStep time.Duration
+		// the messages logged by the timeout after the logged ones
+		wantLogged []string
+		// the message the timeout sends, with its topic
+		wantMessage string
+		wantTopic   string
+	}{
+		{
+			name:        "abort a step that timed out",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK"},
+			sagaStep:    time.Nanosecond,
+			wantLogged:  []string{"ABORT-CHECKOUT-SAGA", "START-READD-STOCK"},
+			wantMessage: "START-READD-STOCK",
+			wantTopic:   "stock-syn",
+		},
+		{
+			name:        "compensate the completed steps and the one that timed out",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK", "END-SUBTRACT-STOCK", "START-MAKE-PAYMENT"},
+			sagaStep:    time.Nanosecond,
+			wantLogged:  []string{"ABORT-CHECKOUT-SAGA", "START-CANCEL-PAYMENT"},
+			wantMessage: "START-CANCEL-PAYMENT",
+			wantTopic:   "payment-syn",
+		},
+		{
+			name:        "retry a compensation that timed out",
+			logged:      []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK", "ABORT-SUBTRACT-STOCK", "START-READD-STOCK"},
+			sagaStep:    time.Nanosecond,
+			wantLogged:  []string{"START-READD-STOCK"},
+			wantMessage: "START-READD-STOCK",
+			wantTopic:   "stock-syn",
+		},
+		{
+			name:        "retry a step of a saga that retries on timeout",
+			logged:      []string{"START-CANCEL-SAGA", "START-CANCEL-PAYMENT"},
+			sagaStep:    time.Nanosecond,
+			wantLogged:  []string{"START-CANCEL-PAYMENT"},
+			wantMessage: "START-CANCEL-PAYMENT",
+			wantTopic:   "payment-syn",
+		},
+		{
+			name:      "leave a step that has not timed out",
+			logged:    []string{"START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK"},
+			sagaStep:  time.Hour,
+			wantTopic: "stock-syn",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared.AppConfig = &shared.Config{Timeouts: shared.TimeoutsConfig{SagaStep: test.sagaStep}}
+			store, sagaID := createTestSaga(t, test.logged...)
+			subscribeErr, subscription := shared.SubscribeBroadcast(test.wantTopic)
+			if subscribeErr != nil {
+				t.Fatalf("subscribe: %v", subscribeErr)
+			}
+			defer subscription.Close()
+
+			time.Sleep(time.Millisecond)
+			expireSagaSteps()
+
+			logged := getLoggedNames(t, store, sagaID)
+			wantLogged := append(append([]string{}, test.logged...), test.wantLogged...)
+			if len(logged) != len(wantLogged) {
+				t.Fatalf("logged %v, want %v", logged, wantLogged)
+			}
+			for i := range wantLogged {
+				if logged[i] != wantLogged[i] {
+					t.Fatalf("logged %v, want %v", logged, wantLogged)
+				}
+			}
+
+			message := receiveSagaMessage(t, subscription)
+			if test.wantMessage == "" {
+				if message != nil {
+					t.Fatalf("sent %s, want nothing", message.Name)
+				}
+				return
+			}
+			if message == nil || message.Name != test.wantMessage || message.SagaID != sagaID {
+				t.Fatalf("sent %+v, want %s of saga %d", message, test.wantMessage, sagaID)
+			}
+		})
+	}
+}
+
+func TestGetIdleSagaIDs(t *testing.T) {
+	store, idleID := createTestSaga(t, "START-CHECKOUT-SAGA", "START-SUBTRACT-STOCK")
+	createErr, finishedID, sagaConn := store.createSaga(context.Background())
+	if createErr != nil {
+		t.Fatalf("create saga: %v", createErr)
+	}
+	for _, name := range []string{"START-CHECKOUT-SAGA", "END-CHECKOUT-SAGA"} {
+		_, sagaLog := sagaMessageToSagaLog(&shared.SagaMessage{Name: name, SagaID: *finishedID})
+		sagaConn.insertSagaLog(sagaLog)
+	}
+	sagaConn.commit()
+	time.Sleep(time.Millisecond)
+
+	_, sagaIDs := store.getIdleSagaIDs(messageTypeMapStringToInt["END"], sagaEventIDs(), time.Nanosecond)
+	if len(sagaIDs) != 1 || sagaIDs[0] != idleID {
+		t.Fatalf("idle sagas %v, want [%d]", sagaIDs, idleID)
+	}
+	_, sagaIDs = store.getIdleSagaIDs(messageTypeMapStringToInt["END"], sagaEventIDs(), time.Hour)
+	if len(sagaIDs) != 0 {
+		t.Fatalf("idle sagas %v within the hour, want none", sagaIDs)
+	}
+}
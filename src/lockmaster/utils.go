@@ -1,4 +1,4 @@
-package main
+package lockmaster
 
 import (
 	"encoding/json"
@@ -13,46 +13,37 @@ var messageTypeMapStringToInt = map[string]int64{
 	"START": 1,
 	"END":   2,
 	"ABORT": 3,
+	// Audit logs of manual saga commands
+	"RETRY":      4,
+	"COMPENSATE": 5,
+	"RESOLVE":    6,
 }
 
-var messageEventMapStringToInt = map[string]int64{
-	"MAKE-PAYMENT":   1,
-	"CANCEL-PAYMENT": 2,
-	"CHECKOUT-SAGA":  3,
-	"CANCEL-SAGA":    4,
-	"SUBTRACT-STOCK": 5,
-	"READD-STOCK":    6,
-	"UPDATE-ORDER":   7,
-}
+// Filled from the saga definitions by loadSagaDefinitions
+var messageEventMapStringToInt = map[string]int64{}
 
 var messageTypeMapIntToString = map[int64]string{
 	1: "START",
 	2: "END",
 	3: "ABORT",
+	4: "RETRY",
+	5: "COMPENSATE",
+	6: "RESOLVE",
 }
 
-var messageEventMapIntToString = map[int64]string{
-	1: "MAKE-PAYMENT",
-	2: "CANCEL-PAYMENT",
-	3: "CHECKOUT-SAGA",
-	4: "CANCEL-SAGA",
-	5: "SUBTRACT-STOCK",
-	6: "READD-STOCK",
-	7: "UPDATE-ORDER",
-}
+// Filled from the saga definitions by loadSagaDefinitions
+var messageEventMapIntToString = map[int64]string{}
 
 func sagaMessageToSagaLog(sagaMessage *shared.SagaMessage) (error, *SagaLog) {
 	msgTypErr, messageType := getMessageTypeInt(sagaMessage.Name)
 	if msgTypErr != nil {
 		return msgTypErr, nil
 	}
-	// fmt.Printf("Message Type: %d", messageType)
 
 	msgEventErr, messageEvent := getMessageEventInt(sagaMessage.Name)
 	if msgEventErr != nil {
 		return msgEventErr, nil
 	}
-	// fmt.Printf("Message Event: %d", messageEvent)
 
 	orderBytes, unmarshalErr := json.Marshal(sagaMessage.Order)
 	if unmarshalErr != nil {
@@ -107,7 +98,7 @@ func getMessageTypeInt(messageName string) (error, int64) {
 func getMessageEventInt(messageName string) (error, int64) {
 	parts := strings.Split(messageName, "-")
 
-	messageEventStr := strings.Join(parts[1:3], "-")
+	messageEventStr := strings.Join(parts[1:], "-")
 	messageEvent, found := messageEventMapStringToInt[messageEventStr]
 	if !found {
 		errorMsg := fmt.Sprintf("invalid message event: %s", messageEventStr)
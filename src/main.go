@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+
+	apigateway "main/api-gateway"
+	"main/local"
+	"main/lockmaster"
+	"main/order"
+	"main/payment"
+	"main/shared"
+	"main/stock"
+)
+
+// services that can be run by name, from SERVICE or the first argument
+var services = map[string]func(){
+	"order":       order.Run,
+	"stock":       stock.Run,
+	"payment":     payment.Run,
+	"lockmaster":  lockmaster.Run,
+	"api-gateway": apigateway.Run,
+	"local":       local.Run,
+	// inspects and replays dead letters through the lockmaster
+	"dlq": lockmaster.RunDeadLetterCLI,
+}
+
+func main() {
+	service := os.Getenv("SERVICE")
+	if len(os.Args) > 1 {
+		service = os.Args[1]
+	}
+	run, found := services[service]
+	if !found {
+		shared.Fatal("Unknown service, use order, stock, payment, lockmaster, api-gateway, local or dlq", shared.LogService, service)
+	}
+
+	configErr := shared.SetUpConfig()
+	if configErr != nil {
+		shared.Fatal("Failed to load the config", shared.LogError, configErr)
+	}
+	// the dlq CLI writes plain text for people, not records
+	if service != "dlq" {
+		shared.SetUpLogging(service)
+	}
+
+	run()
+}
@@ -1,113 +1,179 @@
-package main
+package order
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"main/shared"
 )
 
-var clients [5]*mongo.Client
-var ordersCollections [5]*mongo.Collection
+var orderStore OrderStore
+var sagaSteps shared.SagaStepStore
 
-func main() {
-	go shared.SetUpKafkaListener(
-		[]string{"order"}, false,
-		func(message *shared.SagaMessage) (*shared.SagaMessage, string) {
-
-			returnMessage := shared.SagaMessageConvertStartToEnd(message)
-
-			if message.Name == "START-UPDATE-ORDER" {
-				// ignore error, will not happen
-				_, orderID := shared.ConvertStringToUUID(message.Order.OrderID)
-
-				clientError, serverError := updateOrder(orderID, true)
-				if clientError != nil || serverError != nil {
-					returnMessage.Name = "ABORT-CHECKOUT-SAGA"
-				}
-
-				return returnMessage, "order-ack"
-			}
-
-			return nil, ""
-		},
-	)
+// Run serves the order service on its Mongo shards and Kafka.
+func Run() {
+	shared.ServiceName = "order"
+	defer shared.SetUpTracing("order")()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	setupErr := setupDBConnections(ctx)
+	setupErr, shards := connectMongoShards(ctx)
 	if setupErr != nil {
-		log.Fatal(setupErr)
+		shared.Fatal("Connect to the Mongo shards error", shared.LogError, setupErr)
 	}
-	for i := 0; i < 5; i++ {
-		defer clients[i].Disconnect(ctx)
+	defer shards.disconnect(ctx)
+	orderStore = &mongoOrderStore{orders: shards.orders}
+	sagaSteps = shared.NewShardedSagaSteps(shards.sagaSteps)
+	shards.startResharding()
+
+	go setUpSagaListener()
+	setUpCheckoutResultListener()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
 	}
 
+	// Set the listening address and port for the server
+	addr := fmt.Sprintf(":%s", port)
+	slog.Info("Starting order service", "addr", addr)
+	serveErr := http.ListenAndServe(addr, NewRouter())
+	shared.Fatal("Serve error", shared.LogError, serveErr)
+}
+
+// StartLocal starts the order service on in-memory stores and returns its
+// routes, for the local mode.
+func StartLocal() http.Handler {
+	orderStore = newMemoryOrderStore()
+	sagaSteps = shared.NewMemorySagaSteps()
+	go setUpSagaListener()
+	setUpCheckoutResultListener()
+	return NewRouter()
+}
+
+func NewRouter() *mux.Router {
 	router := mux.NewRouter()
+	shared.InstrumentRouter(router, "order")
 	router.HandleFunc("/create/{user_id}", createOrderHandler)
 	router.HandleFunc("/remove/{order_id}", removeOrderHandler)
 	router.HandleFunc("/find/{order_id}", findOrderHandler)
 	router.HandleFunc("/addItem/{order_id}/{item_id}", addItemHandler)
+	router.HandleFunc("/addItem/{order_id}/{item_id}/{quantity}", addItemHandler)
 	router.HandleFunc("/removeItem/{order_id}/{item_id}", removeItemHandler)
+	router.HandleFunc("/removeItem/{order_id}/{item_id}/{quantity}", removeItemHandler)
 	router.HandleFunc("/checkout/{order_id}", checkoutHandler)
+	router.HandleFunc("/cancel/{order_id}", cancelOrderHandler)
 	router.HandleFunc("/", defaultCheckoutHandler)
+	return router
+}
 
-	port := os.Getenv("PORT")
-	fmt.Printf("Current port is : %s\n", port)
-	if port == "" {
-		port = "8080"
-	}
+func setUpSagaListener() {
+	shared.SetUpSagaListener(
+		[]string{"order"}, false,
+		func(ctx context.Context, message *shared.SagaMessage) (error, *shared.SagaMessage, string) {
 
-	// Set the listening address and port for the server
-	addr := fmt.Sprintf(":%s", port)
-	fmt.Printf("Starting order service at %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, router))
+			returnMessage := shared.SagaMessageConvertStartToEnd(message)
+
+			// a server error is tried again, the step runs again without
+			// changing the order twice
+
+			if message.Name == "START-UPDATE-ORDER" {
+				stepErr, reply := sagaSteps.RunSagaStepOnce(ctx, message, func(ctx context.Context) (error, *shared.SagaMessage) {
+					// ignore error, will not happen
+					_, orderID := shared.ConvertStringToUUID(message.Order.OrderID)
+
+					clientError, serverError := updateOrder(ctx, orderStore, orderID, message.Order.Items, shared.SagaStepID(message))
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				})
+				return stepErr, reply, "order-ack"
+			}
+
+			if message.Name == "START-CANCEL-ORDER" {
+				stepErr, reply := sagaSteps.RunSagaStepOnce(ctx, message, func(ctx context.Context) (error, *shared.SagaMessage) {
+					// ignore error, will not happen
+					_, orderID := shared.ConvertStringToUUID(message.Order.OrderID)
+
+					clientError, serverError := cancelOrder(ctx, orderStore, orderID, shared.SagaStepID(message))
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				})
+				return stepErr, reply, "order-ack"
+			}
+
+			return nil, nil, ""
+		},
+	)
 }
 
-func setupDBConnections(ctx context.Context) error {
-	for i := 0; i < 5; i++ {
-		mongoURL := fmt.Sprintf("mongodb://orderdb-service-%d:27017", i)
-		// mongoURL := "mongodb://localhost:27017"
-		fmt.Printf("%d MongoDB URL: %s", i, mongoURL)
-		var err error
-		var client *mongo.Client
-		client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
-
-		if err != nil {
-			return err
-		}
-		clients[i] = client
-		ordersCollections[i] = client.Database("orders").Collection("orders")
+// setUpCheckoutResultListener ends the checkout of an order when its saga
+// ends, so the order can be checked out again. A checkout that timed out at the
+// gateway may still be running and stays until its saga ends. The order
+// replicas share a group, so every result is applied once.
+func setUpCheckoutResultListener() {
+	subscribeErr, subscription := shared.Subscribe(shared.CHECKOUT_RESULT_TOPIC, "order-checkout-group")
+	if subscribeErr != nil {
+		shared.Fatal("Subscribe error", shared.LogTopic, shared.CHECKOUT_RESULT_TOPIC, shared.LogError, subscribeErr)
 	}
-	return nil
+	go receiveCheckoutResults(subscription)
 }
 
-func getOrder(orderID *uuid.UUID) (error, *shared.Order) {
-	ordersCollection := getOrdersCollection(*orderID)
-	filter := bson.M{"_id": orderID}
-	var order shared.Order
-	findDocErr := ordersCollection.FindOne(context.Background(), filter).Decode(&order)
-	if findDocErr != nil {
-		return findDocErr, nil
+func receiveCheckoutResults(subscription shared.Subscription) {
+	defer subscription.Close()
+	topicCtx := shared.WithLogFields(context.Background(), slog.String(shared.LogTopic, shared.CHECKOUT_RESULT_TOPIC))
+	for {
+		receiveErr, m := subscription.Receive(context.Background())
+		if receiveErr != nil {
+			slog.ErrorContext(topicCtx, "Read message error", shared.LogError, receiveErr)
+			continue
+		}
+		applyCheckoutResult(topicCtx, m)
+		commitErr := subscription.Commit(topicCtx, m)
+		if commitErr != nil {
+			slog.ErrorContext(topicCtx, "Commit message error", shared.LogError, commitErr)
+		}
 	}
-	return nil, &order
 }
 
-func getOrdersCollection(orderID uuid.UUID) *mongo.Collection {
-	databaseNum := shared.HashUUID(orderID)
-	return ordersCollections[databaseNum]
+// applyCheckoutResult ends the checkout of a finished saga, other checkout
+// changes are skipped
+func applyCheckoutResult(ctx context.Context, m *shared.Message) {
+	parseErr, result := shared.ParseCheckout(m.Value)
+	if parseErr != nil {
+		slog.WarnContext(ctx, "Dropping checkout change that cannot be parsed", shared.LogError, parseErr, "payload", string(m.Value))
+		return
+	}
+	if result.CheckoutID == "" || (result.State != shared.CHECKOUT_STATE_SUCCEEDED && result.State != shared.CHECKOUT_STATE_FAILED) {
+		return
+	}
+	convertErr, orderID := shared.ConvertStringToUUID(result.OrderID)
+	if convertErr != nil {
+		return
+	}
+	resultCtx := shared.WithLogFields(ctx, slog.String(shared.LogOrderID, result.OrderID), slog.String(shared.LogCheckoutID, result.CheckoutID))
+	endErr, _ := orderStore.EndCheckout(resultCtx, orderID, result.CheckoutID)
+	if endErr != nil {
+		slog.ErrorContext(resultCtx, "End checkout error", shared.LogError, endErr)
+	}
 }
 
 // Functions only used by http
@@ -127,14 +193,13 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		ID:        orderID,
 		OrderID:   orderID.String(),
 		Paid:      false,
-		Items:     []string{},
+		Items:     []shared.OrderItem{},
 		UserID:    mongoUserID.String(),
 		TotalCost: 0.0,
 	}
 
-	ordersCollection := getOrdersCollection(orderID)
-	_, mongoInsertErr := ordersCollection.InsertOne(context.Background(), order)
-	if mongoInsertErr != nil {
+	insertErr := orderStore.CreateOrder(r.Context(), &order)
+	if insertErr != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -156,10 +221,12 @@ func removeOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ordersCollection := getOrdersCollection(*documentID)
-	filter := bson.M{"_id": documentID}
-	_, removeDocErr := ordersCollection.DeleteOne(context.Background(), filter)
-	if removeDocErr != nil {
+	clientError, serverError := removeOrder(r.Context(), orderStore, documentID)
+	if serverError != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if clientError != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -175,7 +242,7 @@ func findOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	findOrderErr, order := getOrder(documentID)
+	findOrderErr, order := orderStore.GetOrder(r.Context(), documentID)
 	order.OrderID = orderID
 	if findOrderErr != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -193,55 +260,40 @@ func addItemHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["order_id"]
 	itemID := vars["item_id"]
-	//log.Printf("Adding item %s to order %s", itemID, orderID)
 
 	convertItemIDErr, mongoItemID := shared.ConvertStringToUUID(itemID)
 	if convertItemIDErr != nil {
-		//log.Print(convertItemIDErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	stockURL := fmt.Sprintf("http://stock-service:5000/find/%s", mongoItemID.String())
-	getStockResponse, getStockErr := http.Get(stockURL)
-	//log.Printf("response: %s", getStockResponse.StatusCode)
-	//log.Printf("get stock err: %s", getStockErr)
-	if getStockErr != nil {
-		//log.Print(getStockResponse)
+	convertQuantityErr, quantity := getQuantity(vars)
+	if convertQuantityErr != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	defer getStockResponse.Body.Close()
 
-	var item shared.Item
-	jsonDecodeErr := json.NewDecoder(getStockResponse.Body).Decode(&item)
-	//log.Printf("json body err: %s", item)
-	if jsonDecodeErr != nil {
-		//log.Print(jsonDecodeErr)
+	getItemErr, item := getItem(r.Context(), mongoItemID.String())
+	if getItemErr != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	convertOrderIDErr, mongoOrderID := shared.ConvertStringToUUID(orderID)
 	if convertOrderIDErr != nil {
-		//log.Print(jsonDecodeErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	ordersCollection := getOrdersCollection(*mongoOrderID)
-	orderFilter := bson.M{"_id": mongoOrderID}
-	orderUpdate := bson.M{
-		"$push": bson.M{
-			"items": mongoItemID.String(),
-		},
-		"$inc": bson.M{
-			"totalcost": item.Price,
-		},
+	clientError, serverError := addItem(r.Context(), orderStore, mongoOrderID, item, quantity)
+	if errors.Is(clientError, errOrderNotEditable) {
+		w.WriteHeader(http.StatusConflict)
+		return
 	}
-	result := shared.UpdateRecord(ordersCollection, orderFilter, orderUpdate)
-	if result.Err() != nil {
-		//log.Print(result.Err())
+	if clientError != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if serverError != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -257,105 +309,208 @@ func removeItemHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	convertQuantityErr, quantity := getQuantity(vars)
+	if convertQuantityErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	convertOrderIDErr, mongoOrderID := shared.ConvertStringToUUID(orderID)
+	if convertOrderIDErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	stockURL := fmt.Sprintf("http://stock-service:5000/find/%s", mongoItemID.String())
-	getStockResponse, getStockErr := http.Get(stockURL)
-	if getStockErr != nil {
+	getPrice := func() (error, int64) {
+		getItemErr, item := getItem(r.Context(), mongoItemID.String())
+		if getItemErr != nil {
+			return getItemErr, 0
+		}
+		return nil, item.Price
+	}
+	clientError, serverError := removeItem(r.Context(), orderStore, mongoOrderID, mongoItemID.String(), quantity, getPrice)
+	if errors.Is(clientError, errOrderNotEditable) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if clientError != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if serverError != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// getItem finds the item in the stock service
+func getItem(ctx context.Context, itemID string) (error, *shared.Item) {
+	stockURL := fmt.Sprintf("%s/find/%s", shared.AppConfig.Services.Stock, itemID)
+	getStockRequest, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, stockURL, nil)
+	if requestErr != nil {
+		return requestErr, nil
+	}
+	getStockResponse, getStockErr := shared.HTTPClient.Do(getStockRequest)
+	if getStockErr != nil {
+		return getStockErr, nil
+	}
 	defer getStockResponse.Body.Close()
 
 	var item shared.Item
 	jsonDecodeErr := json.NewDecoder(getStockResponse.Body).Decode(&item)
 	if jsonDecodeErr != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return jsonDecodeErr, nil
 	}
+	return nil, &item
+}
 
-	convertOrderIDErr, mongoOrderID := shared.ConvertStringToUUID(orderID)
-	if convertOrderIDErr != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// getQuantity returns the {quantity} of a request, which defaults to 1
+func getQuantity(vars map[string]string) (error, int64) {
+	if vars["quantity"] == "" {
+		return nil, 1
 	}
-
-	ordersCollection := getOrdersCollection(*mongoOrderID)
-	orderFilter := bson.M{"_id": mongoOrderID}
-	orderUpdate := bson.M{
-		"$pull": bson.M{
-			"items": itemID,
-		},
-		"$inc": bson.M{
-			"totalcost": -item.Price,
-		},
+	convErr, quantity := shared.ConvertStringToInt(vars["quantity"])
+	if convErr != nil {
+		return convErr, 0
 	}
-	result := shared.UpdateRecord(ordersCollection, orderFilter, orderUpdate)
-	if result.Err() != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if *quantity <= 0 {
+		return errors.New("quantity must be positive"), 0
 	}
+	return nil, *quantity
 }
 
 func defaultCheckoutHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("default greeter order")
-	fmt.Printf("Url: %s\n", r.URL.String())
+	slog.DebugContext(r.Context(), "Default handler of order", "url", r.URL.String())
 }
 
 func checkoutHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["order_id"]
 	convertOrderIDErr, mongoOrderID := shared.ConvertStringToUUID(orderID)
-	//log.Println("Starting checkout saga for order", orderID)
 
 	if convertOrderIDErr != nil {
-		log.Println("Convert String to Mongo ID error")
+		slog.InfoContext(r.Context(), "Checkout of invalid order ID")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	getOrderErr, order := getOrder(mongoOrderID)
-	order.OrderID = orderID
+	getOrderErr, order := orderStore.GetOrder(r.Context(), mongoOrderID)
 	if getOrderErr != nil {
-		log.Println("Get order error")
+		slog.InfoContext(r.Context(), "Get order error", shared.LogError, getOrderErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	order.OrderID = orderID
+	if order.Paid || order.Cancelled {
+		slog.InfoContext(r.Context(), "Checkout of paid or cancelled order")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
 
-	sender := shared.CreateTopicSender("order-ack")
-	defer sender.Close()
+	// one checkout saga runs per order at a time. A checkout whose result got
+	// lost is taken over after twice the checkout timeout.
+	checkout := shared.OrderCheckout{
+		CheckoutID: r.URL.Query().Get("checkout_id"),
+		Started:    time.Now().UTC(),
+	}
+	if checkout.CheckoutID == "" {
+		checkout.CheckoutID = shared.GetNewID().String()
+	}
+	staleBefore := checkout.Started.Add(-2 * shared.AppConfig.Timeouts.Checkout)
+	startErr, started := orderStore.StartCheckout(r.Context(), mongoOrderID, checkout, staleBefore)
+	if startErr != nil {
+		slog.ErrorContext(r.Context(), "Start checkout error", shared.LogError, startErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !started {
+		if order.Checkout != nil && order.Checkout.CheckoutID == checkout.CheckoutID {
+			// a retry of the running checkout, its saga was already sent
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// or it got paid or cancelled since it was read
+		slog.InfoContext(r.Context(), "Checkout of order already in progress")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	order.Checkout = &checkout
 
 	message := shared.SagaMessage{
 		Name:   "START-CHECKOUT-SAGA",
 		SagaID: -1,
 		Order:  *order,
 	}
-	//log.Println("Sending message to kafka", message)
 	// message.Order.OrderID = orderID
 
-	sendErr := shared.SendSagaMessage(&message, sender)
+	shared.InjectTraceContext(r.Context(), &message)
+	sendErr := shared.SendSagaMessage(&message, "order-ack")
 	if sendErr != nil {
-		log.Println("Send Kafka SAGA message error")
+		slog.ErrorContext(r.Context(), "Send saga message error", shared.LogError, sendErr)
+		orderStore.EndCheckout(r.Context(), mongoOrderID, checkout.CheckoutID)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// Functions used only by kafka
+func cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID := vars["order_id"]
+	convertOrderIDErr, mongoOrderID := shared.ConvertStringToUUID(orderID)
+	if convertOrderIDErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-func updateOrder(orderID *uuid.UUID, status bool) (clientError error, serverError error) {
-	ordersCollection := getOrdersCollection(*orderID)
-	orderFilter := bson.M{"_id": orderID}
-	orderUpdate := bson.M{
-		"$set": bson.M{
-			"paid": status,
-		},
+	getOrderErr, order := orderStore.GetOrder(r.Context(), mongoOrderID)
+	if getOrderErr != nil {
+		slog.InfoContext(r.Context(), "Get order error", shared.LogError, getOrderErr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	order.OrderID = orderID
+	if order.Checkout != nil {
+		slog.InfoContext(r.Context(), "Cancel of order being checked out")
+		w.WriteHeader(http.StatusConflict)
+		return
 	}
-	result := shared.UpdateRecord(ordersCollection, orderFilter, orderUpdate)
-	if result.Err() != nil {
-		log.Print(result.Err())
-		serverError = result.Err()
+	if !order.Paid || order.Cancelled {
+		slog.InfoContext(r.Context(), "Order is not paid or already cancelled")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// one cancel saga runs per order, like the checkout. Mongo keeps
+	// milliseconds, so the time matches when the cancel is ended again.
+	started := time.Now().UTC().Truncate(time.Millisecond)
+	staleBefore := started.Add(-2 * shared.AppConfig.Timeouts.Checkout)
+	startErr, startedCancel := orderStore.StartCancel(r.Context(), mongoOrderID, started, staleBefore)
+	if startErr != nil {
+		slog.ErrorContext(r.Context(), "Start cancel error", shared.LogError, startErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !startedCancel {
+		// or it got cancelled or checked out since it was read
+		slog.InfoContext(r.Context(), "Cancel of order already in progress")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	order.Cancelling = &started
+
+	message := shared.SagaMessage{
+		Name:   "START-CANCEL-SAGA",
+		SagaID: -1,
+		Order:  *order,
+	}
+
+	shared.InjectTraceContext(r.Context(), &message)
+	sendErr := shared.SendSagaMessage(&message, "order-ack")
+	if sendErr != nil {
+		slog.ErrorContext(r.Context(), "Send saga message error", shared.LogError, sendErr)
+		orderStore.EndCancel(r.Context(), mongoOrderID, started)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	return
 }
@@ -0,0 +1,196 @@
+package order
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// memoryOrderStore keeps the orders in memory, for the local mode and tests
+type memoryOrderStore struct {
+	mu     sync.Mutex
+	orders map[uuid.UUID]*shared.Order
+}
+
+func newMemoryOrderStore() *memoryOrderStore {
+	return &memoryOrderStore{orders: map[uuid.UUID]*shared.Order{}}
+}
+
+// copyOrder returns a copy that can be handed out without holding the lock
+func copyOrder(order *shared.Order) *shared.Order {
+	orderCopy := *order
+	orderCopy.Items = append([]shared.OrderItem{}, order.Items...)
+	if order.PaidItems != nil {
+		orderCopy.PaidItems = append([]shared.OrderItem{}, order.PaidItems...)
+	}
+	if order.Checkout != nil {
+		checkoutCopy := *order.Checkout
+		orderCopy.Checkout = &checkoutCopy
+	}
+	if order.Cancelling != nil {
+		cancelling := *order.Cancelling
+		orderCopy.Cancelling = &cancelling
+	}
+	orderCopy.SagaSteps = append([]string(nil), order.SagaSteps...)
+	return &orderCopy
+}
+
+// getOrderOnce returns the order for a change of the saga step, or nil when
+// the order is missing. applied is true when the step changed the order
+// before, like shared.UpdateOnceForSagaStep. It is called with the lock held.
+func (store *memoryOrderStore) getOrderOnce(orderID *uuid.UUID, stepID string) (order *shared.Order, applied bool) {
+	order, found := store.orders[*orderID]
+	if !found {
+		return nil, false
+	}
+	if stepID == "" {
+		return order, false
+	}
+	if shared.HasSagaStep(order.SagaSteps, stepID) {
+		return order, true
+	}
+	order.SagaSteps = shared.AddSagaStep(order.SagaSteps, stepID)
+	return order, false
+}
+
+func (store *memoryOrderStore) CreateOrder(ctx context.Context, order *shared.Order) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.orders[order.ID] = copyOrder(order)
+	return nil
+}
+
+func (store *memoryOrderStore) GetOrder(ctx context.Context, orderID *uuid.UUID) (error, *shared.Order) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found {
+		return errOrderNotFound, nil
+	}
+	return nil, copyOrder(order)
+}
+
+func (store *memoryOrderStore) RemoveUnpaidOrder(ctx context.Context, orderID *uuid.UUID) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || order.Paid {
+		return nil, false
+	}
+	delete(store.orders, *orderID)
+	return nil, true
+}
+
+func (store *memoryOrderStore) AddToLine(ctx context.Context, orderID *uuid.UUID, line shared.OrderItem) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || !orderEditable(order) {
+		return nil, false
+	}
+
+	order.TotalCost += line.UnitPrice * line.Quantity
+	for i := range order.Items {
+		if order.Items[i].ItemID == line.ItemID {
+			order.Items[i].Quantity += line.Quantity
+			return nil, true
+		}
+	}
+	order.Items = append(order.Items, line)
+	return nil, true
+}
+
+func (store *memoryOrderStore) TakeFromLine(ctx context.Context, orderID *uuid.UUID, itemID string, quantity int64, unitPrice int64) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || !orderEditable(order) {
+		return nil, false
+	}
+
+	for i, line := range order.Items {
+		if line.ItemID != itemID || line.Quantity < quantity {
+			continue
+		}
+		order.TotalCost -= unitPrice * quantity
+		order.Items[i].Quantity -= quantity
+		if order.Items[i].Quantity <= 0 {
+			order.Items = append(order.Items[:i], order.Items[i+1:]...)
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+func (store *memoryOrderStore) SetPaid(ctx context.Context, orderID *uuid.UUID, paidItems shared.OrderItems, stepID string) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, applied := store.getOrderOnce(orderID, stepID)
+	if order == nil || applied {
+		return nil, order != nil
+	}
+	order.Paid = true
+	order.PaidItems = append([]shared.OrderItem{}, paidItems...)
+	return nil, true
+}
+
+func (store *memoryOrderStore) SetCancelled(ctx context.Context, orderID *uuid.UUID, stepID string) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, applied := store.getOrderOnce(orderID, stepID)
+	if order == nil || applied {
+		return nil, order != nil
+	}
+	order.Paid = false
+	order.Cancelled = true
+	order.Cancelling = nil
+	return nil, true
+}
+
+func (store *memoryOrderStore) StartCheckout(ctx context.Context, orderID *uuid.UUID, checkout shared.OrderCheckout, staleBefore time.Time) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || order.Paid || order.Cancelled || (order.Checkout != nil && !order.Checkout.Started.Before(staleBefore)) {
+		return nil, false
+	}
+	order.Checkout = &checkout
+	return nil, true
+}
+
+func (store *memoryOrderStore) EndCheckout(ctx context.Context, orderID *uuid.UUID, checkoutID string) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || order.Checkout == nil || order.Checkout.CheckoutID != checkoutID {
+		return nil, false
+	}
+	order.Checkout = nil
+	return nil, true
+}
+
+func (store *memoryOrderStore) StartCancel(ctx context.Context, orderID *uuid.UUID, started time.Time, staleBefore time.Time) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || !order.Paid || order.Cancelled || order.Checkout != nil || (order.Cancelling != nil && !order.Cancelling.Before(staleBefore)) {
+		return nil, false
+	}
+	order.Cancelling = &started
+	return nil, true
+}
+
+func (store *memoryOrderStore) EndCancel(ctx context.Context, orderID *uuid.UUID, started time.Time) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	order, found := store.orders[*orderID]
+	if !found || order.Cancelling == nil || !order.Cancelling.Equal(started) {
+		return nil, false
+	}
+	order.Cancelling = nil
+	return nil, true
+}
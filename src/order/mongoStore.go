@@ -0,0 +1,293 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"main/shared"
+)
+
+// mongoShards are the collections of the service on its Mongo shards
+type mongoShards struct {
+	clients   []*mongo.Client
+	orders    *shared.ShardedCollection
+	sagaSteps *shared.ShardedCollection
+}
+
+// mongoOrderStore stores the orders on the Mongo shards of the service
+type mongoOrderStore struct {
+	orders *shared.ShardedCollection
+}
+
+func connectMongoShards(ctx context.Context) (error, *mongoShards) {
+	loadErr, shardMap := shared.NewShardMap(&shared.AppConfig.Sharding, "order")
+	if loadErr != nil {
+		return loadErr, nil
+	}
+	connectErr, clients := shared.ConnectShards(ctx, shardMap)
+	if connectErr != nil {
+		return connectErr, nil
+	}
+	return nil, &mongoShards{
+		clients:   clients,
+		orders:    shared.NewShardedCollection(shardMap, clients, "orders", "orders", "_id"),
+		sagaSteps: shared.NewShardedCollection(shardMap, clients, "orders", "saga_steps", "orderid"),
+	}
+}
+
+func (shards *mongoShards) disconnect(ctx context.Context) {
+	for _, client := range shards.clients {
+		client.Disconnect(ctx)
+	}
+}
+
+func (shards *mongoShards) startResharding() {
+	shared.StartResharding(shards.orders, shards.sagaSteps)
+}
+
+func (store *mongoOrderStore) CreateOrder(ctx context.Context, order *shared.Order) error {
+	_, insertErr := store.orders.Get(order.ID).InsertOne(ctx, order)
+	return insertErr
+}
+
+func (store *mongoOrderStore) GetOrder(ctx context.Context, orderID *uuid.UUID) (error, *shared.Order) {
+	ordersCollection := store.orders.Read(*orderID)
+	filter := bson.M{"_id": orderID}
+	var order shared.Order
+	findDocErr := ordersCollection.FindOne(ctx, filter).Decode(&order)
+	if errors.Is(findDocErr, mongo.ErrNoDocuments) {
+		return errOrderNotFound, nil
+	}
+	if findDocErr != nil {
+		return findDocErr, nil
+	}
+	return nil, &order
+}
+
+// updateOrder runs one update on the order and reports whether it matched
+func (store *mongoOrderStore) updateOrder(ctx context.Context, orderID *uuid.UUID, filter bson.M, update bson.M) (error, bool) {
+	moveErr, ordersCollection := store.orders.Write(*orderID)
+	if moveErr != nil {
+		return moveErr, false
+	}
+	result, updateErr := ordersCollection.UpdateOne(ctx, filter, update)
+	if updateErr != nil {
+		slog.ErrorContext(ctx, "Update order error", shared.LogError, updateErr)
+		return updateErr, false
+	}
+	return nil, result.MatchedCount > 0
+}
+
+func (store *mongoOrderStore) RemoveUnpaidOrder(ctx context.Context, orderID *uuid.UUID) (error, bool) {
+	moveErr, ordersCollection := store.orders.Write(*orderID)
+	if moveErr != nil {
+		return moveErr, false
+	}
+	filter := bson.M{"_id": orderID, "paid": bson.M{"$ne": true}}
+	removeResult, removeDocErr := ordersCollection.DeleteOne(ctx, filter)
+	if removeDocErr != nil {
+		return removeDocErr, false
+	}
+	return nil, removeResult.DeletedCount > 0
+}
+
+// editableFilter matches the order while its items may change, see
+// orderEditable
+func editableFilter(orderID *uuid.UUID) bson.M {
+	return bson.M{
+		"_id":       orderID,
+		"paid":      bson.M{"$ne": true},
+		"cancelled": bson.M{"$ne": true},
+		"checkout":  nil,
+	}
+}
+
+// convertLegacyItems stores the items of an order from before line items, one
+// item ID per unit, as line items, so the line updates match them. Like the
+// documents of resharding, orders are converted before they are written.
+func (store *mongoOrderStore) convertLegacyItems(ctx context.Context, orderID *uuid.UUID) error {
+	moveErr, ordersCollection := store.orders.Write(*orderID)
+	if moveErr != nil {
+		return moveErr
+	}
+	legacyFilter := bson.M{"_id": orderID, "items": bson.M{"$type": "string"}}
+	var order shared.Order
+	findErr := ordersCollection.FindOne(ctx, legacyFilter).Decode(&order)
+	if errors.Is(findErr, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if findErr != nil {
+		return findErr
+	}
+	// does not match when a concurrent conversion stored the lines first
+	_, updateErr := ordersCollection.UpdateOne(ctx, legacyFilter, bson.M{"$set": bson.M{"items": order.Items}})
+	return updateErr
+}
+
+func (store *mongoOrderStore) AddToLine(ctx context.Context, orderID *uuid.UUID, line shared.OrderItem) (error, bool) {
+	convertErr := store.convertLegacyItems(ctx, orderID)
+	if convertErr != nil {
+		return convertErr, false
+	}
+	// a concurrent add may create the line in between, then increment it
+	for attempt := 0; attempt < 2; attempt++ {
+		lineFilter := editableFilter(orderID)
+		lineFilter["items.itemid"] = line.ItemID
+		lineUpdate := bson.M{
+			"$inc": bson.M{
+				"items.$.quantity": line.Quantity,
+				"totalcost":        line.UnitPrice * line.Quantity,
+			},
+		}
+		updateErr, matched := store.updateOrder(ctx, orderID, lineFilter, lineUpdate)
+		if updateErr != nil || matched {
+			return updateErr, matched
+		}
+
+		orderFilter := editableFilter(orderID)
+		orderFilter["items.itemid"] = bson.M{"$ne": line.ItemID}
+		orderUpdate := bson.M{
+			"$push": bson.M{
+				"items": line,
+			},
+			"$inc": bson.M{
+				"totalcost": line.UnitPrice * line.Quantity,
+			},
+		}
+		updateErr, matched = store.updateOrder(ctx, orderID, orderFilter, orderUpdate)
+		if updateErr != nil || matched {
+			return updateErr, matched
+		}
+	}
+	return nil, false
+}
+
+func (store *mongoOrderStore) TakeFromLine(ctx context.Context, orderID *uuid.UUID, itemID string, quantity int64, unitPrice int64) (error, bool) {
+	convertErr := store.convertLegacyItems(ctx, orderID)
+	if convertErr != nil {
+		return convertErr, false
+	}
+	lineFilter := editableFilter(orderID)
+	lineFilter["items"] = bson.M{
+		"$elemMatch": bson.M{"itemid": itemID, "quantity": bson.M{"$gte": quantity}},
+	}
+	lineUpdate := bson.M{
+		"$inc": bson.M{
+			"items.$.quantity": -quantity,
+			"totalcost":        -unitPrice * quantity,
+		},
+	}
+	updateErr, matched := store.updateOrder(ctx, orderID, lineFilter, lineUpdate)
+	if updateErr != nil || !matched {
+		return updateErr, matched
+	}
+
+	emptyLines := bson.M{
+		"$pull": bson.M{
+			"items": bson.M{"quantity": bson.M{"$lte": 0}},
+		},
+	}
+	updateErr, _ = store.updateOrder(ctx, orderID, bson.M{"_id": orderID}, emptyLines)
+	return updateErr, true
+}
+
+// updateOrderOnce runs one update on the order once for the saga step and
+// reports whether it matched
+func (store *mongoOrderStore) updateOrderOnce(ctx context.Context, orderID *uuid.UUID, update bson.M, stepID string) (error, bool) {
+	moveErr, ordersCollection := store.orders.Write(*orderID)
+	if moveErr != nil {
+		return moveErr, false
+	}
+	updateErr, matched := shared.UpdateOnceForSagaStep(ctx, ordersCollection, orderID, bson.M{"_id": orderID}, update, stepID)
+	if updateErr != nil {
+		slog.ErrorContext(ctx, "Update order error", shared.LogError, updateErr)
+		return updateErr, false
+	}
+	return nil, matched
+}
+
+func (store *mongoOrderStore) SetPaid(ctx context.Context, orderID *uuid.UUID, paidItems shared.OrderItems, stepID string) (error, bool) {
+	orderUpdate := bson.M{
+		"$set": bson.M{
+			"paid":       true,
+			"paid_items": paidItems,
+		},
+	}
+	return store.updateOrderOnce(ctx, orderID, orderUpdate, stepID)
+}
+
+func (store *mongoOrderStore) StartCheckout(ctx context.Context, orderID *uuid.UUID, checkout shared.OrderCheckout, staleBefore time.Time) (error, bool) {
+	filter := bson.M{
+		"_id":       orderID,
+		"paid":      bson.M{"$ne": true},
+		"cancelled": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"checkout": nil},
+			bson.M{"checkout.started": bson.M{"$lt": staleBefore}},
+		},
+	}
+	orderUpdate := bson.M{
+		"$set": bson.M{
+			"checkout": checkout,
+		},
+	}
+	return store.updateOrder(ctx, orderID, filter, orderUpdate)
+}
+
+func (store *mongoOrderStore) EndCheckout(ctx context.Context, orderID *uuid.UUID, checkoutID string) (error, bool) {
+	filter := bson.M{"_id": orderID, "checkout.checkoutid": checkoutID}
+	orderUpdate := bson.M{
+		"$unset": bson.M{
+			"checkout": "",
+		},
+	}
+	return store.updateOrder(ctx, orderID, filter, orderUpdate)
+}
+
+func (store *mongoOrderStore) SetCancelled(ctx context.Context, orderID *uuid.UUID, stepID string) (error, bool) {
+	orderUpdate := bson.M{
+		"$set": bson.M{
+			"paid":      false,
+			"cancelled": true,
+		},
+		"$unset": bson.M{
+			"cancelling": "",
+		},
+	}
+	return store.updateOrderOnce(ctx, orderID, orderUpdate, stepID)
+}
+
+func (store *mongoOrderStore) StartCancel(ctx context.Context, orderID *uuid.UUID, started time.Time, staleBefore time.Time) (error, bool) {
+	filter := bson.M{
+		"_id":       orderID,
+		"paid":      true,
+		"cancelled": bson.M{"$ne": true},
+		"checkout":  nil,
+		"$or": bson.A{
+			bson.M{"cancelling": nil},
+			bson.M{"cancelling": bson.M{"$lt": staleBefore}},
+		},
+	}
+	orderUpdate := bson.M{
+		"$set": bson.M{
+			"cancelling": started,
+		},
+	}
+	return store.updateOrder(ctx, orderID, filter, orderUpdate)
+}
+
+func (store *mongoOrderStore) EndCancel(ctx context.Context, orderID *uuid.UUID, started time.Time) (error, bool) {
+	filter := bson.M{"_id": orderID, "cancelling": started}
+	orderUpdate := bson.M{
+		"$unset": bson.M{
+			"cancelling": "",
+		},
+	}
+	return store.updateOrder(ctx, orderID, filter, orderUpdate)
+}
@@ -0,0 +1,155 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// The order functions take the store, so they run the same on Mongo and in
+// memory.
+
+var errNotEnoughInOrder = errors.New("not enough of the item in order")
+
+// removeOrder removes an order that is not paid, paid orders have to be
+// cancelled first, otherwise the payment is lost.
+func removeOrder(ctx context.Context, orders OrderStore, orderID *uuid.UUID) (clientError error, serverError error) {
+	removeErr, removed := orders.RemoveUnpaidOrder(ctx, orderID)
+	if removeErr != nil {
+		serverError = removeErr
+		return
+	}
+	if !removed {
+		clientError = fmt.Errorf("order %s not found or paid", orderID)
+	}
+	return
+}
+
+// orderEditable reports whether the items of the order may change. A checkout
+// charges the total cost the order has when it starts.
+func orderEditable(order *shared.Order) bool {
+	return !order.Paid && !order.Cancelled && order.Checkout == nil
+}
+
+// lineNotChangedError returns why the items of an order did not change when
+// the order is missing or not editable, or otherwise notChanged
+func lineNotChangedError(ctx context.Context, orders OrderStore, orderID *uuid.UUID, notChanged error) (clientError error, serverError error) {
+	getOrderErr, order := orders.GetOrder(ctx, orderID)
+	if errors.Is(getOrderErr, errOrderNotFound) {
+		clientError = errOrderNotFound
+		return
+	}
+	if getOrderErr != nil {
+		serverError = getOrderErr
+		return
+	}
+	if !orderEditable(order) {
+		clientError = errOrderNotEditable
+		return
+	}
+	clientError = notChanged
+	return
+}
+
+// addItem adds quantity of the item to its line in the order, at the current
+// price of the item.
+func addItem(ctx context.Context, orders OrderStore, orderID *uuid.UUID, item *shared.Item, quantity int64) (clientError error, serverError error) {
+	if quantity <= 0 {
+		clientError = errors.New("quantity must be positive")
+		return
+	}
+	line := shared.OrderItem{
+		ItemID:    item.ID.String(),
+		Quantity:  quantity,
+		UnitPrice: item.Price,
+	}
+	addErr, added := orders.AddToLine(ctx, orderID, line)
+	if addErr != nil {
+		serverError = addErr
+		return
+	}
+	if !added {
+		return lineNotChangedError(ctx, orders, orderID, errOrderNotFound)
+	}
+	return
+}
+
+// removeItem takes quantity of the item off the order, at the price it was
+// added for. The order must contain at least quantity of the item. Lines of
+// orders from before line items have no unit price, they take the price of
+// the item from getPrice, which has not changed since.
+func removeItem(ctx context.Context, orders OrderStore, orderID *uuid.UUID, itemID string, quantity int64, getPrice func() (error, int64)) (clientError error, serverError error) {
+	getOrderErr, order := orders.GetOrder(ctx, orderID)
+	if getOrderErr != nil {
+		clientError = getOrderErr
+		return
+	}
+	if !orderEditable(order) {
+		clientError = errOrderNotEditable
+		return
+	}
+	var line *shared.OrderItem
+	for i := range order.Items {
+		if order.Items[i].ItemID == itemID {
+			line = &order.Items[i]
+		}
+	}
+	if line == nil {
+		clientError = errors.New("item not in order")
+		return
+	}
+	if line.Quantity < quantity {
+		clientError = errNotEnoughInOrder
+		return
+	}
+	unitPrice := line.UnitPrice
+	if unitPrice == 0 {
+		priceErr, price := getPrice()
+		if priceErr != nil {
+			clientError = priceErr
+			return
+		}
+		unitPrice = price
+	}
+
+	// the line or the order may have changed since it was read
+	takeErr, taken := orders.TakeFromLine(ctx, orderID, itemID, quantity, unitPrice)
+	if takeErr != nil {
+		serverError = takeErr
+		return
+	}
+	if !taken {
+		return lineNotChangedError(ctx, orders, orderID, errNotEnoughInOrder)
+	}
+	return
+}
+
+// updateOrder marks the order paid for paidItems, the items the checkout
+// subtracted from the stock, once for the saga step stepID
+func updateOrder(ctx context.Context, orders OrderStore, orderID *uuid.UUID, paidItems shared.OrderItems, stepID string) (clientError error, serverError error) {
+	updateErr, found := orders.SetPaid(ctx, orderID, paidItems, stepID)
+	if updateErr != nil {
+		serverError = updateErr
+		return
+	}
+	if !found {
+		clientError = errOrderNotFound
+	}
+	return
+}
+
+func cancelOrder(ctx context.Context, orders OrderStore, orderID *uuid.UUID, stepID string) (clientError error, serverError error) {
+	cancelErr, found := orders.SetCancelled(ctx, orderID, stepID)
+	if cancelErr != nil {
+		serverError = cancelErr
+		return
+	}
+	if !found {
+		clientError = errOrderNotFound
+	}
+	return
+}
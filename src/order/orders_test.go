@@ -0,0 +1,328 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// createTestOrder stores the order under a new ID and returns the ID
+func createTestOrder(t *testing.T, orders OrderStore, order shared.Order) *uuid.UUID {
+	t.Helper()
+	order.ID = shared.GetNewID()
+	order.OrderID = order.ID.String()
+	createErr := orders.CreateOrder(context.Background(), &order)
+	if createErr != nil {
+		t.Fatalf("create order: %v", createErr)
+	}
+	return &order.ID
+}
+
+func getTestOrder(t *testing.T, orders OrderStore, orderID *uuid.UUID) *shared.Order {
+	t.Helper()
+	getErr, order := orders.GetOrder(context.Background(), orderID)
+	if getErr != nil {
+		t.Fatalf("get order: %v", getErr)
+	}
+	return order
+}
+
+func TestUpdateOrder(t *testing.T) {
+	lines := shared.OrderItems{{ItemID: "a", Quantity: 2, UnitPrice: 10}}
+
+	tests := []struct {
+		name            string
+		order           shared.Order
+		unknownOrder    bool
+		paidItems       shared.OrderItems
+		wantClientError error
+	}{
+		{
+			name:      "unpaid order",
+			order:     shared.Order{Items: lines, TotalCost: 20},
+			paidItems: lines,
+		},
+		{
+			name:      "order being checked out",
+			order:     shared.Order{Items: lines, TotalCost: 20, Checkout: &shared.OrderCheckout{CheckoutID: "c"}},
+			paidItems: lines,
+		},
+		{
+			name:            "unknown order",
+			unknownOrder:    true,
+			paidItems:       lines,
+			wantClientError: errOrderNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orders := newMemoryOrderStore()
+			orderID := createTestOrder(t, orders, test.order)
+			updatedID := orderID
+			if test.unknownOrder {
+				unknownID := shared.GetNewID()
+				updatedID = &unknownID
+			}
+
+			clientError, serverError := updateOrder(context.Background(), orders, updatedID, test.paidItems, "")
+			if serverError != nil {
+				t.Fatalf("server error: %v", serverError)
+			}
+			if !errors.Is(clientError, test.wantClientError) {
+				t.Fatalf("client error %v, want %v", clientError, test.wantClientError)
+			}
+			order := getTestOrder(t, orders, orderID)
+			if test.wantClientError != nil {
+				if order.Paid {
+					t.Errorf("order %s was paid", orderID)
+				}
+				return
+			}
+			if !order.Paid || len(order.PaidItems) != len(test.paidItems) || order.PaidItems[0] != test.paidItems[0] {
+				t.Errorf("order is paid %v for %v, want paid for %v", order.Paid, order.PaidItems, test.paidItems)
+			}
+		})
+	}
+}
+
+// TestUpdateOrderAgain runs the UPDATE-ORDER step again after the order was
+// cancelled, as after a takeover of the step, the order stays cancelled
+func TestUpdateOrderAgain(t *testing.T) {
+	lines := shared.OrderItems{{ItemID: shared.GetNewID().String(), Quantity: 2, UnitPrice: 10}}
+	orders := newMemoryOrderStore()
+	orderID := createTestOrder(t, orders, shared.Order{Items: lines, TotalCost: 20})
+
+	steps := []func() (error, error){
+		func() (error, error) {
+			return updateOrder(context.Background(), orders, orderID, lines, "1_START-UPDATE-ORDER")
+		},
+		func() (error, error) {
+			return cancelOrder(context.Background(), orders, orderID, "2_START-CANCEL-ORDER")
+		},
+		func() (error, error) {
+			return updateOrder(context.Background(), orders, orderID, lines, "1_START-UPDATE-ORDER")
+		},
+	}
+	for i, step := range steps {
+		clientError, serverError := step()
+		if clientError != nil || serverError != nil {
+			t.Fatalf("step %d: %v %v", i, clientError, serverError)
+		}
+	}
+
+	order := getTestOrder(t, orders, orderID)
+	if order.Paid || !order.Cancelled {
+		t.Errorf("order is paid %v and cancelled %v, want cancelled", order.Paid, order.Cancelled)
+	}
+}
+
+func TestStartCancel(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	staleBefore := now.Add(-time.Minute)
+	running := now.Add(-time.Second)
+	stale := now.Add(-2 * time.Minute)
+
+	tests := []struct {
+		name        string
+		order       shared.Order
+		wantStarted bool
+	}{
+		{name: "paid order", order: shared.Order{Paid: true}, wantStarted: true},
+		{name: "unpaid order", order: shared.Order{}},
+		{name: "cancelled order", order: shared.Order{Cancelled: true}},
+		{name: "order being checked out", order: shared.Order{Paid: true, Checkout: &shared.OrderCheckout{CheckoutID: "c"}}},
+		{name: "cancel running", order: shared.Order{Paid: true, Cancelling: &running}},
+		{name: "stale cancel", order: shared.Order{Paid: true, Cancelling: &stale}, wantStarted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orders := newMemoryOrderStore()
+			orderID := createTestOrder(t, orders, test.order)
+
+			startErr, started := orders.StartCancel(context.Background(), orderID, now, staleBefore)
+			if startErr != nil {
+				t.Fatalf("start cancel: %v", startErr)
+			}
+			if started != test.wantStarted {
+				t.Fatalf("cancel started %v, want %v", started, test.wantStarted)
+			}
+			if !started {
+				return
+			}
+			// a second cancel does not start while the first runs
+			_, startedAgain := orders.StartCancel(context.Background(), orderID, now.Add(time.Millisecond), staleBefore)
+			if startedAgain {
+				t.Fatalf("second cancel started while the first runs")
+			}
+
+			clientError, serverError := cancelOrder(context.Background(), orders, orderID, "1_START-CANCEL-ORDER")
+			if clientError != nil || serverError != nil {
+				t.Fatalf("cancel order: %v %v", clientError, serverError)
+			}
+			order := getTestOrder(t, orders, orderID)
+			if !order.Cancelled || order.Cancelling != nil {
+				t.Errorf("order is cancelled %v with cancel %v, want cancelled and the cancel ended", order.Cancelled, order.Cancelling)
+			}
+		})
+	}
+}
+
+func TestAddItem(t *testing.T) {
+	item := shared.Item{ID: shared.GetNewID(), Price: 10}
+	otherItem := shared.Item{ID: shared.GetNewID(), Price: 5}
+
+	tests := []struct {
+		name            string
+		order           shared.Order
+		quantity        int64
+		wantItems       shared.OrderItems
+		wantTotalCost   int64
+		wantClientError error
+	}{
+		{
+			name:          "new line",
+			order:         shared.Order{Items: shared.OrderItems{}},
+			quantity:      2,
+			wantItems:     shared.OrderItems{{ItemID: item.ID.String(), Quantity: 2, UnitPrice: 10}},
+			wantTotalCost: 20,
+		},
+		{
+			name: "existing line",
+			order: shared.Order{
+				Items:     shared.OrderItems{{ItemID: otherItem.ID.String(), Quantity: 1, UnitPrice: 5}, {ItemID: item.ID.String(), Quantity: 1, UnitPrice: 10}},
+				TotalCost: 15,
+			},
+			quantity:      3,
+			wantItems:     shared.OrderItems{{ItemID: otherItem.ID.String(), Quantity: 1, UnitPrice: 5}, {ItemID: item.ID.String(), Quantity: 4, UnitPrice: 10}},
+			wantTotalCost: 45,
+		},
+		{
+			name:            "paid order",
+			order:           shared.Order{Items: shared.OrderItems{}, Paid: true},
+			quantity:        1,
+			wantItems:       shared.OrderItems{},
+			wantClientError: errOrderNotEditable,
+		},
+		{
+			name:            "order being checked out",
+			order:           shared.Order{Items: shared.OrderItems{}, Checkout: &shared.OrderCheckout{CheckoutID: "c", Started: time.Now()}},
+			quantity:        1,
+			wantItems:       shared.OrderItems{},
+			wantClientError: errOrderNotEditable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orders := newMemoryOrderStore()
+			orderID := createTestOrder(t, orders, test.order)
+
+			clientError, serverError := addItem(context.Background(), orders, orderID, &item, test.quantity)
+			if serverError != nil {
+				t.Fatalf("server error: %v", serverError)
+			}
+			if !errors.Is(clientError, test.wantClientError) {
+				t.Fatalf("client error %v, want %v", clientError, test.wantClientError)
+			}
+			order := getTestOrder(t, orders, orderID)
+			if len(order.Items) != len(test.wantItems) {
+				t.Fatalf("items are %v, want %v", order.Items, test.wantItems)
+			}
+			for i := range order.Items {
+				if order.Items[i] != test.wantItems[i] {
+					t.Errorf("line %d is %v, want %v", i, order.Items[i], test.wantItems[i])
+				}
+			}
+			if order.TotalCost != test.wantTotalCost {
+				t.Errorf("total cost is %d, want %d", order.TotalCost, test.wantTotalCost)
+			}
+		})
+	}
+}
+
+func TestRemoveItem(t *testing.T) {
+	currentPrice := func() (error, int64) {
+		return nil, 7
+	}
+
+	tests := []struct {
+		name            string
+		order           shared.Order
+		quantity        int64
+		wantItems       shared.OrderItems
+		wantTotalCost   int64
+		wantClientError error
+	}{
+		{
+			name:          "part of a line",
+			order:         shared.Order{Items: shared.OrderItems{{ItemID: "a", Quantity: 3, UnitPrice: 10}}, TotalCost: 30},
+			quantity:      2,
+			wantItems:     shared.OrderItems{{ItemID: "a", Quantity: 1, UnitPrice: 10}},
+			wantTotalCost: 10,
+		},
+		{
+			name:          "whole line",
+			order:         shared.Order{Items: shared.OrderItems{{ItemID: "a", Quantity: 3, UnitPrice: 10}}, TotalCost: 30},
+			quantity:      3,
+			wantItems:     shared.OrderItems{},
+			wantTotalCost: 0,
+		},
+		{
+			name:          "line of an order from before line items",
+			order:         shared.Order{Items: shared.OrderItems{{ItemID: "a", Quantity: 2}}, TotalCost: 14},
+			quantity:      1,
+			wantItems:     shared.OrderItems{{ItemID: "a", Quantity: 1}},
+			wantTotalCost: 7,
+		},
+		{
+			name:            "more than the line holds",
+			order:           shared.Order{Items: shared.OrderItems{{ItemID: "a", Quantity: 1, UnitPrice: 10}}, TotalCost: 10},
+			quantity:        2,
+			wantItems:       shared.OrderItems{{ItemID: "a", Quantity: 1, UnitPrice: 10}},
+			wantTotalCost:   10,
+			wantClientError: errNotEnoughInOrder,
+		},
+		{
+			name:            "cancelled order",
+			order:           shared.Order{Items: shared.OrderItems{{ItemID: "a", Quantity: 1, UnitPrice: 10}}, TotalCost: 10, Cancelled: true},
+			quantity:        1,
+			wantItems:       shared.OrderItems{{ItemID: "a", Quantity: 1, UnitPrice: 10}},
+			wantTotalCost:   10,
+			wantClientError: errOrderNotEditable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orders := newMemoryOrderStore()
+			orderID := createTestOrder(t, orders, test.order)
+
+			clientError, serverError := removeItem(context.Background(), orders, orderID, "a", test.quantity, currentPrice)
+			if serverError != nil {
+				t.Fatalf("server error: %v", serverError)
+			}
+			if !errors.Is(clientError, test.wantClientError) {
+				t.Fatalf("client error %v, want %v", clientError, test.wantClientError)
+			}
+			order := getTestOrder(t, orders, orderID)
+			if len(order.Items) != len(test.wantItems) {
+				t.Fatalf("items are %v, want %v", order.Items, test.wantItems)
+			}
+			for i := range order.Items {
+				if order.Items[i] != test.wantItems[i] {
+					t.Errorf("line %d is %v, want %v", i, order.Items[i], test.wantItems[i])
+				}
+			}
+			if order.TotalCost != test.wantTotalCost {
+				t.Errorf("total cost is %d, want %d", order.TotalCost, test.wantTotalCost)
+			}
+		})
+	}
+}
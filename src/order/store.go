@@ -0,0 +1,52 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+var errOrderNotFound = errors.New("order not found")
+var errOrderNotEditable = errors.New("order is paid, cancelled or being checked out")
+
+// OrderStore stores the orders of the service, on the Mongo shards or in
+// memory in local mode. Every function is atomic on its order. The bool
+// results report whether the order matched, a missing order is no error.
+//
+// The changes of saga steps carry the ID of the step, stepID, and are applied
+// at most once, see shared.UpdateOnceForSagaStep.
+type OrderStore interface {
+	CreateOrder(ctx context.Context, order *shared.Order) error
+	// GetOrder returns errOrderNotFound for a missing order
+	GetOrder(ctx context.Context, orderID *uuid.UUID) (error, *shared.Order)
+	// RemoveUnpaidOrder removes the order unless it is paid
+	RemoveUnpaidOrder(ctx context.Context, orderID *uuid.UUID) (error, bool)
+	// AddToLine adds the quantity of line to the line of its item and the
+	// total cost, or adds line when the order does not contain the item. It
+	// does not match an order that is paid, cancelled or being checked out.
+	AddToLine(ctx context.Context, orderID *uuid.UUID, line shared.OrderItem) (error, bool)
+	// TakeFromLine takes quantity off the line of the item and the total cost
+	// and drops the line when it reaches zero. It does not match when the line
+	// holds less than quantity, or when AddToLine would not.
+	TakeFromLine(ctx context.Context, orderID *uuid.UUID, itemID string, quantity int64, unitPrice int64) (error, bool)
+	// SetPaid marks the order paid and keeps paidItems as its paid items
+	SetPaid(ctx context.Context, orderID *uuid.UUID, paidItems shared.OrderItems, stepID string) (error, bool)
+	// SetCancelled marks the order cancelled and not paid and ends its cancel
+	SetCancelled(ctx context.Context, orderID *uuid.UUID, stepID string) (error, bool)
+	// StartCheckout marks the checkout in progress on the order. It does not
+	// match a paid or cancelled order, or while another checkout that started
+	// after staleBefore is.
+	StartCheckout(ctx context.Context, orderID *uuid.UUID, checkout shared.OrderCheckout, staleBefore time.Time) (error, bool)
+	// EndCheckout clears the checkout of the order if it is checkoutID
+	EndCheckout(ctx context.Context, orderID *uuid.UUID, checkoutID string) (error, bool)
+	// StartCancel marks the cancel saga of the paid order started. It does not
+	// match an order that is not paid, cancelled or being checked out, or while
+	// another cancel that started after staleBefore is.
+	StartCancel(ctx context.Context, orderID *uuid.UUID, started time.Time, staleBefore time.Time) (error, bool)
+	// EndCancel clears the cancel of the order if it started at started
+	EndCancel(ctx context.Context, orderID *uuid.UUID, started time.Time) (error, bool)
+}
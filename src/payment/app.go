@@ -1,20 +1,17 @@
-package main
+package payment
 
 import (
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"main/shared"
 )
@@ -27,145 +24,135 @@ type PaidResponse struct {
 	Paid bool `json:"paid"`
 }
 
-var clients [5]*mongo.Client
-var userCollections [5]*mongo.Collection
-var paymentCollections [5]*mongo.Collection
+var userStore UserStore
+var paymentStore PaymentStore
+var transactions UserTransactions
 
-// var client *mongo.Client
-// var userCollection *mongo.Collection
-// var paymentCollection *mongo.Collection
-
-func main() {
-	go shared.SetUpKafkaListener(
-		[]string{"payment"}, false,
-		func(message *shared.SagaMessage) (*shared.SagaMessage, string) {
-			returnMessage := shared.SagaMessageConvertStartToEnd(message)
-
-			// TODO: remove code duplication
-
-			if message.Name == "START-MAKE-PAYMENT" {
-				// ignore error, wil not happen
-				_, mongoUserID := shared.ConvertStringToUUID(message.Order.UserID)
-				_, mongoOrderID := shared.ConvertStringToUUID(message.Order.OrderID)
-
-				clientError, serverError := pay(mongoUserID, mongoOrderID, &message.Order.TotalCost)
-				if clientError != nil || serverError != nil {
-					log.Print(clientError, serverError)
-					returnMessage.Name = "ABORT-CHECKOUT-SAGA"
-				}
-				return returnMessage, "payment-ack"
-			}
-
-			if message.Name == "START-CANCEL-PAYMENT" {
-				// ignore error, wil not happen
-				_, mongoUserID := shared.ConvertStringToUUID(message.Order.UserID)
-				_, mongoOrderID := shared.ConvertStringToUUID(message.Order.OrderID)
-
-				clientError, serverError := cancelPayment(mongoUserID, mongoOrderID)
-				if clientError != nil || serverError != nil {
-					returnMessage.Name = "ABORT-CHECKOUT-SAGA"
-				}
-
-				return returnMessage, "payment-ack"
-			}
-
-			return nil, ""
-		},
-	)
+// Run serves the payment service on its Mongo shards and Kafka.
+func Run() {
+	shared.ServiceName = "payment"
+	defer shared.SetUpTracing("payment")()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	setupErr := setupDBConnections(ctx)
+	setupErr, shards := connectMongoShards(ctx)
 	if setupErr != nil {
-		log.Fatal(setupErr)
-	}
-	for i := 0; i < 5; i++ {
-		defer clients[i].Disconnect(ctx)
+		shared.Fatal("Connect to the Mongo shards error", shared.LogError, setupErr)
 	}
+	defer shards.disconnect(ctx)
+	userStore = mongoUserStore{shards: shards}
+	paymentStore = mongoPaymentStore{shards: shards}
+	transactions = mongoUserTransactions{shards: shards}
+	shards.startResharding()
+	shards.startOutboxRelay()
 
-	router := mux.NewRouter()
-	router.HandleFunc("/pay/{user_id}/{order_id}/{amount}", payHandler)
-	router.HandleFunc("/cancel/{user_id}/{order_id}", cancelPaymentHandler)
-	router.HandleFunc("/status/{user_id}/{order_id}", paymentStatusHandler)
-	router.HandleFunc("/add_funds/{user_id}/{amount}", addFundsHandler)
-	router.HandleFunc("/create_user", createUserHandler)
-	router.HandleFunc("/find_user/{user_id}", findUserHandler)
-	router.HandleFunc("/", greetingHandler)
+	go setUpSagaListener()
 
 	port := os.Getenv("PORT")
-	fmt.Printf("Current port is : %s\n", port)
 	if port == "" {
 		port = "8081"
 	}
 
 	// Set the listening address and port for the server
 	addr := fmt.Sprintf(":%s", port)
-	fmt.Printf("Starting payment service at %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, router))
+	slog.Info("Starting payment service", "addr", addr)
+	serveErr := http.ListenAndServe(addr, NewRouter())
+	shared.Fatal("Serve error", shared.LogError, serveErr)
 }
 
-func setupDBConnections(ctx context.Context) error {
-	for i := 0; i < 5; i++ {
-		mongoURL := fmt.Sprintf("mongodb://paymentdb-service-%d:27017", i)
-		fmt.Printf("%d MongoDB URL: %s\n", i, mongoURL)
-		var err error
-		var client *mongo.Client
-		client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
-
-		if err != nil {
-			return err
-		}
-		clients[i] = client
-		userCollections[i] = client.Database("payment").Collection("users")
-		paymentCollections[i] = client.Database("payment").Collection("payments")
-	}
-	return nil
+// StartLocal starts the payment service on in-memory stores and returns its
+// routes, for the local mode.
+func StartLocal() http.Handler {
+	memory := newMemoryStore()
+	userStore = memoryUserStore{memory: memory}
+	paymentStore = memoryPaymentStore{memory: memory}
+	transactions = memoryUserTransactions{memory: memory}
+	go setUpSagaListener()
+	return NewRouter()
 }
 
-func greetingHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("URL Path:", r.URL.Path)
-
-	// You can also print the full URL if the request included it
-	if r.URL.RawQuery != "" {
-		fmt.Println("Full URL:", r.URL.String())
-	}
-	log.Print("Hello welcome to paymnt!!")
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+	shared.InstrumentRouter(router, "payment")
+	router.HandleFunc("/pay/{user_id}/{order_id}/{amount}", payHandler)
+	router.HandleFunc("/cancel/{user_id}/{order_id}", cancelPaymentHandler)
+	router.HandleFunc("/status/{user_id}/{order_id}", paymentStatusHandler)
+	router.HandleFunc("/add_funds/{user_id}/{amount}", addFundsHandler)
+	router.HandleFunc("/create_user", createUserHandler)
+	router.HandleFunc("/find_user/{user_id}", findUserHandler)
+	router.HandleFunc("/", greetingHandler)
+	return router
 }
 
-func getUser(documentID *uuid.UUID) (error, *shared.User) {
-	userCollection := getUserCollection(documentID)
+func setUpSagaListener() {
+	shared.SetUpSagaListener(
+		[]string{"payment"}, false,
+		func(ctx context.Context, message *shared.SagaMessage) (error, *shared.SagaMessage, string) {
+			// ignore error, wil not happen
+			_, mongoUserID := shared.ConvertStringToUUID(message.Order.UserID)
+			_, mongoOrderID := shared.ConvertStringToUUID(message.Order.OrderID)
 
-	var user shared.User
-	err := userCollection.FindOne(context.Background(), bson.M{"_id": documentID}).Decode(&user)
-	if err != nil {
-		return err, nil
-	}
-	user.ID = *documentID
-	user.UserID = documentID.String()
-	return nil, &user
-}
+			// TODO: remove code duplication
 
-func getPayment(userID *uuid.UUID, orderID *uuid.UUID) (error, *shared.Payment) {
-	paymentCollection := getPaymentCollection(userID, orderID)
+			// replies are stored with the payment and sent afterwards, a
+			// server error rolls the step back and is tried again
+			if message.Name == "START-MAKE-PAYMENT" {
+				return transactions.RunSagaStep(ctx, mongoUserID, message, func(ctx context.Context, users UserStore, payments PaymentStore) (error, *shared.SagaMessage) {
+					returnMessage := shared.SagaMessageConvertStartToEnd(message)
+					clientError, serverError := pay(ctx, users, payments, mongoUserID, mongoOrderID, &message.Order.TotalCost)
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						slog.InfoContext(ctx, "Payment refused", shared.LogError, clientError)
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				}), nil, ""
+			}
 
-	filter := bson.M{"userid": userID, "orderid": orderID}
-	var payment shared.Payment
-	findErr := paymentCollection.FindOne(context.Background(), filter).Decode(&payment)
-	if findErr != nil {
-		return findErr, nil
-	}
-	return nil, &payment
-}
+			if message.Name == "START-CANCEL-PAYMENT" && !message.Order.Paid {
+				// the rollback of a checkout, which compensates a MAKE-PAYMENT
+				// that timed out as well, it may never have run
+				return transactions.RunSagaCompensation(ctx, mongoUserID, message, "START-MAKE-PAYMENT", func(ctx context.Context, users UserStore, payments PaymentStore, stepReply string) (error, *shared.SagaMessage) {
+					returnMessage := shared.SagaMessageConvertStartToEnd(message)
+					if !strings.HasPrefix(stepReply, "END-") {
+						// nothing was paid
+						return nil, returnMessage
+					}
+					clientError, serverError := cancelPayment(ctx, users, payments, mongoUserID, mongoOrderID)
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				}), nil, ""
+			}
+
+			if message.Name == "START-CANCEL-PAYMENT" {
+				return transactions.RunSagaStep(ctx, mongoUserID, message, func(ctx context.Context, users UserStore, payments PaymentStore) (error, *shared.SagaMessage) {
+					returnMessage := shared.SagaMessageConvertStartToEnd(message)
+					clientError, serverError := cancelPayment(ctx, users, payments, mongoUserID, mongoOrderID)
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				}), nil, ""
+			}
 
-func getUserCollection(userID *uuid.UUID) *mongo.Collection {
-	databaseNum := shared.HashUUID(*userID)
-	return userCollections[databaseNum]
+			return nil, nil, ""
+		},
+	)
 }
 
-func getPaymentCollection(userID *uuid.UUID, orderID *uuid.UUID) *mongo.Collection {
-	databaseNum := shared.HashTwoUUIDs(*userID, *orderID)
-	return paymentCollections[databaseNum]
+func greetingHandler(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Default handler of payment", "url", r.URL.String())
 }
 
 // Functions only used by http
@@ -186,10 +173,7 @@ func paymentStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	paymentCollection := getPaymentCollection(mongoUserID, mongoOrderID)
-	filter := bson.M{"userid": mongoUserID, "orderid": mongoOrderID}
-	var payment shared.Payment
-	findErr := paymentCollection.FindOne(context.Background(), filter).Decode(&payment)
+	findErr, payment := paymentStore.GetPayment(r.Context(), mongoUserID, mongoOrderID)
 	if findErr != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -222,16 +206,9 @@ func addFundsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userCollection := getUserCollection(documentID)
-	filter := bson.M{"_id": documentID}
-	update := bson.M{
-		"$inc": bson.M{
-			"credit": amountInt,
-		},
-	}
-	result := shared.UpdateRecord(userCollection, filter, update)
+	addErr := addFunds(r.Context(), userStore, documentID, *amountInt)
 	response := DoneResponse{}
-	if result.Err() != nil {
+	if addErr != nil {
 		response.Done = false
 	} else {
 		response.Done = true
@@ -246,19 +223,15 @@ func addFundsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("creates user handler")
-
 	user := shared.User{
 		Credit: 0.0,
 	}
 	userID := shared.GetNewID()
 	user.ID = userID
 	user.UserID = userID.String()
-	userCollection := getUserCollection(&userID)
-	fmt.Printf("New user: %+v\n", user)
-	_, insertionError := userCollection.InsertOne(context.Background(), user)
+	insertionError := userStore.CreateUser(r.Context(), &user)
 	if insertionError != nil {
-		log.Print(insertionError)
+		slog.ErrorContext(r.Context(), "Create user error", shared.LogError, insertionError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -266,7 +239,7 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	jsonError := json.NewEncoder(w).Encode(user)
 	if jsonError != nil {
-		log.Print(jsonError)
+		slog.ErrorContext(r.Context(), "Encode user error", shared.LogError, jsonError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -278,14 +251,13 @@ func findUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	userIdConvErr, mongoUserID := shared.ConvertStringToUUID(userID)
 	if userIdConvErr != nil {
-		log.Print(userIdConvErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	userFindErr, user := getUser(mongoUserID)
+	userFindErr, user := userStore.GetUser(r.Context(), mongoUserID)
 	if userFindErr != nil {
-		log.Print(userFindErr)
+		slog.InfoContext(r.Context(), "Get user error", shared.LogError, userFindErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -293,7 +265,7 @@ func findUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	jsonErr := json.NewEncoder(w).Encode(user)
 	if jsonErr != nil {
-		log.Print(jsonErr)
+		slog.ErrorContext(r.Context(), "Encode user error", shared.LogError, jsonErr)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -309,7 +281,6 @@ func payHandler(w http.ResponseWriter, r *http.Request) {
 
 	userIdConvErr, mongoUserID := shared.ConvertStringToUUID(userID)
 	if userIdConvErr != nil {
-		log.Print(userIdConvErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -324,66 +295,26 @@ func payHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientError, serverError := pay(mongoUserID, mongoOrderID, amountInt)
+	clientError, serverError := transactions.RunInUserTransaction(r.Context(), mongoUserID, func(ctx context.Context, users UserStore, payments PaymentStore) (error, error) {
+		return pay(ctx, users, payments, mongoUserID, mongoOrderID, amountInt)
+	})
 
+	if errors.Is(clientError, errInsufficientCredit) {
+		http.Error(w, clientError.Error(), http.StatusBadRequest)
+		return
+	}
 	if clientError != nil {
-		log.Print(clientError)
+		slog.InfoContext(r.Context(), "Payment refused", shared.LogError, clientError)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	if serverError != nil {
-		log.Print(serverError)
+		slog.ErrorContext(r.Context(), "Payment error", shared.LogError, serverError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
-func pay(userID *uuid.UUID, orderID *uuid.UUID, amount *int64) (clientError error, serverError error) {
-	getuserErr, user := getUser(userID)
-	if getuserErr != nil {
-		log.Print("user not found")
-		clientError = getuserErr
-		return
-	}
-	if user.Credit < *amount {
-		log.Print("not enough credits to pay")
-		clientError = errors.New("not enough credits to pay")
-		return
-	}
-
-	userFilter := bson.M{
-		"_id": userID,
-	}
-	userUpdate := bson.M{
-		"$inc": bson.M{
-			"credit": -*amount,
-		},
-	}
-
-	userCollection := getUserCollection(userID)
-	result := shared.UpdateRecord(userCollection, userFilter, userUpdate)
-	if result.Err() != nil {
-		serverError = result.Err()
-		return
-	}
-
-	paymentCollection := getPaymentCollection(userID, orderID)
-	paymentID := shared.GetNewID()
-	payment := shared.Payment{
-		ID:      paymentID,
-		UserID:  userID.String(),
-		OrderID: orderID.String(),
-		Amount:  *amount,
-		Paid:    true,
-	}
-	_, insertErr := paymentCollection.InsertOne(context.Background(), payment)
-	if insertErr != nil {
-		serverError = insertErr
-		return
-	}
-	return
-}
-
 func cancelPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["user_id"]
@@ -401,7 +332,9 @@ func cancelPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientError, serverError := cancelPayment(mongoUserID, mongoOrderID)
+	clientError, serverError := transactions.RunInUserTransaction(r.Context(), mongoUserID, func(ctx context.Context, users UserStore, payments PaymentStore) (error, error) {
+		return cancelPayment(ctx, users, payments, mongoUserID, mongoOrderID)
+	})
 	if clientError != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -411,42 +344,3 @@ func cancelPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
-
-func cancelPayment(userID *uuid.UUID, orderID *uuid.UUID) (clientError error, serverError error) {
-	getPaymentErr, payment := getPayment(userID, orderID)
-	if getPaymentErr != nil {
-		clientError = getPaymentErr
-		return
-	}
-
-	userCollection := getUserCollection(userID)
-	userFilter := bson.M{
-		"_id": userID,
-	}
-	userUpdate := bson.M{
-		"$inc": bson.M{
-			"credit": payment.Amount,
-		},
-	}
-	result := shared.UpdateRecord(userCollection, userFilter, userUpdate)
-	if result.Err() != nil {
-		serverError = result.Err()
-		return
-	}
-
-	paymentCollection := getPaymentCollection(userID, orderID)
-	paymentFilter := bson.M{
-		"userid":  userID,
-		"orderid": orderID,
-	}
-	paymentUpdate := bson.M{
-		"$set": bson.M{
-			"paid": false,
-		},
-	}
-	result = shared.UpdateRecord(paymentCollection, paymentFilter, paymentUpdate)
-	if result.Err() != nil {
-		serverError = result.Err()
-	}
-	return
-}
@@ -0,0 +1,202 @@
+package payment
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// memoryStore keeps the users and payments in memory, for the local mode and
+// tests. A transaction holds the lock and restores the data of its user on
+// error.
+type memoryStore struct {
+	mu    sync.Mutex
+	users map[uuid.UUID]shared.User
+	// payments by user and order
+	payments map[uuid.UUID]map[uuid.UUID]shared.Payment
+	outbox   *shared.MemoryOutbox
+}
+
+// memoryUserStore and memoryPaymentStore take the lock for every function,
+// unless they belong to a transaction that holds it.
+type memoryUserStore struct {
+	memory        *memoryStore
+	inTransaction bool
+}
+
+type memoryPaymentStore struct {
+	memory        *memoryStore
+	inTransaction bool
+}
+
+type memoryUserTransactions struct {
+	memory *memoryStore
+}
+
+// memoryUserSnapshot is the data of a user before a transaction
+type memoryUserSnapshot struct {
+	user      shared.User
+	userFound bool
+	payments  map[uuid.UUID]shared.Payment
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:    map[uuid.UUID]shared.User{},
+		payments: map[uuid.UUID]map[uuid.UUID]shared.Payment{},
+		outbox:   shared.NewMemoryOutbox(),
+	}
+}
+
+// lock takes the lock and returns the function that releases it
+func (memory *memoryStore) lock(inTransaction bool) func() {
+	if inTransaction {
+		return func() {}
+	}
+	memory.mu.Lock()
+	return memory.mu.Unlock
+}
+
+func (memory *memoryStore) snapshotUser(userID *uuid.UUID) memoryUserSnapshot {
+	user, userFound := memory.users[*userID]
+	payments := map[uuid.UUID]shared.Payment{}
+	for orderID, payment := range memory.payments[*userID] {
+		payments[orderID] = payment
+	}
+	return memoryUserSnapshot{user: user, userFound: userFound, payments: payments}
+}
+
+func (memory *memoryStore) restoreUser(userID *uuid.UUID, snapshot memoryUserSnapshot) {
+	if snapshot.userFound {
+		memory.users[*userID] = snapshot.user
+	} else {
+		delete(memory.users, *userID)
+	}
+	memory.payments[*userID] = snapshot.payments
+}
+
+func (store memoryUserStore) CreateUser(ctx context.Context, user *shared.User) error {
+	defer store.memory.lock(store.inTransaction)()
+	store.memory.users[user.ID] = *user
+	return nil
+}
+
+func (store memoryUserStore) GetUser(ctx context.Context, userID *uuid.UUID) (error, *shared.User) {
+	defer store.memory.lock(store.inTransaction)()
+	user, found := store.memory.users[*userID]
+	if !found {
+		return errUserNotFound, nil
+	}
+	return nil, &user
+}
+
+func (store memoryUserStore) AddCredit(ctx context.Context, userID *uuid.UUID, amount int64) (error, bool) {
+	defer store.memory.lock(store.inTransaction)()
+	user, found := store.memory.users[*userID]
+	if !found {
+		return nil, false
+	}
+	user.Credit += amount
+	store.memory.users[*userID] = user
+	return nil, true
+}
+
+func (store memoryUserStore) TakeCredit(ctx context.Context, userID *uuid.UUID, amount int64) (error, bool) {
+	defer store.memory.lock(store.inTransaction)()
+	user, found := store.memory.users[*userID]
+	if !found || user.Credit < amount {
+		return nil, false
+	}
+	user.Credit -= amount
+	store.memory.users[*userID] = user
+	return nil, true
+}
+
+func (store memoryPaymentStore) CreatePayment(ctx context.Context, payment *shared.Payment) error {
+	defer store.memory.lock(store.inTransaction)()
+	// ignore errors, will not happen
+	_, userID := shared.ConvertStringToUUID(payment.UserID)
+	_, orderID := shared.ConvertStringToUUID(payment.OrderID)
+	if store.memory.payments[*userID] == nil {
+		store.memory.payments[*userID] = map[uuid.UUID]shared.Payment{}
+	}
+	store.memory.payments[*userID][*orderID] = *payment
+	return nil
+}
+
+func (store memoryPaymentStore) GetPayment(ctx context.Context, userID *uuid.UUID, orderID *uuid.UUID) (error, *shared.Payment) {
+	defer store.memory.lock(store.inTransaction)()
+	payment, found := store.memory.payments[*userID][*orderID]
+	if !found {
+		return errPaymentNotFound, nil
+	}
+	return nil, &payment
+}
+
+func (store memoryPaymentStore) SetPaymentPaid(ctx context.Context, userID *uuid.UUID, orderID *uuid.UUID, paid bool) (error, bool) {
+	defer store.memory.lock(store.inTransaction)()
+	payment, found := store.memory.payments[*userID][*orderID]
+	if !found {
+		return nil, false
+	}
+	payment.Paid = paid
+	store.memory.payments[*userID][*orderID] = payment
+	return nil, true
+}
+
+func (transactions memoryUserTransactions) stores() (UserStore, PaymentStore) {
+	return memoryUserStore{memory: transactions.memory, inTransaction: true}, memoryPaymentStore{memory: transactions.memory, inTransaction: true}
+}
+
+func (transactions memoryUserTransactions) RunInUserTransaction(ctx context.Context, userID *uuid.UUID, paymentFunc func(ctx context.Context, users UserStore, payments PaymentStore) (error, error)) (clientError error, serverError error) {
+	memory := transactions.memory
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	snapshot := memory.snapshotUser(userID)
+	users, payments := transactions.stores()
+	clientError, serverError = paymentFunc(ctx, users, payments)
+	if clientError != nil || serverError != nil {
+		memory.restoreUser(userID, snapshot)
+	}
+	return
+}
+
+func (transactions memoryUserTransactions) RunSagaStep(ctx context.Context, userID *uuid.UUID, message *shared.SagaMessage, step func(ctx context.Context, users UserStore, payments PaymentStore) (error, *shared.SagaMessage)) error {
+	memory := transactions.memory
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	return memory.outbox.RunSagaStep(ctx, message, "payment-ack", func() (error, *shared.SagaMessage) {
+		snapshot := memory.snapshotUser(userID)
+		users, payments := transactions.stores()
+		stepErr, reply := step(ctx, users, payments)
+		if stepErr != nil {
+			memory.restoreUser(userID, snapshot)
+		}
+		return stepErr, reply
+	})
+}
+
+func (transactions memoryUserTransactions) RunSagaCompensation(ctx context.Context, userID *uuid.UUID, message *shared.SagaMessage, stepName string, compensate func(ctx context.Context, users UserStore, payments PaymentStore, stepReply string) (error, *shared.SagaMessage)) error {
+	memory := transactions.memory
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	return memory.outbox.RunSagaStep(ctx, message, "payment-ack", func() (error, *shared.SagaMessage) {
+		fenceErr, stepReply := memory.outbox.FenceSagaStep(message, stepName, "payment-ack")
+		if fenceErr != nil {
+			return fenceErr, nil
+		}
+		snapshot := memory.snapshotUser(userID)
+		users, payments := transactions.stores()
+		stepErr, reply := compensate(ctx, users, payments, stepReply)
+		if stepErr != nil {
+			memory.restoreUser(userID, snapshot)
+		}
+		return stepErr, reply
+	})
+}
@@ -0,0 +1,235 @@
+package payment
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"main/shared"
+)
+
+// mongoShards are the collections of the service on its Mongo shards.
+// Payments and the outbox are stored with their user, so paying and the saga
+// reply can be written in one transaction.
+type mongoShards struct {
+	clients  []*mongo.Client
+	users    *shared.ShardedCollection
+	payments *shared.ShardedCollection
+	outboxes *shared.ShardedCollection
+}
+
+// mongoUserStore and mongoPaymentStore run in the transaction of the context
+// they are called with, if it has one.
+type mongoUserStore struct {
+	shards *mongoShards
+}
+
+type mongoPaymentStore struct {
+	shards *mongoShards
+}
+
+// mongoUserTransactions run Mongo transactions on the shard of the user
+type mongoUserTransactions struct {
+	shards *mongoShards
+}
+
+func connectMongoShards(ctx context.Context) (error, *mongoShards) {
+	loadErr, shardMap := shared.NewShardMap(&shared.AppConfig.Sharding, "payment")
+	if loadErr != nil {
+		return loadErr, nil
+	}
+	connectErr, clients := shared.ConnectShards(ctx, shardMap)
+	if connectErr != nil {
+		return connectErr, nil
+	}
+	return nil, &mongoShards{
+		clients:  clients,
+		users:    shared.NewShardedCollection(shardMap, clients, "payment", "users", "_id"),
+		payments: shared.NewShardedCollection(shardMap, clients, "payment", "payments", "userid"),
+		outboxes: shared.NewShardedCollection(shardMap, clients, "payment", "outbox", "shardkey"),
+	}
+}
+
+func (shards *mongoShards) disconnect(ctx context.Context) {
+	for _, client := range shards.clients {
+		client.Disconnect(ctx)
+	}
+}
+
+func (shards *mongoShards) startResharding() {
+	shared.StartResharding(shards.users, shards.payments, shards.outboxes)
+}
+
+func (shards *mongoShards) startOutboxRelay() {
+	shared.StartOutboxRelay(shards.outboxes.All())
+}
+
+// moveUserDocuments moves the user, its payments and its outbox to the shard
+// of the user while resharding, before they are written.
+func (shards *mongoShards) moveUserDocuments(userID *uuid.UUID) error {
+	for _, sharded := range []*shared.ShardedCollection{shards.users, shards.payments, shards.outboxes} {
+		moveErr, _ := sharded.Write(*userID)
+		if moveErr != nil {
+			return moveErr
+		}
+	}
+	return nil
+}
+
+func (store mongoUserStore) CreateUser(ctx context.Context, user *shared.User) error {
+	_, insertErr := store.shards.users.Get(user.ID).InsertOne(ctx, user)
+	return insertErr
+}
+
+func (store mongoUserStore) GetUser(ctx context.Context, documentID *uuid.UUID) (error, *shared.User) {
+	userCollection := store.shards.users.Read(*documentID)
+
+	var user shared.User
+	err := userCollection.FindOne(ctx, bson.M{"_id": documentID}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errUserNotFound, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+	user.ID = *documentID
+	user.UserID = documentID.String()
+	return nil, &user
+}
+
+// updateCredit changes the credit in one update and reports whether it
+// matched
+func (store mongoUserStore) updateCredit(ctx context.Context, userID *uuid.UUID, filter bson.M, amount int64) (error, bool) {
+	moveErr, userCollection := store.shards.users.Write(*userID)
+	if moveErr != nil {
+		return moveErr, false
+	}
+	update := bson.M{
+		"$inc": bson.M{
+			"credit": amount,
+		},
+	}
+	result, updateErr := userCollection.UpdateOne(ctx, filter, update)
+	if updateErr != nil {
+		return updateErr, false
+	}
+	return nil, result.MatchedCount > 0
+}
+
+func (store mongoUserStore) AddCredit(ctx context.Context, userID *uuid.UUID, amount int64) (error, bool) {
+	return store.updateCredit(ctx, userID, bson.M{"_id": userID}, amount)
+}
+
+func (store mongoUserStore) TakeCredit(ctx context.Context, userID *uuid.UUID, amount int64) (error, bool) {
+	// check and deduct the credit in one update
+	filter := bson.M{
+		"_id":    userID,
+		"credit": bson.M{"$gte": amount},
+	}
+	return store.updateCredit(ctx, userID, filter, -amount)
+}
+
+func (store mongoPaymentStore) CreatePayment(ctx context.Context, payment *shared.Payment) error {
+	// ignore error, will not happen
+	_, userID := shared.ConvertStringToUUID(payment.UserID)
+	_, insertErr := store.shards.payments.Get(*userID).InsertOne(ctx, payment)
+	return insertErr
+}
+
+func (store mongoPaymentStore) GetPayment(ctx context.Context, userID *uuid.UUID, orderID *uuid.UUID) (error, *shared.Payment) {
+	paymentCollection := store.shards.payments.Read(*userID)
+
+	filter := bson.M{"userid": userID.String(), "orderid": orderID.String()}
+	var payment shared.Payment
+	findErr := paymentCollection.FindOne(ctx, filter).Decode(&payment)
+	if errors.Is(findErr, mongo.ErrNoDocuments) {
+		return errPaymentNotFound, nil
+	}
+	if findErr != nil {
+		return findErr, nil
+	}
+	return nil, &payment
+}
+
+func (store mongoPaymentStore) SetPaymentPaid(ctx context.Context, userID *uuid.UUID, orderID *uuid.UUID, paid bool) (error, bool) {
+	moveErr, paymentCollection := store.shards.payments.Write(*userID)
+	if moveErr != nil {
+		return moveErr, false
+	}
+	filter := bson.M{
+		"userid":  userID.String(),
+		"orderid": orderID.String(),
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"paid": paid,
+		},
+	}
+	result, updateErr := paymentCollection.UpdateOne(ctx, filter, update)
+	if updateErr != nil {
+		return updateErr, false
+	}
+	return nil, result.MatchedCount > 0
+}
+
+func (transactions mongoUserTransactions) stores() (UserStore, PaymentStore) {
+	return mongoUserStore{shards: transactions.shards}, mongoPaymentStore{shards: transactions.shards}
+}
+
+func (transactions mongoUserTransactions) RunSagaStep(traceCtx context.Context, userID *uuid.UUID, message *shared.SagaMessage, step func(ctx context.Context, users UserStore, payments PaymentStore) (error, *shared.SagaMessage)) error {
+	moveErr := transactions.shards.moveUserDocuments(userID)
+	if moveErr != nil {
+		return moveErr
+	}
+	outbox := transactions.shards.outboxes.Get(*userID)
+	return shared.RunSagaStepWithOutbox(traceCtx, outbox, userID.String(), message, "payment-ack", func(ctx mongo.SessionContext) (error, *shared.SagaMessage) {
+		users, payments := transactions.stores()
+		return step(ctx, users, payments)
+	})
+}
+
+func (transactions mongoUserTransactions) RunSagaCompensation(traceCtx context.Context, userID *uuid.UUID, message *shared.SagaMessage, stepName string, compensate func(ctx context.Context, users UserStore, payments PaymentStore, stepReply string) (error, *shared.SagaMessage)) error {
+	moveErr := transactions.shards.moveUserDocuments(userID)
+	if moveErr != nil {
+		return moveErr
+	}
+	outbox := transactions.shards.outboxes.Get(*userID)
+	return shared.RunSagaStepWithOutbox(traceCtx, outbox, userID.String(), message, "payment-ack", func(ctx mongo.SessionContext) (error, *shared.SagaMessage) {
+		fenceErr, stepReply := shared.FenceSagaStepInOutbox(ctx, outbox, userID.String(), message, stepName, "payment-ack")
+		if fenceErr != nil {
+			return fenceErr, nil
+		}
+		users, payments := transactions.stores()
+		return compensate(ctx, users, payments, stepReply)
+	})
+}
+
+func (transactions mongoUserTransactions) RunInUserTransaction(traceCtx context.Context, userID *uuid.UUID, paymentFunc func(ctx context.Context, users UserStore, payments PaymentStore) (error, error)) (clientError error, serverError error) {
+	moveErr := transactions.shards.moveUserDocuments(userID)
+	if moveErr != nil {
+		serverError = moveErr
+		return
+	}
+	session, sessionErr := transactions.shards.users.Get(*userID).Database().Client().StartSession()
+	if sessionErr != nil {
+		serverError = sessionErr
+		return
+	}
+	defer session.EndSession(traceCtx)
+
+	_, txErr := session.WithTransaction(traceCtx, func(ctx mongo.SessionContext) (interface{}, error) {
+		users, payments := transactions.stores()
+		clientError, serverError = paymentFunc(ctx, users, payments)
+		if clientError != nil {
+			return nil, clientError
+		}
+		return nil, serverError
+	})
+	if clientError == nil && txErr != nil {
+		serverError = txErr
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package payment
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+var errInsufficientCredit = errors.New("insufficient credit")
+
+// The payment functions take the stores, so they run the same on Mongo and in
+// memory. pay and cancelPayment have to run in a user transaction.
+
+func addFunds(ctx context.Context, users UserStore, userID *uuid.UUID, amount int64) error {
+	addErr, added := users.AddCredit(ctx, userID, amount)
+	if addErr != nil {
+		return addErr
+	}
+	if !added {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func pay(ctx context.Context, users UserStore, payments PaymentStore, userID *uuid.UUID, orderID *uuid.UUID, amount *int64) (clientError error, serverError error) {
+	takeErr, taken := users.TakeCredit(ctx, userID, *amount)
+	if takeErr != nil {
+		serverError = takeErr
+		return
+	}
+	if !taken {
+		getUserErr, _ := users.GetUser(ctx, userID)
+		if getUserErr != nil {
+			clientError = getUserErr
+			return
+		}
+		clientError = errInsufficientCredit
+		return
+	}
+
+	payment := shared.Payment{
+		ID:      shared.GetNewID(),
+		UserID:  userID.String(),
+		OrderID: orderID.String(),
+		Amount:  *amount,
+		Paid:    true,
+	}
+	insertErr := payments.CreatePayment(ctx, &payment)
+	if insertErr != nil {
+		serverError = insertErr
+	}
+	return
+}
+
+func cancelPayment(ctx context.Context, users UserStore, payments PaymentStore, userID *uuid.UUID, orderID *uuid.UUID) (clientError error, serverError error) {
+	getPaymentErr, payment := payments.GetPayment(ctx, userID, orderID)
+	if getPaymentErr != nil {
+		clientError = getPaymentErr
+		return
+	}
+	if !payment.Paid {
+		clientError = errors.New("payment already cancelled")
+		return
+	}
+
+	addErr, added := users.AddCredit(ctx, userID, payment.Amount)
+	if addErr != nil {
+		serverError = addErr
+		return
+	}
+	if !added {
+		clientError = errUserNotFound
+		return
+	}
+
+	setErr, _ := payments.SetPaymentPaid(ctx, userID, orderID, false)
+	if setErr != nil {
+		serverError = setErr
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// newTestStores returns the memory stores with a user that has credit
+func newTestStores(t *testing.T, credit int64) (*memoryStore, *uuid.UUID) {
+	t.Helper()
+	memory := newMemoryStore()
+	userID := shared.GetNewID()
+	createErr := memoryUserStore{memory: memory}.CreateUser(context.Background(), &shared.User{ID: userID, UserID: userID.String(), Credit: credit})
+	if createErr != nil {
+		t.Fatalf("create user: %v", createErr)
+	}
+	return memory, &userID
+}
+
+func getTestCredit(t *testing.T, users UserStore, userID *uuid.UUID) int64 {
+	t.Helper()
+	getErr, user := users.GetUser(context.Background(), userID)
+	if getErr != nil {
+		t.Fatalf("get user: %v", getErr)
+	}
+	return user.Credit
+}
+
+func TestPay(t *testing.T) {
+	tests := []struct {
+		name            string
+		credit          int64
+		amount          int64
+		unknownUser     bool
+		wantCredit      int64
+		wantClientError error
+	}{
+		{
+			name:       "enough credit",
+			credit:     100,
+			amount:     30,
+			wantCredit: 70,
+		},
+		{
+			name:       "all credit",
+			credit:     30,
+			amount:     30,
+			wantCredit: 0,
+		},
+		{
+			name:            "not enough credit",
+			credit:          20,
+			amount:          30,
+			wantCredit:      20,
+			wantClientError: errInsufficientCredit,
+		},
+		{
+			name:            "unknown user",
+			credit:          100,
+			amount:          30,
+			unknownUser:     true,
+			wantCredit:      100,
+			wantClientError: errUserNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory, userID := newTestStores(t, test.credit)
+			users := memoryUserStore{memory: memory}
+			payments := memoryPaymentStore{memory: memory}
+			payingUserID := userID
+			if test.unknownUser {
+				unknownID := shared.GetNewID()
+				payingUserID = &unknownID
+			}
+			orderID := shared.GetNewID()
+
+			amount := test.amount
+			clientError, serverError := pay(context.Background(), users, payments, payingUserID, &orderID, &amount)
+			if serverError != nil {
+				t.Fatalf("server error: %v", serverError)
+			}
+			if !errors.Is(clientError, test.wantClientError) {
+				t.Fatalf("client error %v, want %v", clientError, test.wantClientError)
+			}
+			if credit := getTestCredit(t, users, userID); credit != test.wantCredit {
+				t.Errorf("credit is %d, want %d", credit, test.wantCredit)
+			}
+
+			getPaymentErr, payment := payments.GetPayment(context.Background(), payingUserID, &orderID)
+			if test.wantClientError != nil {
+				if !errors.Is(getPaymentErr, errPaymentNotFound) {
+					t.Errorf("refused payment was stored: %v", payment)
+				}
+				return
+			}
+			if getPaymentErr != nil || !payment.Paid || payment.Amount != test.amount {
+				t.Errorf("payment is %v, %v, want paid %d", payment, getPaymentErr, test.amount)
+			}
+		})
+	}
+}
+
+// TestConcurrentPay pays and adds funds at the same time, no payment may take
+// the credit below zero and no change may get lost
+func TestConcurrentPay(t *testing.T) {
+	const initialCredit = 100
+	const payers = 50
+	const payAmount = 10
+	const funders = 20
+	const fundAmount = 5
+
+	memory, userID := newTestStores(t, initialCredit)
+	transactions := memoryUserTransactions{memory: memory}
+
+	var paid atomic.Int64
+	var wait sync.WaitGroup
+	for i := 0; i < payers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			orderID := shared.GetNewID()
+			amount := int64(payAmount)
+			clientError, serverError := transactions.RunInUserTransaction(context.Background(), userID, func(ctx context.Context, users UserStore, payments PaymentStore) (error, error) {
+				return pay(ctx, users, payments, userID, &orderID, &amount)
+			})
+			if serverError != nil {
+				t.Errorf("server error: %v", serverError)
+				return
+			}
+			if clientError == nil {
+				paid.Add(payAmount)
+			} else if !errors.Is(clientError, errInsufficientCredit) {
+				t.Errorf("client error: %v", clientError)
+			}
+		}()
+	}
+	for i := 0; i < funders; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			addErr := addFunds(context.Background(), memoryUserStore{memory: memory}, userID, fundAmount)
+			if addErr != nil {
+				t.Errorf("add funds: %v", addErr)
+			}
+		}()
+	}
+	wait.Wait()
+
+	credit := getTestCredit(t, memoryUserStore{memory: memory}, userID)
+	if credit < 0 {
+		t.Fatalf("credit is %d", credit)
+	}
+	if want := initialCredit + funders*fundAmount - paid.Load(); credit != want {
+		t.Errorf("credit is %d, want %d after paying %d", credit, want, paid.Load())
+	}
+	if paid.Load() < initialCredit {
+		t.Errorf("only %d paid", paid.Load())
+	}
+}
+
+func TestCancelPayment(t *testing.T) {
+	tests := []struct {
+		name string
+		// pay 30 of 100 credit first
+		paid bool
+		// cancel the payment before the one under test
+		cancelled       bool
+		wantCredit      int64
+		wantClientError bool
+	}{
+		{
+			name:       "paid",
+			paid:       true,
+			wantCredit: 100,
+		},
+		{
+			name:            "already cancelled",
+			paid:            true,
+			cancelled:       true,
+			wantCredit:      100,
+			wantClientError: true,
+		},
+		{
+			name:            "not paid",
+			wantCredit:      100,
+			wantClientError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory, userID := newTestStores(t, 100)
+			users := memoryUserStore{memory: memory}
+			payments := memoryPaymentStore{memory: memory}
+			orderID := shared.GetNewID()
+			if test.paid {
+				amount := int64(30)
+				clientError, serverError := pay(context.Background(), users, payments, userID, &orderID, &amount)
+				if clientError != nil || serverError != nil {
+					t.Fatalf("pay: %v %v", clientError, serverError)
+				}
+			}
+			if test.cancelled {
+				clientError, serverError := cancelPayment(context.Background(), users, payments, userID, &orderID)
+				if clientError != nil || serverError != nil {
+					t.Fatalf("cancel payment: %v %v", clientError, serverError)
+				}
+			}
+
+			clientError, serverError := cancelPayment(context.Background(), users, payments, userID, &orderID)
+			if serverError != nil {
+				t.Fatalf("server error: %v", serverError)
+			}
+			if (clientError != nil) != test.wantClientError {
+				t.Fatalf("client error %v, want one: %v", clientError, test.wantClientError)
+			}
+			if credit := getTestCredit(t, users, userID); credit != test.wantCredit {
+				t.Errorf("credit is %d, want %d", credit, test.wantCredit)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package payment
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+var errUserNotFound = errors.New("user not found")
+var errPaymentNotFound = errors.New("payment not found")
+
+// UserStore stores the users and their credit, on the Mongo shards or in
+// memory in local mode. The bool results report whether the user matched, a
+// missing user is no error.
+type UserStore interface {
+	CreateUser(ctx context.Context, user *shared.User) error
+	// GetUser returns errUserNotFound for a missing user
+	GetUser(ctx context.Context, userID *uuid.UUID) (error, *shared.User)
+	AddCredit(ctx context.Context, userID *uuid.UUID, amount int64) (error, bool)
+	// TakeCredit does not match when the user has less credit than amount, so
+	// concurrent payments cannot take the credit below zero.
+	TakeCredit(ctx context.Context, userID *uuid.UUID, amount int64) (error, bool)
+}
+
+// PaymentStore stores the payments of the users, one per user and order
+type PaymentStore interface {
+	CreatePayment(ctx context.Context, payment *shared.Payment) error
+	// GetPayment returns errPaymentNotFound for a missing payment
+	GetPayment(ctx context.Context, userID *uuid.UUID, orderID *uuid.UUID) (error, *shared.Payment)
+	SetPaymentPaid(ctx context.Context, userID *uuid.UUID, orderID *uuid.UUID, paid bool) (error, bool)
+}
+
+// UserTransactions run functions on the stores atomically for the data of one
+// user. The functions call the stores with the context passed to them, which
+// belongs to the transaction.
+type UserTransactions interface {
+	// RunInUserTransaction rolls back on any error of paymentFunc
+	RunInUserTransaction(ctx context.Context, userID *uuid.UUID, paymentFunc func(ctx context.Context, users UserStore, payments PaymentStore) (error, error)) (clientError error, serverError error)
+	// RunSagaStep stores the reply of the step in the transaction and sends
+	// it afterwards. A redelivered step only sends its reply again.
+	RunSagaStep(ctx context.Context, userID *uuid.UUID, message *shared.SagaMessage, step func(ctx context.Context, users UserStore, payments PaymentStore) (error, *shared.SagaMessage)) error
+	// RunSagaCompensation is RunSagaStep for the compensation of the step
+	// stepName of the same saga. It fences the step first, see
+	// shared.FenceSagaStepInOutbox, and passes the reply the step had to
+	// compensate.
+	RunSagaCompensation(ctx context.Context, userID *uuid.UUID, message *shared.SagaMessage, stepName string, compensate func(ctx context.Context, users UserStore, payments PaymentStore, stepReply string) (error, *shared.SagaMessage)) error
+}
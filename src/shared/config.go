@@ -0,0 +1,394 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "config/config.yaml"
+
+// Config of all services, read from config/config.yaml. Every field with an
+// env tag can be overridden by that environment variable, or by NAME_FILE to
+// read the value from a file, e.g. a mounted secret.
+type Config struct {
+	Kafka     KafkaConfig     `yaml:"kafka"`
+	Messaging MessagingConfig `yaml:"messaging"`
+	Services  ServicesConfig  `yaml:"services"`
+	MySQL     MySQLConfig     `yaml:"mysql"`
+	Timeouts  TimeoutsConfig  `yaml:"timeouts"`
+	Sharding  ShardingConfig  `yaml:"sharding"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Logging   LoggingConfig   `yaml:"logging"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Checkout  CheckoutConfig  `yaml:"checkout"`
+}
+
+// KafkaConfig of the brokers. The saga topics are created with Partitions
+// partitions, at least as many as the largest number of replicas of a service.
+type KafkaConfig struct {
+	Brokers           []string `yaml:"brokers" env:"KAFKA_BROKERS"`
+	Partitions        int      `yaml:"partitions" env:"KAFKA_PARTITIONS"`
+	ReplicationFactor int      `yaml:"replication_factor" env:"KAFKA_REPLICATION_FACTOR"`
+}
+
+// MessagingConfig picks the transport of the saga messages, kafka or memory.
+// memory only reaches the services of the same process. A saga message that
+// fails is handled up to MaxAttempts times, waiting from InitialBackoff up to
+// MaxBackoff in between, before it is sent to the dead-letter topic.
+type MessagingConfig struct {
+	Transport      string        `yaml:"transport" env:"MESSAGING_TRANSPORT"`
+	MaxAttempts    int           `yaml:"max_attempts" env:"MESSAGING_MAX_ATTEMPTS"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env:"MESSAGING_INITIAL_BACKOFF"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env:"MESSAGING_MAX_BACKOFF"`
+}
+
+// ServicesConfig holds the base URLs the services call each other on
+type ServicesConfig struct {
+	Order      string `yaml:"order" env:"ORDER_SERVICE_URL"`
+	Stock      string `yaml:"stock" env:"STOCK_SERVICE_URL"`
+	Lockmaster string `yaml:"lockmaster" env:"LOCKMASTER_URL"`
+}
+
+type MySQLConfig struct {
+	Host     string `yaml:"host" env:"MYSQL_HOST"`
+	Port     int    `yaml:"port" env:"MYSQL_PORT"`
+	Database string `yaml:"database" env:"MYSQL_DATABASE"`
+	User     string `yaml:"user" env:"MYSQL_USER"`
+	Password string `yaml:"password" env:"MYSQL_PASSWORD"`
+}
+
+type TimeoutsConfig struct {
+	SagaStep            time.Duration `yaml:"saga_step" env:"SAGA_STEP_TIMEOUT"`
+	Checkout            time.Duration `yaml:"checkout" env:"CHECKOUT_TIMEOUT"`
+	RecoveryGracePeriod time.Duration `yaml:"recovery_grace_period" env:"RECOVERY_GRACE_PERIOD"`
+}
+
+// TracingConfig of the OpenTelemetry traces. Exporter is none, otlp to send
+// the spans to the OTLP/HTTP collector at Endpoint, or stdout to write them as
+// JSON to File, or to stdout when File is empty. SampleRatio of the traces
+// that start in a service are kept.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER"`
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT"`
+	File        string  `yaml:"file" env:"TRACING_FILE"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+// LoggingConfig of the logs of the services. Level is debug, info, warn or
+// error, Services overrides it for single services, also with
+// <SERVICE>_LOG_LEVEL, e.g. API_GATEWAY_LOG_LEVEL. Format is json or text.
+type LoggingConfig struct {
+	Level    string            `yaml:"level" env:"LOG_LEVEL"`
+	Format   string            `yaml:"format" env:"LOG_FORMAT"`
+	Services map[string]string `yaml:"services"`
+}
+
+// AdminConfig of the commands of the lockmaster API that change sagas and dead
+// letters. They need the header Authorization: Bearer <Token>, and are refused
+// while no token is set.
+type AdminConfig struct {
+	Token string `yaml:"token" env:"ADMIN_TOKEN"`
+}
+
+// CheckoutConfig of the api gateway. A checkout may only post its result to
+// a callback URL on one of CallbackHosts, and never to an address inside the
+// cluster. Without hosts callbacks are refused.
+type CheckoutConfig struct {
+	CallbackHosts []string `yaml:"callback_hosts" env:"CHECKOUT_CALLBACK_HOSTS"`
+}
+
+// LevelOf returns the log level of the service
+func (logging *LoggingConfig) LevelOf(service string) string {
+	if level, found := logging.Services[service]; found {
+		return level
+	}
+	return logging.Level
+}
+
+// Services whose log level can be set with <SERVICE>_LOG_LEVEL
+var loggedServices = []string{"order", "stock", "payment", "lockmaster", "api-gateway", "local"}
+
+// Services whose shards can be set with <SERVICE>_DB_URIS, <SERVICE>_DB_SHARDS
+// and <SERVICE>_DB_PREVIOUS_SHARDS, where 0 previous shards ends resharding.
+var shardedServices = []string{"order", "stock", "payment"}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// AppConfig is the config of the running service, loaded by SetUpConfig.
+var AppConfig = &Config{}
+
+func GetConfigPath() string {
+	path := os.Getenv("CONFIG_PATH")
+	if path == "" {
+		return defaultConfigPath
+	}
+	return path
+}
+
+// SetUpConfig loads the config from CONFIG_PATH into AppConfig.
+func SetUpConfig() error {
+	loadErr, config := LoadConfig(GetConfigPath())
+	if loadErr != nil {
+		return loadErr
+	}
+	AppConfig = config
+	return nil
+}
+
+func LoadConfig(path string) (error, *Config) {
+	fileBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return readErr, nil
+	}
+	var config Config
+	unmarshalErr := yaml.Unmarshal(fileBytes, &config)
+	if unmarshalErr != nil {
+		return unmarshalErr, nil
+	}
+
+	envErr := applyEnvOverrides(reflect.ValueOf(&config).Elem())
+	if envErr != nil {
+		return envErr, nil
+	}
+	shardsErr := applyShardEnvOverrides(&config.Sharding)
+	if shardsErr != nil {
+		return shardsErr, nil
+	}
+	logLevelsErr := applyLogLevelEnvOverrides(&config.Logging)
+	if logLevelsErr != nil {
+		return logLevelsErr, nil
+	}
+
+	validateErr := config.validate()
+	if validateErr != nil {
+		return validateErr, nil
+	}
+	return nil, &config
+}
+
+func (config *Config) validate() error {
+	switch config.Messaging.Transport {
+	case "", "kafka":
+		if len(config.Kafka.Brokers) == 0 {
+			return errors.New("config: no kafka brokers")
+		}
+		if config.Kafka.Partitions <= 0 || config.Kafka.ReplicationFactor <= 0 {
+			return errors.New("config: kafka partitions and replication factor must be positive")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("config: unknown messaging transport %q", config.Messaging.Transport)
+	}
+	if config.Messaging.MaxAttempts <= 0 || config.Messaging.InitialBackoff <= 0 || config.Messaging.MaxBackoff < config.Messaging.InitialBackoff {
+		return errors.New("config: messaging retries need positive attempts and backoffs")
+	}
+	if config.Timeouts.SagaStep <= 0 || config.Timeouts.Checkout <= 0 || config.Timeouts.RecoveryGracePeriod <= 0 {
+		return errors.New("config: timeouts must be positive")
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		return errors.New("config: tracing sample ratio must be between 0 and 1")
+	}
+	if config.Logging.Format != "" && config.Logging.Format != "json" && config.Logging.Format != "text" {
+		return fmt.Errorf("config: unknown log format %q", config.Logging.Format)
+	}
+	levelErr, _ := parseLogLevel(config.Logging.Level)
+	if levelErr != nil {
+		return fmt.Errorf("config: %w", levelErr)
+	}
+	for service, level := range config.Logging.Services {
+		levelErr, _ := parseLogLevel(level)
+		if levelErr != nil {
+			return fmt.Errorf("config: %s: %w", service, levelErr)
+		}
+	}
+	return nil
+}
+
+// DSN is the data source name of the lockmaster database. The driver formats
+// it, so a password may contain any character. NewConfig keeps the defaults of
+// the driver, e.g. native password authentication.
+func (mysqlConfig *MySQLConfig) DSN() string {
+	driverConfig := mysql.NewConfig()
+	driverConfig.User = mysqlConfig.User
+	driverConfig.Passwd = mysqlConfig.Password
+	driverConfig.Net = "tcp"
+	driverConfig.Addr = net.JoinHostPort(mysqlConfig.Host, strconv.Itoa(mysqlConfig.Port))
+	driverConfig.DBName = mysqlConfig.Database
+	driverConfig.ParseTime = true
+	return driverConfig.FormatDSN()
+}
+
+// applyEnvOverrides walks the config structs and sets every field with an env
+// tag whose variable is set.
+func applyEnvOverrides(value reflect.Value) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := value.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			nestedErr := applyEnvOverrides(field)
+			if nestedErr != nil {
+				return nestedErr
+			}
+			continue
+		}
+
+		name := fieldType.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		lookupErr, envValue, found := lookupEnv(name)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if !found {
+			continue
+		}
+		setErr := setField(field, envValue)
+		if setErr != nil {
+			return fmt.Errorf("config: %s: %w", name, setErr)
+		}
+	}
+	return nil
+}
+
+func applyShardEnvOverrides(sharding *ShardingConfig) error {
+	if sharding.Services == nil {
+		sharding.Services = map[string]ServiceShards{}
+	}
+	for _, service := range shardedServices {
+		prefix := strings.ToUpper(service) + "_DB_"
+		serviceShards := sharding.Services[service]
+		overrides := []struct {
+			name  string
+			field reflect.Value
+		}{
+			{prefix + "URIS", reflect.ValueOf(&serviceShards.URIs).Elem()},
+			{prefix + "SHARDS", reflect.ValueOf(&serviceShards.Shards).Elem()},
+		}
+		for _, override := range overrides {
+			lookupErr, envValue, found := lookupEnv(override.name)
+			if lookupErr != nil {
+				return lookupErr
+			}
+			if !found {
+				continue
+			}
+			setErr := setField(override.field, envValue)
+			if setErr != nil {
+				return fmt.Errorf("config: %s: %w", override.name, setErr)
+			}
+		}
+
+		lookupErr, previousShards, found := lookupEnv(prefix + "PREVIOUS_SHARDS")
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if found {
+			shards, parseErr := strconv.Atoi(previousShards)
+			if parseErr != nil {
+				return fmt.Errorf("config: %sPREVIOUS_SHARDS: %w", prefix, parseErr)
+			}
+			if shards == 0 {
+				serviceShards.Previous = nil
+			} else if serviceShards.Previous == nil {
+				serviceShards.Previous = &PreviousShards{Shards: shards}
+			} else {
+				// copy, the yaml value may be shared
+				previous := *serviceShards.Previous
+				previous.Shards = shards
+				serviceShards.Previous = &previous
+			}
+		}
+		sharding.Services[service] = serviceShards
+	}
+	return nil
+}
+
+func applyLogLevelEnvOverrides(logging *LoggingConfig) error {
+	for _, service := range loggedServices {
+		name := strings.ToUpper(strings.ReplaceAll(service, "-", "_")) + "_LOG_LEVEL"
+		lookupErr, level, found := lookupEnv(name)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if !found {
+			continue
+		}
+		// copy, the yaml value may be shared
+		services := map[string]string{}
+		for otherService, otherLevel := range logging.Services {
+			services[otherService] = otherLevel
+		}
+		services[service] = level
+		logging.Services = services
+	}
+	return nil
+}
+
+// lookupEnv returns the value of the variable name, or the trimmed contents
+// of the file in name_FILE.
+func lookupEnv(name string) (error, string, bool) {
+	value, found := os.LookupEnv(name)
+	if found {
+		return nil, value, true
+	}
+	path, found := os.LookupEnv(name + "_FILE")
+	if !found {
+		return nil, "", false
+	}
+	fileBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return fmt.Errorf("config: %s_FILE: %w", name, readErr), "", false
+	}
+	return nil, strings.TrimSpace(string(fileBytes)), true
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		duration, parseErr := time.ParseDuration(value)
+		if parseErr != nil {
+			return parseErr
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, parseErr := strconv.Atoi(value)
+		if parseErr != nil {
+			return parseErr
+		}
+		field.SetInt(int64(number))
+	case reflect.Float64:
+		number, parseErr := strconv.ParseFloat(value, 64)
+		if parseErr != nil {
+			return parseErr
+		}
+		field.SetFloat(number)
+	case reflect.Slice:
+		// comma separated list of strings
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
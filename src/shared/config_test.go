@@ -0,0 +1,227 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+kafka:
+  brokers: [kafka:9092]
+  partitions: 3
+  replication_factor: 1
+messaging:
+  transport: kafka
+  max_attempts: 5
+  initial_backoff: 100ms
+  max_backoff: 5s
+mysql:
+  host: mysql
+  port: 3306
+  password: file-password
+timeouts:
+  saga_step: 30s
+  checkout: 2m
+  recovery_grace_period: 30s
+tracing:
+  exporter: none
+  sample_ratio: 1
+logging:
+  level: info
+  format: json
+sharding:
+  services:
+    order:
+      uri_pattern: mongodb://orderdb-%d
+      shards: 5
+      previous:
+        shards: 3
+        hashing: modulo
+`
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// variables set to the path of a file with the given contents
+		files   map[string]string
+		wantErr bool
+		check   func(t *testing.T, config *Config)
+	}{
+		{
+			name: "config file",
+			check: func(t *testing.T, config *Config) {
+				if config.MySQL.Password != "file-password" || config.Timeouts.SagaStep != 30*time.Second || config.Kafka.Partitions != 3 {
+					t.Errorf("config %+v does not hold the values of the file", config)
+				}
+			},
+		},
+		{
+			name: "variable over the config file",
+			env:  map[string]string{"MYSQL_PASSWORD": "env-password", "SAGA_STEP_TIMEOUT": "45s", "KAFKA_BROKERS": "a:1, b:2,", "TRACING_SAMPLE_RATIO": "0.5"},
+			check: func(t *testing.T, config *Config) {
+				if config.MySQL.Password != "env-password" || config.Timeouts.SagaStep != 45*time.Second || config.Tracing.SampleRatio != 0.5 {
+					t.Errorf("config %+v does not hold the variables", config)
+				}
+				if brokers := config.Kafka.Brokers; len(brokers) != 2 || brokers[0] != "a:1" || brokers[1] != "b:2" {
+					t.Errorf("brokers %v, want [a:1 b:2]", brokers)
+				}
+			},
+		},
+		{
+			name:  "variable from a file",
+			files: map[string]string{"MYSQL_PASSWORD_FILE": "secret-password\n"},
+			check: func(t *testing.T, config *Config) {
+				if config.MySQL.Password != "secret-password" {
+					t.Errorf("password %q, want the trimmed file", config.MySQL.Password)
+				}
+			},
+		},
+		{
+			name:  "variable over its file",
+			env:   map[string]string{"MYSQL_PASSWORD": "env-password"},
+			files: map[string]string{"MYSQL_PASSWORD_FILE": "secret-password"},
+			check: func(t *testing.T, config *Config) {
+				if config.MySQL.Password != "env-password" {
+					t.Errorf("password %q, want the variable", config.MySQL.Password)
+				}
+			},
+		},
+		{
+			name:    "missing file",
+			env:     map[string]string{"MYSQL_PASSWORD_FILE": "/no/such/secret"},
+			wantErr: true,
+		},
+		{
+			name: "previous shards removed",
+			env:  map[string]string{"ORDER_DB_PREVIOUS_SHARDS": "0", "ORDER_DB_SHARDS": "6"},
+			check: func(t *testing.T, config *Config) {
+				order := config.Sharding.Services["order"]
+				if order.Previous != nil || order.Shards != 6 {
+					t.Errorf("order has %d shards and previous %+v, want 6 and none", order.Shards, order.Previous)
+				}
+			},
+		},
+		{
+			name: "previous shards changed",
+			env:  map[string]string{"ORDER_DB_PREVIOUS_SHARDS": "4"},
+			check: func(t *testing.T, config *Config) {
+				previous := config.Sharding.Services["order"].Previous
+				if previous == nil || previous.Shards != 4 || previous.Hashing != "modulo" {
+					t.Errorf("previous %+v, want 4 modulo shards", previous)
+				}
+			},
+		},
+		{
+			name: "log level of a service",
+			env:  map[string]string{"API_GATEWAY_LOG_LEVEL": "debug"},
+			check: func(t *testing.T, config *Config) {
+				if level := config.Logging.LevelOf("api-gateway"); level != "debug" {
+					t.Errorf("api-gateway logs at %q, want debug", level)
+				}
+				if level := config.Logging.LevelOf("order"); level != "info" {
+					t.Errorf("order logs at %q, want info", level)
+				}
+			},
+		},
+		{
+			name: "memory transport without brokers",
+			env:  map[string]string{"MESSAGING_TRANSPORT": "memory", "KAFKA_PARTITIONS": "0"},
+			check: func(t *testing.T, config *Config) {
+				if config.Messaging.Transport != "memory" {
+					t.Errorf("transport %q, want memory", config.Messaging.Transport)
+				}
+			},
+		},
+		{name: "malformed duration", env: map[string]string{"SAGA_STEP_TIMEOUT": "soon"}, wantErr: true},
+		{name: "malformed number", env: map[string]string{"KAFKA_PARTITIONS": "many"}, wantErr: true},
+		{name: "malformed ratio", env: map[string]string{"TRACING_SAMPLE_RATIO": "half"}, wantErr: true},
+		{name: "malformed previous shards", env: map[string]string{"ORDER_DB_PREVIOUS_SHARDS": "three"}, wantErr: true},
+		{name: "unknown transport", env: map[string]string{"MESSAGING_TRANSPORT": "pigeon"}, wantErr: true},
+		{name: "no partitions", env: map[string]string{"KAFKA_PARTITIONS": "0"}, wantErr: true},
+		{name: "backoff below its start", env: map[string]string{"MESSAGING_MAX_BACKOFF": "10ms"}, wantErr: true},
+		{name: "no timeout", env: map[string]string{"CHECKOUT_TIMEOUT": "0s"}, wantErr: true},
+		{name: "sample ratio above one", env: map[string]string{"TRACING_SAMPLE_RATIO": "2"}, wantErr: true},
+		{name: "unknown log format", env: map[string]string{"LOG_FORMAT": "xml"}, wantErr: true},
+		{name: "unknown log level", env: map[string]string{"LOG_LEVEL": "loud"}, wantErr: true},
+		{name: "unknown log level of a service", env: map[string]string{"STOCK_LOG_LEVEL": "loud"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.yaml")
+			writeErr := os.WriteFile(path, []byte(testConfig), 0o644)
+			if writeErr != nil {
+				t.Fatalf("write config: %v", writeErr)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			for name, contents := range test.files {
+				filePath := filepath.Join(dir, name)
+				writeErr := os.WriteFile(filePath, []byte(contents), 0o600)
+				if writeErr != nil {
+					t.Fatalf("write %s: %v", name, writeErr)
+				}
+				t.Setenv(name, filePath)
+			}
+
+			loadErr, config := LoadConfig(path)
+			if test.wantErr {
+				if loadErr == nil {
+					t.Fatalf("loaded %+v, want an error", config)
+				}
+				return
+			}
+			if loadErr != nil {
+				t.Fatalf("load: %v", loadErr)
+			}
+			test.check(t, config)
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "missing file"},
+		{name: "broken yaml", config: "kafka: [\n"},
+		{name: "empty config", config: "\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if test.config != "" {
+				writeErr := os.WriteFile(path, []byte(test.config), 0o644)
+				if writeErr != nil {
+					t.Fatalf("write config: %v", writeErr)
+				}
+			}
+			if loadErr, config := LoadConfig(path); loadErr == nil {
+				t.Fatalf("loaded %+v, want an error", config)
+			}
+		})
+	}
+}
+
+// the shipped config is valid
+func TestLoadShippedConfig(t *testing.T) {
+	for dir, _ := os.Getwd(); ; dir = filepath.Dir(dir) {
+		path := filepath.Join(dir, "config", "config.yaml")
+		if _, statErr := os.Stat(path); statErr == nil {
+			if loadErr, _ := LoadConfig(path); loadErr != nil {
+				t.Fatalf("load %s: %v", path, loadErr)
+			}
+			return
+		}
+		if dir == filepath.Dir(dir) {
+			t.Skip("no config directory above the working directory")
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// DeadLetterServices are the services with a dead-letter topic
+var DeadLetterServices = []string{"order", "stock", "payment", "lockmaster"}
+
+// DeadLetter is a saga message that could not be parsed or kept failing, as
+// sent to the dead-letter topic of the service that received it.
+type DeadLetter struct {
+	Service string `json:"service"`
+	Topic   string `json:"topic"`
+	Key     string `json:"key"`
+	// the message as it was received, saga messages are JSON text
+	Payload  string            `json:"payload"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Error    string            `json:"error"`
+	Attempts int               `json:"attempts"`
+	FailedAt time.Time         `json:"failed_at"`
+}
+
+func DeadLetterTopic(service string) string {
+	return service + "-dlq"
+}
+
+func ParseDeadLetter(value []byte) (error, *DeadLetter) {
+	var deadLetter DeadLetter
+	unmarshalErr := json.Unmarshal(value, &deadLetter)
+	if unmarshalErr != nil {
+		return unmarshalErr, nil
+	}
+	return nil, &deadLetter
+}
+
+// sendDeadLetter sends the message to the dead-letter topic of the service.
+// If that fails as well the message is only left in the log.
+func sendDeadLetter(ctx context.Context, service string, message *Message, cause error, attempts int) {
+	deadLetter := DeadLetter{
+		Service:  service,
+		Topic:    message.Topic,
+		Key:      message.Key,
+		Payload:  string(message.Value),
+		Headers:  message.Headers,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+	slog.WarnContext(ctx, "Dead-lettering message", "attempts", attempts, LogError, cause)
+
+	deadLetterBytes, encodeErr := json.Marshal(&deadLetter)
+	if encodeErr != nil {
+		slog.ErrorContext(ctx, "Lost message, encode dead letter error", LogError, encodeErr, "payload", string(message.Value))
+		return
+	}
+	topic := DeadLetterTopic(service)
+	sendErr, _ := retryWithBackoff(ctx, func() error {
+		return sendMessageBytes(deadLetterBytes, topic, message.Key)
+	})
+	if sendErr != nil {
+		slog.ErrorContext(ctx, "Lost message, send dead letter error", "dead_letter_topic", topic, LogError, sendErr, "payload", string(message.Value))
+	}
+}
+
+// ReplayDeadLetter sends the payload of a dead letter to its topic again
+func ReplayDeadLetter(deadLetter *DeadLetter) error {
+	return sendMessageBytes([]byte(deadLetter.Payload), deadLetter.Topic, deadLetter.Key)
+}
+
+// retryWithBackoff calls attempt up to messaging.max_attempts times and
+// doubles the wait after every failure. It returns the last error and the
+// number of attempts.
+func retryWithBackoff(ctx context.Context, attempt func() error) (error, int) {
+	backoff := AppConfig.Messaging.InitialBackoff
+	attempts := 0
+	for {
+		attempts++
+		attemptErr := attempt()
+		if attemptErr == nil || attempts >= AppConfig.Messaging.MaxAttempts {
+			return attemptErr, attempts
+		}
+		slog.WarnContext(ctx, "Attempt failed, retrying", "attempt", attempts, "backoff", backoff.String(), LogError, attemptErr)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > AppConfig.Messaging.MaxBackoff {
+			backoff = AppConfig.Messaging.MaxBackoff
+		}
+	}
+}
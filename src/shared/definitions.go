@@ -1,3 +0,0 @@
-package shared
-
-const NUM_DBS = 3
@@ -1,23 +1,70 @@
 package shared
 
 import (
-	"log"
+	"encoding/json"
 	"net/http"
-	"strconv"
+	"time"
 )
 
-const API_GATEWAY = "http://api-gateway-service-0:5000/release/"
+// CHECKOUT_RESULT_TOPIC carries every change of a checkout to all api gateway
+// replicas: pending from the gateway that accepted it, the result of the saga
+// from the lockmaster and timeouts from the gateway again. The replica that
+// holds the waiting request releases it, all of them answer status polls.
+const CHECKOUT_RESULT_TOPIC = "checkout-result"
 
-func RouteCheckoutCall(orderID string, status int) int {
-	str := strconv.Itoa(status)
-	backendURL := API_GATEWAY + orderID + "/" + str
-	log.Printf("Calling %s", backendURL)
-	resp, err := http.Get(backendURL)
+const (
+	CHECKOUT_STATE_PENDING   = "pending"
+	CHECKOUT_STATE_SUCCEEDED = "succeeded"
+	CHECKOUT_STATE_FAILED    = "failed"
+	CHECKOUT_STATE_TIMED_OUT = "timed_out"
+)
+
+// Checkout is the state of a checkout at the api gateway. Status is the status
+// code the blocking checkout answers with.
+type Checkout struct {
+	CheckoutID     string     `json:"checkout_id"`
+	OrderID        string     `json:"order_id"`
+	State          string     `json:"state"`
+	Status         int        `json:"status,omitempty"`
+	IdempotencyKey string     `json:"idempotency_key,omitempty"`
+	CallbackURL    string     `json:"callback_url,omitempty"`
+	Created        time.Time  `json:"created"`
+	Finished       *time.Time `json:"finished,omitempty"`
+}
+
+func ParseCheckout(value []byte) (error, *Checkout) {
+	var checkout Checkout
+	unmarshalErr := json.Unmarshal(value, &checkout)
+	if unmarshalErr != nil {
+		return unmarshalErr, nil
+	}
+	return nil, &checkout
+}
+
+// PublishCheckout sends a change of a checkout to all api gateways. Changes of
+// an order are read in order.
+func PublishCheckout(checkout *Checkout) error {
+	checkoutBytes, encodeErr := json.Marshal(checkout)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return sendMessageBytes(checkoutBytes, CHECKOUT_RESULT_TOPIC, checkout.OrderID)
+}
 
-  if err != nil {
-		log.Printf("\nFailed to make service call: %v", err)
-		return http.StatusBadRequest
+// PublishCheckoutResult sends the end of the checkout saga of an order. The
+// gateways apply it to the checkout, or to the pending checkout of the order
+// when the saga does not know its checkout.
+func PublishCheckoutResult(orderID string, checkoutID string, status int) error {
+	state := CHECKOUT_STATE_SUCCEEDED
+	if status != http.StatusOK {
+		state = CHECKOUT_STATE_FAILED
 	}
-	log.Print(resp.StatusCode)
-	return resp.StatusCode
+	finished := time.Now().UTC()
+	return PublishCheckout(&Checkout{
+		CheckoutID: checkoutID,
+		OrderID:    orderID,
+		State:      state,
+		Status:     status,
+		Finished:   &finished,
+	})
 }
@@ -1,24 +1,71 @@
 package shared
 
 import (
-	"github.com/google/uuid"
+	"crypto/md5"
+	"encoding/binary"
 	"hash/crc32"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
 )
 
+const DEFAULT_VIRTUAL_NODES = 128
+
 func GetNewID() uuid.UUID {
 	return uuid.New()
 }
 
-func HashUUID(uuid uuid.UUID) uint32 {
-	bytes := uuid[:]
-	checksum := crc32.ChecksumIEEE(bytes)
+func hashKey(key uuid.UUID) uint32 {
+	return crc32.ChecksumIEEE(key[:])
+}
+
+// shardPlacement maps a key to the index of the shard that owns it
+type shardPlacement interface {
+	GetShard(key uuid.UUID) int
+}
+
+// HashRing is a consistent hash ring with virtual nodes. Adding a shard only
+// moves the keys of the ring segments the new shard takes over.
+type HashRing struct {
+	points []uint32
+	owners map[uint32]int
+}
 
-	return checksum % NUM_DBS
+func NewHashRing(numShards int, virtualNodes int) *HashRing {
+	ring := HashRing{owners: map[uint32]int{}}
+	for shard := 0; shard < numShards; shard++ {
+		for node := 0; node < virtualNodes; node++ {
+			// md5 spreads the similar node names far better than crc32
+			sum := md5.Sum([]byte("shard-" + strconv.Itoa(shard) + "-" + strconv.Itoa(node)))
+			point := binary.BigEndian.Uint32(sum[:4])
+			// on a collision the lower shard keeps the point, on every ring
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = shard
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return &ring
 }
 
-func HashTwoUUIDs(uuid1 uuid.UUID, uuid2 uuid.UUID) uint32 {
-	hash1 := HashUUID(uuid1)
-	hash2 := HashUUID(uuid2)
+// GetShard returns the shard of the first point at or after the hash of key.
+func (ring *HashRing) GetShard(key uuid.UUID) int {
+	hash := hashKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// moduloPlacement is how keys were placed before the hash ring
+type moduloPlacement struct {
+	numShards int
+}
 
-	return (hash1 + hash2) % NUM_DBS
+func (placement moduloPlacement) GetShard(key uuid.UUID) int {
+	return int(hashKey(key) % uint32(placement.numShards))
 }
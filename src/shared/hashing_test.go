@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func getTestKeys(count int) []uuid.UUID {
+	keys := make([]uuid.UUID, count)
+	for i := range keys {
+		keys[i] = GetNewID()
+	}
+	return keys
+}
+
+func TestHashRingSpread(t *testing.T) {
+	const numShards = 5
+	ring := NewHashRing(numShards, DEFAULT_VIRTUAL_NODES)
+	sameRing := NewHashRing(numShards, DEFAULT_VIRTUAL_NODES)
+	keys := getTestKeys(20000)
+
+	counts := make([]int, numShards)
+	for _, key := range keys {
+		shard := ring.GetShard(key)
+		if shard < 0 || shard >= numShards {
+			t.Fatalf("key %s placed on shard %d of %d", key, shard, numShards)
+		}
+		if sameShard := sameRing.GetShard(key); sameShard != shard {
+			t.Fatalf("key %s placed on shard %d and %d by equal rings", key, shard, sameShard)
+		}
+		counts[shard]++
+	}
+	// every shard holds about a fifth of the keys
+	for shard, count := range counts {
+		share := float64(count) / float64(len(keys))
+		if share < 0.1 || share > 0.3 {
+			t.Errorf("shard %d holds %.2f of the keys, want about %.2f", shard, share, 1.0/numShards)
+		}
+	}
+}
+
+func TestHashRingMovement(t *testing.T) {
+	tests := []struct {
+		name      string
+		numShards int
+	}{
+		{name: "3 to 4 shards", numShards: 3},
+		{name: "5 to 6 shards", numShards: 5},
+		{name: "9 to 10 shards", numShards: 9},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := NewHashRing(test.numShards, DEFAULT_VIRTUAL_NODES)
+			after := NewHashRing(test.numShards+1, DEFAULT_VIRTUAL_NODES)
+			keys := getTestKeys(20000)
+
+			moved := 0
+			for _, key := range keys {
+				from, to := before.GetShard(key), after.GetShard(key)
+				if from == to {
+					continue
+				}
+				// keys only move to the new shard
+				if to != test.numShards {
+					t.Fatalf("key %s moved from shard %d to %d, not to the new shard %d", key, from, to, test.numShards)
+				}
+				moved++
+			}
+			share := float64(moved) / float64(len(keys))
+			want := 1.0 / float64(test.numShards+1)
+			if share < want/2 || share > want*1.5 {
+				t.Errorf("%.3f of the keys moved, want about %.3f", share, want)
+			}
+		})
+	}
+}
+
+func TestModuloPlacement(t *testing.T) {
+	placement := moduloPlacement{numShards: 3}
+	for _, key := range getTestKeys(100) {
+		if shard, want := placement.GetShard(key), int(crc32.ChecksumIEEE(key[:])%3); shard != want {
+			t.Fatalf("key %s placed on shard %d, want crc32 %% 3 = %d", key, shard, want)
+		}
+	}
+}
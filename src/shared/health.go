@@ -0,0 +1,126 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HEALTH_CHECK_TIMEOUT bounds each dependency check of a probe
+const HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+// the paths of the probes, not traced
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// HealthCheck pings a dependency of the service, e.g. a Mongo shard
+type HealthCheck func(ctx context.Context) error
+
+var healthChecks = struct {
+	sync.Mutex
+	checks map[string]HealthCheck
+}{checks: map[string]HealthCheck{}}
+
+// started is set by MarkReady once the service has connected to its
+// dependencies and subscribed to its topics
+var started atomic.Bool
+
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthStatus struct {
+	// "ok", "starting" or "unavailable"
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// AddHealthCheck adds a dependency to the probes of the process. A check
+// with the same name replaces the previous one.
+func AddHealthCheck(name string, check HealthCheck) {
+	healthChecks.Lock()
+	defer healthChecks.Unlock()
+	healthChecks.checks[name] = check
+}
+
+// MarkReady makes /readyz report ready as long as the dependencies are up.
+// Until then the service is starting.
+func MarkReady() {
+	started.Store(true)
+}
+
+// checkHealth runs the checks of all dependencies at once
+func checkHealth(ctx context.Context) HealthStatus {
+	healthChecks.Lock()
+	checks := make(map[string]HealthCheck, len(healthChecks.checks))
+	for name, check := range healthChecks.checks {
+		checks[name] = check
+	}
+	healthChecks.Unlock()
+
+	health := HealthStatus{Status: "ok", Dependencies: make(map[string]DependencyStatus, len(checks))}
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for name, check := range checks {
+		wait.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wait.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+			defer cancel()
+			dependency := DependencyStatus{Status: "ok"}
+			if checkErr := check(checkCtx); checkErr != nil {
+				dependency = DependencyStatus{Status: "unavailable", Error: checkErr.Error()}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			health.Dependencies[name] = dependency
+			if dependency.Status != "ok" {
+				health.Status = "unavailable"
+			}
+		}(name, check)
+	}
+	wait.Wait()
+	if health.Status == "ok" && !started.Load() {
+		health.Status = "starting"
+	}
+	return health
+}
+
+// addHealthRoutes serves the probes of the process. Both report the status of
+// every dependency, but only /readyz fails with it: a dependency that is down
+// takes the pod out of the service instead of restarting it.
+func addHealthRoutes(router *mux.Router) {
+	router.HandleFunc(healthzPath, HealthzHandler).Methods(http.MethodGet)
+	router.HandleFunc(readyzPath, ReadyzHandler).Methods(http.MethodGet)
+}
+
+// HealthzHandler answers 200 while the process serves
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, checkHealth(r.Context()))
+}
+
+// ReadyzHandler answers 200 once the service has started and all its
+// dependencies are up, 503 otherwise
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	health := checkHealth(r.Context())
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, health)
+}
+
+func writeHealth(w http.ResponseWriter, status int, health HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,300 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaTransport carries the messages over the Kafka brokers. Messages are
+// spread over the partitions of a topic by key.
+type KafkaTransport struct {
+	brokers           []string
+	partitions        int
+	replicationFactor int
+	// topics known to exist
+	topics sync.Map
+}
+
+type kafkaPublisher struct {
+	transport *KafkaTransport
+	writer    *kafka.Writer
+}
+
+// kafkaReplaySubscription reads every partition of a topic without a group,
+// from an offset in the past
+type kafkaReplaySubscription struct {
+	readers  []*kafka.Reader
+	messages chan *Message
+	cancel   context.CancelFunc
+}
+
+type kafkaSubscription struct {
+	reader *kafka.Reader
+	// whether the offsets of the group are committed, a broadcast group is
+	// read from the end of the topic every time
+	commit bool
+}
+
+func NewKafkaTransport(config *KafkaConfig) *KafkaTransport {
+	return &KafkaTransport{
+		brokers:           config.Brokers,
+		partitions:        config.Partitions,
+		replicationFactor: config.ReplicationFactor,
+	}
+}
+
+// Ping asks the brokers for the cluster metadata, of no topic
+func (transport *KafkaTransport) Ping(ctx context.Context) error {
+	client := &kafka.Client{Addr: kafka.TCP(transport.brokers...)}
+	_, metadataErr := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{}})
+	return metadataErr
+}
+
+// ensureTopic creates the topic with the configured partitions. A topic that
+// has fewer, e.g. one created by the broker on the first write, is only
+// reported: adding partitions moves keys to other partitions, so the operator
+// adds them while no saga is running, see the README.
+func (transport *KafkaTransport) ensureTopic(ctx context.Context, topic string) error {
+	if _, found := transport.topics.Load(topic); found {
+		return nil
+	}
+	client := &kafka.Client{Addr: kafka.TCP(transport.brokers...)}
+
+	createResponse, createErr := client.CreateTopics(ctx, &kafka.CreateTopicsRequest{
+		Topics: []kafka.TopicConfig{{
+			Topic:             topic,
+			NumPartitions:     transport.partitions,
+			ReplicationFactor: transport.replicationFactor,
+		}},
+	})
+	if createErr != nil {
+		return createErr
+	}
+	topicErr := createResponse.Errors[topic]
+	if errors.Is(topicErr, kafka.TopicAlreadyExists) {
+		topicErr = transport.checkPartitions(ctx, client, topic)
+	}
+	if topicErr != nil {
+		return topicErr
+	}
+	transport.topics.Store(topic, true)
+	return nil
+}
+
+// checkPartitions warns when the existing topic has fewer partitions than
+// configured
+func (transport *KafkaTransport) checkPartitions(ctx context.Context, client *kafka.Client, topic string) error {
+	metadata, metadataErr := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if metadataErr != nil {
+		return metadataErr
+	}
+	if len(metadata.Topics) == 1 && len(metadata.Topics[0].Partitions) < transport.partitions {
+		slog.Warn("Topic has fewer partitions than configured", LogTopic, topic, "partitions", len(metadata.Topics[0].Partitions), "configured_partitions", transport.partitions)
+	}
+	return nil
+}
+
+func (transport *KafkaTransport) NewPublisher() Publisher {
+	return &kafkaPublisher{
+		transport: transport,
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(transport.brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+			// every saga step waits for its message, do not wait for a batch
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: sendTimeout,
+		},
+	}
+}
+
+func (transport *KafkaTransport) Subscribe(topic string, group string) (error, Subscription) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	ensureErr := transport.ensureTopic(ctx, topic)
+	if ensureErr != nil {
+		slog.Error("Create topic error", LogTopic, topic, LogError, ensureErr)
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:         transport.brokers,
+		GroupID:         group,
+		Topic:           topic,
+		MinBytes:        10e3,
+		MaxBytes:        10e6,
+		MaxWait:         1 * time.Second,
+		ReadLagInterval: -1,
+	})
+	return nil, &kafkaSubscription{reader: reader, commit: true}
+}
+
+// SubscribeBroadcast reads the topic in a group of its own, starting at the
+// end of the topic
+func (transport *KafkaTransport) SubscribeBroadcast(topic string) (error, Subscription) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	ensureErr := transport.ensureTopic(ctx, topic)
+	if ensureErr != nil {
+		slog.Error("Create topic error", LogTopic, topic, LogError, ensureErr)
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:         transport.brokers,
+		GroupID:         topic + "-" + ServiceName + "-" + GetNewID().String(),
+		Topic:           topic,
+		StartOffset:     kafka.LastOffset,
+		MinBytes:        1,
+		MaxBytes:        10e6,
+		MaxWait:         100 * time.Millisecond,
+		ReadLagInterval: -1,
+	})
+	return nil, &kafkaSubscription{reader: reader}
+}
+
+// SubscribeReplay reads every partition of the topic from the first message
+// published since since. Partitions added to the topic later are not read.
+func (transport *KafkaTransport) SubscribeReplay(topic string, since time.Time) (error, Subscription) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	ensureErr := transport.ensureTopic(ctx, topic)
+	if ensureErr != nil {
+		return ensureErr, nil
+	}
+	client := &kafka.Client{Addr: kafka.TCP(transport.brokers...)}
+	metadata, metadataErr := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if metadataErr != nil {
+		return metadataErr, nil
+	}
+	if len(metadata.Topics) != 1 || metadata.Topics[0].Error != nil {
+		return fmt.Errorf("no metadata of topic %s", topic), nil
+	}
+
+	readCtx, cancelRead := context.WithCancel(context.Background())
+	subscription := &kafkaReplaySubscription{messages: make(chan *Message), cancel: cancelRead}
+	for _, partition := range metadata.Topics[0].Partitions {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:         transport.brokers,
+			Topic:           topic,
+			Partition:       partition.ID,
+			MinBytes:        1,
+			MaxBytes:        10e6,
+			MaxWait:         100 * time.Millisecond,
+			ReadLagInterval: -1,
+		})
+		offsetErr := reader.SetOffsetAt(ctx, since)
+		if offsetErr != nil {
+			subscription.Close()
+			reader.Close()
+			return offsetErr, nil
+		}
+		subscription.readers = append(subscription.readers, reader)
+		go subscription.read(readCtx, reader)
+	}
+	return nil, subscription
+}
+
+func (publisher *kafkaPublisher) Publish(ctx context.Context, topic string, key string, value []byte) error {
+	// without the topic the broker creates it with its default partitions
+	ensureErr := publisher.transport.ensureTopic(ctx, topic)
+	if ensureErr != nil {
+		slog.Error("Create topic error", LogTopic, topic, LogError, ensureErr)
+	}
+	return publisher.writer.WriteMessages(ctx, kafka.Message{Topic: topic, Key: []byte(key), Value: value})
+}
+
+func (publisher *kafkaPublisher) Close() error {
+	return publisher.writer.Close()
+}
+
+// Receive fetches the next message without committing it, see Commit
+func (subscription *kafkaSubscription) Receive(ctx context.Context) (error, *Message) {
+	kafkaMessage, fetchErr := subscription.reader.FetchMessage(ctx)
+	if fetchErr != nil {
+		return fetchErr, nil
+	}
+	return nil, toMessage(&kafkaMessage)
+}
+
+func toMessage(kafkaMessage *kafka.Message) *Message {
+	headers := make(map[string]string, len(kafkaMessage.Headers))
+	for _, header := range kafkaMessage.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	lag := kafkaMessage.HighWaterMark - kafkaMessage.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	return &Message{
+		Topic:     kafkaMessage.Topic,
+		Key:       string(kafkaMessage.Key),
+		Value:     kafkaMessage.Value,
+		Headers:   headers,
+		Lag:       lag,
+		Partition: kafkaMessage.Partition,
+		Offset:    kafkaMessage.Offset,
+	}
+}
+
+// Commit commits the offset of the message for the group, which also commits
+// the earlier messages of its partition
+func (subscription *kafkaSubscription) Commit(ctx context.Context, m *Message) error {
+	if !subscription.commit {
+		return nil
+	}
+	return subscription.reader.CommitMessages(ctx, kafka.Message{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset})
+}
+
+func (subscription *kafkaSubscription) Close() error {
+	return subscription.reader.Close()
+}
+
+// read passes the messages of one partition on until ctx is done
+func (subscription *kafkaReplaySubscription) read(ctx context.Context, reader *kafka.Reader) {
+	for {
+		kafkaMessage, readErr := reader.ReadMessage(ctx)
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Read message error", LogTopic, reader.Config().Topic, LogError, readErr)
+			continue
+		}
+		select {
+		case subscription.messages <- toMessage(&kafkaMessage):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Receive returns the next message of any partition, the messages of a
+// partition in order
+func (subscription *kafkaReplaySubscription) Receive(ctx context.Context) (error, *Message) {
+	select {
+	case m := <-subscription.messages:
+		return nil, m
+	case <-ctx.Done():
+		return ctx.Err(), nil
+	}
+}
+
+// Commit does nothing, the subscription has no group
+func (subscription *kafkaReplaySubscription) Commit(ctx context.Context, m *Message) error {
+	return nil
+}
+
+func (subscription *kafkaReplaySubscription) Close() error {
+	subscription.cancel()
+	var closeErrs []error
+	for _, reader := range subscription.readers {
+		closeErrs = append(closeErrs, reader.Close())
+	}
+	return errors.Join(closeErrs...)
+}
@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The keys of the fields attached to the records of a request or message
+const (
+	LogService       = "service"
+	LogOrderID       = "order_id"
+	LogSagaID        = "saga_id"
+	LogCorrelationID = "correlation_id"
+	LogShard         = "shard"
+	LogTopic         = "topic"
+	LogCheckoutID    = "checkout_id"
+	LogError         = "error"
+)
+
+// the route variables that become fields of the records of a request
+var routeLogFields = []string{"order_id", "item_id", "user_id", "checkout_id", "saga_id", "dead_letter_id"}
+
+type logFieldsKey struct{}
+
+// SetUpLogging makes slog, and the log package through it, write the records
+// of the service at the level of the config, as JSON or text on stderr. The
+// records logged with a context carry its fields and its trace.
+func SetUpLogging(service string) {
+	levelErr, level := parseLogLevel(AppConfig.Logging.LevelOf(service))
+	if levelErr != nil {
+		// validated with the config
+		level = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if AppConfig.Logging.Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}).With(LogService, service))
+}
+
+func parseLogLevel(name string) (error, slog.Level) {
+	var level slog.Level
+	if name == "" {
+		return nil, slog.LevelInfo
+	}
+	unmarshalErr := level.UnmarshalText([]byte(name))
+	if unmarshalErr != nil {
+		return fmt.Errorf("unknown log level %q", name), level
+	}
+	return nil, level
+}
+
+// Fatal logs an error the service cannot run with and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// WithLogFields returns ctx with fields added to every record logged with it.
+// A field replaces the field of ctx with the same key.
+func WithLogFields(ctx context.Context, fields ...slog.Attr) context.Context {
+	previous, _ := ctx.Value(logFieldsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(previous)+len(fields))
+	for _, field := range previous {
+		if !hasLogField(fields, field.Key) {
+			merged = append(merged, field)
+		}
+	}
+	merged = append(merged, fields...)
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+func hasLogField(fields []slog.Attr, key string) bool {
+	for _, field := range fields {
+		if field.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// withMessageLogFields returns ctx with the fields of a saga message received
+// on topic
+func withMessageLogFields(ctx context.Context, topic string, message *SagaMessage) context.Context {
+	return WithLogFields(ctx,
+		slog.String(LogTopic, topic),
+		slog.Int64(LogSagaID, message.SagaID),
+		slog.String(LogOrderID, message.Order.OrderID),
+		slog.String(LogCorrelationID, message.CorrelationID),
+	)
+}
+
+// logRequestFields attaches the IDs in the route of a request to the records
+// logged with its context
+func logRequestFields(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var fields []slog.Attr
+		for _, name := range routeLogFields {
+			if value, found := vars[name]; found {
+				fields = append(fields, slog.String(name, value))
+			}
+		}
+		if len(fields) > 0 {
+			r = r.WithContext(WithLogFields(r.Context(), fields...))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contextHandler adds the fields and the trace of the context to the records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (handler *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields, found := ctx.Value(logFieldsKey{}).([]slog.Attr); found {
+		record.AddAttrs(fields...)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()),
+		)
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: handler.Handler.WithGroup(name)}
+}
@@ -0,0 +1,159 @@
+package shared
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryTransport carries the messages in memory, when all services run in one
+// process or in tests. Every group of a topic has an unbounded queue and each
+// message is read by one subscription of the group, like the readers of a
+// Kafka consumer group.
+type MemoryTransport struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+}
+
+// memoryTopic holds the queue of every group subscribed to the topic, messages
+// published before a group subscribed are only read by the first group.
+type memoryTopic struct {
+	mu     sync.Mutex
+	groups map[string]*memoryQueue
+	// messages published while no group was subscribed
+	pending []Message
+}
+
+type memoryQueue struct {
+	mu       sync.Mutex
+	messages []Message
+	// signalled when a message is queued
+	queued chan struct{}
+}
+
+type memoryPublisher struct {
+	transport *MemoryTransport
+}
+
+type memorySubscription struct {
+	queue *memoryQueue
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{topics: map[string]*memoryTopic{}}
+}
+
+func (transport *MemoryTransport) getTopic(name string) *memoryTopic {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	topic, found := transport.topics[name]
+	if !found {
+		topic = &memoryTopic{groups: map[string]*memoryQueue{}}
+		transport.topics[name] = topic
+	}
+	return topic
+}
+
+func (transport *MemoryTransport) NewPublisher() Publisher {
+	return &memoryPublisher{transport: transport}
+}
+
+func (transport *MemoryTransport) Subscribe(topicName string, group string) (error, Subscription) {
+	topic := transport.getTopic(topicName)
+	topic.mu.Lock()
+	defer topic.mu.Unlock()
+	queue, found := topic.groups[group]
+	if !found {
+		queue = &memoryQueue{queued: make(chan struct{}, 1)}
+		topic.groups[group] = queue
+		for _, message := range topic.pending {
+			queue.push(message)
+		}
+		topic.pending = nil
+	}
+	return nil, &memorySubscription{queue: queue}
+}
+
+// SubscribeBroadcast subscribes with a group of its own
+func (transport *MemoryTransport) SubscribeBroadcast(topicName string) (error, Subscription) {
+	return transport.Subscribe(topicName, "broadcast-"+GetNewID().String())
+}
+
+// SubscribeReplay is SubscribeBroadcast, the topics keep no history. The
+// process holds all state of the topic anyway.
+func (transport *MemoryTransport) SubscribeReplay(topicName string, since time.Time) (error, Subscription) {
+	return transport.SubscribeBroadcast(topicName)
+}
+
+// Publish keeps the key with the message, a queue keeps all messages in order
+func (publisher *memoryPublisher) Publish(ctx context.Context, topicName string, key string, value []byte) error {
+	message := Message{Topic: topicName, Key: key, Value: make([]byte, len(value))}
+	copy(message.Value, value)
+
+	topic := publisher.transport.getTopic(topicName)
+	topic.mu.Lock()
+	defer topic.mu.Unlock()
+	if len(topic.groups) == 0 {
+		topic.pending = append(topic.pending, message)
+		return nil
+	}
+	for _, queue := range topic.groups {
+		queue.push(message)
+	}
+	return nil
+}
+
+// Close does nothing, the topics live as long as the transport
+func (publisher *memoryPublisher) Close() error {
+	return nil
+}
+
+func (queue *memoryQueue) push(message Message) {
+	queue.mu.Lock()
+	queue.messages = append(queue.messages, message)
+	queue.mu.Unlock()
+	queue.signal()
+}
+
+func (queue *memoryQueue) signal() {
+	select {
+	case queue.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (subscription *memorySubscription) Receive(ctx context.Context) (error, *Message) {
+	queue := subscription.queue
+	for {
+		queue.mu.Lock()
+		if len(queue.messages) > 0 {
+			message := queue.messages[0]
+			queue.messages = queue.messages[1:]
+			remaining := len(queue.messages)
+			queue.mu.Unlock()
+			if remaining > 0 {
+				// wake up the next subscription of the group
+				queue.signal()
+			}
+			message.Lag = int64(remaining)
+			return nil, &message
+		}
+		queue.mu.Unlock()
+
+		select {
+		case <-queue.queued:
+		case <-ctx.Done():
+			return ctx.Err(), nil
+		}
+	}
+}
+
+// Commit does nothing, a received message is gone from the queue
+func (subscription *memorySubscription) Commit(ctx context.Context, m *Message) error {
+	return nil
+}
+
+// Close does nothing, the queue of the group stays for its other subscriptions
+func (subscription *memorySubscription) Close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const sendTimeout = 10 * time.Second
+
+// Message is a message read from a topic of any transport
+type Message struct {
+	Topic string
+	Key   string
+	Value []byte
+	// headers set by the producer, Kafka only
+	Headers map[string]string
+	// messages behind the end of the partition or queue when it was read
+	Lag int64
+	// position of the message in its topic, Kafka only
+	Partition int
+	Offset    int64
+}
+
+// Publisher sends messages to any topic
+type Publisher interface {
+	// Publish sends value to the topic. Messages with the same key are read
+	// in the order they were published.
+	Publish(ctx context.Context, topic string, key string, value []byte) error
+	Close() error
+}
+
+// Subscription reads the messages of one topic. Each message is read by one
+// subscription of the group.
+type Subscription interface {
+	// Receive blocks until a message arrives or ctx is done
+	Receive(ctx context.Context) (error, *Message)
+	// Commit marks the message and the messages received before it handled.
+	// Messages that are not committed are read again after a restart or a
+	// rebalance of the group, so commit a message once it is handled.
+	Commit(ctx context.Context, m *Message) error
+	Close() error
+}
+
+// Transport carries the saga messages between the services: Kafka, or queues
+// in memory when all services run in one process.
+type Transport interface {
+	NewPublisher() Publisher
+	Subscribe(topic string, group string) (error, Subscription)
+	// SubscribeBroadcast returns a subscription of its own, which reads every
+	// message published to the topic from now on. Its messages need no commit.
+	SubscribeBroadcast(topic string) (error, Subscription)
+	// SubscribeReplay is SubscribeBroadcast starting with the messages
+	// published since since, so a process can rebuild the state of a topic
+	SubscribeReplay(topic string, since time.Time) (error, Subscription)
+}
+
+var transport Transport
+var transportOnce sync.Once
+
+var publisher Publisher
+var publisherOnce sync.Once
+
+// UseTransport sets the transport of this process. It has to be called before
+// any message is sent or received, otherwise the transport of the config is
+// used.
+func UseTransport(newTransport Transport) {
+	transport = newTransport
+}
+
+func getTransport() Transport {
+	transportOnce.Do(func() {
+		if transport != nil {
+			return
+		}
+		switch AppConfig.Messaging.Transport {
+		case "memory":
+			transport = NewMemoryTransport()
+		default:
+			kafkaTransport := NewKafkaTransport(&AppConfig.Kafka)
+			AddHealthCheck("kafka", kafkaTransport.Ping)
+			transport = kafkaTransport
+		}
+	})
+	return transport
+}
+
+// GetPublisher returns the publisher shared by the process
+func GetPublisher() Publisher {
+	publisherOnce.Do(func() {
+		publisher = getTransport().NewPublisher()
+	})
+	return publisher
+}
+
+func Subscribe(topic string, group string) (error, Subscription) {
+	subscribeErr, subscription := getTransport().Subscribe(topic, group)
+	if subscribeErr != nil {
+		return subscribeErr, nil
+	}
+	return nil, &meteredSubscription{Subscription: subscription, topic: topic}
+}
+
+func SubscribeBroadcast(topic string) (error, Subscription) {
+	subscribeErr, subscription := getTransport().SubscribeBroadcast(topic)
+	if subscribeErr != nil {
+		return subscribeErr, nil
+	}
+	return nil, &meteredSubscription{Subscription: subscription, topic: topic}
+}
+
+func SubscribeReplay(topic string, since time.Time) (error, Subscription) {
+	subscribeErr, subscription := getTransport().SubscribeReplay(topic, since)
+	if subscribeErr != nil {
+		return subscribeErr, nil
+	}
+	return nil, &meteredSubscription{Subscription: subscription, topic: topic}
+}
+
+func SendSagaMessage(message *SagaMessage, topic string) error {
+	messageBytes, encodeErr := EncodeSagaMessage(message)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return sendMessageBytes(messageBytes, topic, SagaMessageKey(message))
+}
+
+// SagaMessageKey is the key of the saga messages of an order, so all messages
+// of its sagas are read in order. The start of a saga has no saga ID yet.
+func SagaMessageKey(message *SagaMessage) string {
+	if message.Order.OrderID != "" {
+		return message.Order.OrderID
+	}
+	return strconv.FormatInt(message.SagaID, 10)
+}
+
+func sendMessageBytes(messageBytes []byte, topic string, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	publishErr := GetPublisher().Publish(ctx, topic, key, messageBytes)
+	if publishErr != nil {
+		return fmt.Errorf("publish to %s: %w", topic, publishErr)
+	}
+	messagesProduced.WithLabelValues(ServiceName, topic).Inc()
+	return nil
+}
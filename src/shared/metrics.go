@@ -0,0 +1,157 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The metrics of all services, served on /metrics by InstrumentRouter. In the
+// local mode all services share one registry, so every /metrics serves all of
+// them.
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "route", "method", "status"})
+
+	messagesProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messages_produced_total",
+		Help: "Messages published by topic.",
+	}, []string{"service", "topic"})
+
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messages_consumed_total",
+		Help: "Messages received by topic.",
+	}, []string{"service", "topic"})
+
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "messages_consumer_lag",
+		Help: "Messages behind the end of the partition or queue when the last message of the topic was received.",
+	}, []string{"service", "topic"})
+
+	mongoOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_operation_duration_seconds",
+		Help:    "Latency of the Mongo commands by shard index.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "shard", "command", "result"})
+)
+
+// InstrumentRouter traces every route of the router, records its latency and
+// status code, attaches the IDs of the route to the records logged with the
+// request context and serves the metrics of the process on /metrics and its
+// probes on /healthz and /readyz.
+func InstrumentRouter(router *mux.Router, service string) {
+	router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	addHealthRoutes(router)
+	router.Use(otelhttp.NewMiddleware(service,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeTemplate(r)
+		}),
+		// the probes of k8s would be most of the traces
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != healthzPath && r.URL.Path != readyzPath
+		}),
+	))
+	router.Use(logRequestFields)
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			httpRequestDuration.WithLabelValues(service, routeTemplate(r), r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+		})
+	})
+}
+
+// routeTemplate returns the template of the matched route, not the path, so
+// IDs do not become labels or span names
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, templateErr := current.GetPathTemplate(); templateErr == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// meteredSubscription counts the messages received on its topic
+type meteredSubscription struct {
+	Subscription
+	topic string
+}
+
+func (subscription *meteredSubscription) Receive(ctx context.Context) (error, *Message) {
+	receiveErr, m := subscription.Subscription.Receive(ctx)
+	if receiveErr == nil {
+		messagesConsumed.WithLabelValues(ServiceName, subscription.topic).Inc()
+		consumerLag.WithLabelValues(ServiceName, subscription.topic).Set(float64(m.Lag))
+	}
+	return receiveErr, m
+}
+
+// MongoMonitor records the latency of the commands sent to one shard of a
+// service, and traces the commands sent in a traced context
+func MongoMonitor(service string, shard int) *event.CommandMonitor {
+	shardLabel := strconv.Itoa(shard)
+	// spans of the running commands by request ID
+	var spans sync.Map
+	endSpan := func(requestID int64, err error) {
+		if span, found := spans.LoadAndDelete(requestID); found {
+			EndSpan(span.(trace.Span), err)
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, started *event.CommandStartedEvent) {
+			if !TracedContext(ctx) {
+				return
+			}
+			_, span := StartSpan(ctx, "mongo "+started.CommandName,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemMongoDB,
+					semconv.DBNamespace(started.DatabaseName),
+					semconv.DBOperationName(started.CommandName),
+					attribute.Int("db.shard", shard),
+				),
+			)
+			spans.Store(started.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, succeeded *event.CommandSucceededEvent) {
+			endSpan(succeeded.RequestID, nil)
+			mongoOperationDuration.WithLabelValues(service, shardLabel, succeeded.CommandName, "ok").Observe(succeeded.Duration.Seconds())
+		},
+		Failed: func(ctx context.Context, failed *event.CommandFailedEvent) {
+			endSpan(failed.RequestID, errors.New(failed.Failure))
+			// often expected, e.g. duplicate keys of redelivered messages
+			slog.DebugContext(ctx, "Mongo command failed", LogShard, shard, "command", failed.CommandName, LogError, failed.Failure)
+			mongoOperationDuration.WithLabelValues(service, shardLabel, failed.CommandName, "error").Observe(failed.Duration.Seconds())
+		},
+	}
+}
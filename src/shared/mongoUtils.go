@@ -7,7 +7,12 @@ import (
 )
 
 func UpdateRecord(collection *mongo.Collection, filter interface{}, update interface{}) *mongo.SingleResult {
+	return UpdateRecordWithContext(context.Background(), collection, filter, update)
+}
+
+// UpdateRecordWithContext is UpdateRecord in a context, e.g. of a transaction
+func UpdateRecordWithContext(ctx context.Context, collection *mongo.Collection, filter interface{}, update interface{}) *mongo.SingleResult {
 	options := options.FindOneAndUpdate().SetUpsert(true)
-	result := collection.FindOneAndUpdate(context.Background(), filter, update, options)
+	result := collection.FindOneAndUpdate(ctx, filter, update, options)
 	return result
 }
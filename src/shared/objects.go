@@ -1,14 +1,137 @@
 package shared
 
-import "github.com/google/uuid"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
 
 type Order struct {
-	ID        uuid.UUID `bson:"_id"`
-	OrderID   string    `json:"order_id"`
-	Paid      bool      `json:"paid"`
-	Items     []string  `json:"items"`
-	UserID    string    `json:"user_id"`
-	TotalCost int64     `json:"total_cost"`
+	ID        uuid.UUID  `bson:"_id"`
+	OrderID   string     `json:"order_id"`
+	Paid      bool       `json:"paid"`
+	Cancelled bool       `json:"cancelled"`
+	Items     OrderItems `json:"items"`
+	UserID    string     `json:"user_id"`
+	TotalCost int64      `json:"total_cost"`
+	// the items when the order was marked paid, the cancel saga restocks them
+	PaidItems OrderItems `json:"paid_items,omitempty" bson:"paid_items,omitempty"`
+	// the checkout in progress, it travels with the order through the saga
+	Checkout *OrderCheckout `json:"checkout,omitempty" bson:"checkout,omitempty"`
+	// when the cancel saga of the order started, so no second one starts. The
+	// cancel step of the saga clears it.
+	Cancelling *time.Time `json:"cancelling,omitempty" bson:"cancelling,omitempty"`
+	// the latest saga steps that changed the order, see UpdateOnceForSagaStep
+	SagaSteps []string `json:"-" bson:"sagasteps,omitempty"`
+}
+
+// OrderCheckout marks a running checkout saga of an order, so no second one
+// starts. The result of the saga clears it.
+type OrderCheckout struct {
+	CheckoutID string    `json:"checkout_id"`
+	Started    time.Time `json:"started"`
+}
+
+type OrderItem struct {
+	ItemID    string `json:"item_id"`
+	Quantity  int64  `json:"quantity"`
+	UnitPrice int64  `json:"unit_price"`
+}
+
+// OrderItems are the line items of an order. Orders stored and sent before
+// line items listed the item ID once per unit, they are read as lines without
+// a unit price.
+type OrderItems []OrderItem
+
+func (items *OrderItems) UnmarshalJSON(data []byte) error {
+	var elements []json.RawMessage
+	unmarshalErr := json.Unmarshal(data, &elements)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if elements == nil {
+		*items = nil
+		return nil
+	}
+
+	lines := legacyLines{items: OrderItems{}}
+	for _, element := range elements {
+		var itemID string
+		if json.Unmarshal(element, &itemID) == nil {
+			lines.addUnit(itemID)
+			continue
+		}
+		var line OrderItem
+		unmarshalErr = json.Unmarshal(element, &line)
+		if unmarshalErr != nil {
+			return unmarshalErr
+		}
+		lines.add(line)
+	}
+	*items = lines.items
+	return nil
+}
+
+func (items *OrderItems) UnmarshalBSONValue(valueType bsontype.Type, data []byte) error {
+	if valueType == bsontype.Null || valueType == bsontype.Undefined {
+		*items = nil
+		return nil
+	}
+	if valueType != bsontype.Array {
+		return fmt.Errorf("cannot decode %s into order items", valueType)
+	}
+	// an array is encoded as a document with the indexes as keys
+	elements, valuesErr := bson.Raw(data).Values()
+	if valuesErr != nil {
+		return valuesErr
+	}
+
+	lines := legacyLines{items: OrderItems{}}
+	for _, element := range elements {
+		if itemID, isString := element.StringValueOK(); isString {
+			lines.addUnit(itemID)
+			continue
+		}
+		var line OrderItem
+		unmarshalErr := element.Unmarshal(&line)
+		if unmarshalErr != nil {
+			return unmarshalErr
+		}
+		lines.add(line)
+	}
+	*items = lines.items
+	return nil
+}
+
+// legacyLines merge the units of the legacy item IDs into lines, in the order
+// the items first appear
+type legacyLines struct {
+	items OrderItems
+	index map[string]int
+}
+
+func (lines *legacyLines) addUnit(itemID string) {
+	lines.add(OrderItem{ItemID: itemID, Quantity: 1})
+}
+
+func (lines *legacyLines) add(line OrderItem) {
+	if lines.index == nil {
+		lines.index = map[string]int{}
+	}
+	i, found := lines.index[line.ItemID]
+	if !found {
+		lines.index[line.ItemID] = len(lines.items)
+		lines.items = append(lines.items, line)
+		return
+	}
+	lines.items[i].Quantity += line.Quantity
+	if lines.items[i].UnitPrice == 0 {
+		lines.items[i].UnitPrice = line.UnitPrice
+	}
 }
 
 type Item struct {
@@ -16,6 +139,8 @@ type Item struct {
 	ItemID string    `json:"item_id"`
 	Stock  int64     `json:"stock"`
 	Price  int64     `json:"price"`
+	// the latest saga steps that changed the item, see UpdateOnceForSagaStep
+	SagaSteps []string `json:"-" bson:"sagasteps,omitempty"`
 }
 
 type User struct {
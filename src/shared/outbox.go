@@ -0,0 +1,277 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const OUTBOX_RELAY_INTERVAL = 100 * time.Millisecond
+const outboxRelayBatchSize = 100
+
+// OutboxEntry is the reply to a saga step, written in the same transaction as
+// the business update of the step. It is published by the outbox relay.
+type OutboxEntry struct {
+	ID       string    `bson:"_id"`
+	SagaID   int64     `bson:"sagaid"`
+	ShardKey string    `bson:"shardkey"`
+	Key      string    `bson:"key"`
+	Name     string    `bson:"name"`
+	Topic    string    `bson:"topic"`
+	Message  string    `bson:"message"`
+	Sent     bool      `bson:"sent"`
+	Created  time.Time `bson:"created"`
+}
+
+var errSagaStepDone = errors.New("saga step already done")
+var errSagaStepRunning = errors.New("saga step is still running")
+
+// RunSagaStepWithOutbox runs a saga step in a transaction on the database of
+// the outbox and writes its reply into the outbox in the same transaction. An
+// error of the step aborts the transaction without answering. A redelivered
+// step is not run again; its reply is queued to be sent again. The entry is
+// stored with shardKey, the key the outbox is sharded by. The reply continues
+// the trace of traceCtx.
+func RunSagaStepWithOutbox(traceCtx context.Context, outbox *mongo.Collection, shardKey string, message *SagaMessage, topic string, step func(ctx mongo.SessionContext) (error, *SagaMessage)) error {
+	session, sessionErr := outbox.Database().Client().StartSession()
+	if sessionErr != nil {
+		return sessionErr
+	}
+	defer session.EndSession(traceCtx)
+
+	entryID := SagaStepID(message)
+	_, txErr := session.WithTransaction(traceCtx, func(ctx mongo.SessionContext) (interface{}, error) {
+		findErr := outbox.FindOne(ctx, bson.M{"_id": entryID}).Err()
+		if findErr == nil {
+			return nil, errSagaStepDone
+		}
+		if !errors.Is(findErr, mongo.ErrNoDocuments) {
+			return nil, findErr
+		}
+
+		stepErr, reply := step(ctx)
+		if stepErr != nil {
+			return nil, stepErr
+		}
+		if reply == nil {
+			return nil, errors.New("saga step without reply")
+		}
+
+		reply.ReplyTo = ReplyTopic(topic)
+		InjectTraceContext(traceCtx, reply)
+		messageBytes, encodeErr := EncodeSagaMessage(reply)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		entry := OutboxEntry{
+			ID:       entryID,
+			SagaID:   message.SagaID,
+			ShardKey: shardKey,
+			Key:      SagaMessageKey(reply),
+			Name:     reply.Name,
+			Topic:    topic,
+			Message:  string(messageBytes),
+			Created:  time.Now().UTC(),
+		}
+		_, insertErr := outbox.InsertOne(ctx, entry)
+		return nil, insertErr
+	})
+
+	if errors.Is(txErr, errSagaStepDone) {
+		slog.InfoContext(traceCtx, "Saga step already done, sending its reply again", "step", entryID)
+		_, updateErr := outbox.UpdateOne(traceCtx, bson.M{"_id": entryID}, bson.M{"$set": bson.M{"sent": false}})
+		return updateErr
+	}
+	return txErr
+}
+
+// FenceSagaStepInOutbox is FenceSagaStep for the steps that reply through the
+// outbox, in the transaction of ctx. A step without an entry gets the abort as
+// its entry, marked sent, so a late delivery of the step sends the abort again
+// instead of running. It returns the name of the reply of the step.
+func FenceSagaStepInOutbox(ctx mongo.SessionContext, outbox *mongo.Collection, shardKey string, message *SagaMessage, stepName string, topic string) (error, string) {
+	entryID := SagaStepIDOf(message.SagaID, stepName)
+	var entry OutboxEntry
+	findErr := outbox.FindOne(ctx, bson.M{"_id": entryID}).Decode(&entry)
+	if findErr == nil {
+		return nil, entry.Name
+	}
+	// a duplicate insert would abort the transaction, look first
+	if !errors.Is(findErr, mongo.ErrNoDocuments) {
+		return findErr, ""
+	}
+
+	reply := fencedReply(message, stepName, topic)
+	messageBytes, encodeErr := EncodeSagaMessage(reply)
+	if encodeErr != nil {
+		return encodeErr, ""
+	}
+	entry = OutboxEntry{
+		ID:       entryID,
+		SagaID:   message.SagaID,
+		ShardKey: shardKey,
+		Key:      SagaMessageKey(reply),
+		Name:     reply.Name,
+		Topic:    topic,
+		Message:  string(messageBytes),
+		Sent:     true,
+		Created:  time.Now().UTC(),
+	}
+	_, insertErr := outbox.InsertOne(ctx, entry)
+	if insertErr != nil {
+		return insertErr, ""
+	}
+	return nil, entry.Name
+}
+
+// fencedReply is the reply of the step stepName of the saga of message when it
+// is fenced
+func fencedReply(message *SagaMessage, stepName string, topic string) *SagaMessage {
+	step := *message
+	step.Name = stepName
+	reply := SagaMessageConvertStartToEnd(&step)
+	reply.Name = SagaAbortName(message)
+	reply.ReplyTo = ReplyTopic(topic)
+	return reply
+}
+
+// MemoryOutbox is RunSagaStepWithOutbox for services that keep their data in
+// memory. The caller has to make the step atomic, the reply is sent right away.
+type MemoryOutbox struct {
+	mu      sync.Mutex
+	replies map[string]*SagaMessage
+	// the steps in flight, a redelivery while they run is not answered
+	running map[string]bool
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{replies: map[string]*SagaMessage{}, running: map[string]bool{}}
+}
+
+func (outbox *MemoryOutbox) RunSagaStep(ctx context.Context, message *SagaMessage, topic string, step func() (error, *SagaMessage)) error {
+	entryID := SagaStepID(message)
+	outbox.mu.Lock()
+	reply, done := outbox.replies[entryID]
+	running := outbox.running[entryID]
+	if !done && !running {
+		outbox.running[entryID] = true
+	}
+	outbox.mu.Unlock()
+	if done {
+		slog.InfoContext(ctx, "Saga step already done, sending its reply again", "step", entryID)
+		return sendReply(reply, topic)
+	}
+	if running {
+		slog.InfoContext(ctx, "Saga step is already running", "step", entryID)
+		return nil
+	}
+	defer func() {
+		outbox.mu.Lock()
+		delete(outbox.running, entryID)
+		outbox.mu.Unlock()
+	}()
+
+	stepErr, reply := step()
+	if stepErr != nil {
+		return stepErr
+	}
+	if reply == nil {
+		return errors.New("saga step without reply")
+	}
+	reply.ReplyTo = ReplyTopic(topic)
+	InjectTraceContext(ctx, reply)
+
+	outbox.mu.Lock()
+	outbox.replies[entryID] = reply
+	outbox.mu.Unlock()
+	return sendReply(reply, topic)
+}
+
+// FenceSagaStep is FenceSagaStepInOutbox for the replies in memory
+func (outbox *MemoryOutbox) FenceSagaStep(message *SagaMessage, stepName string, topic string) (error, string) {
+	entryID := SagaStepIDOf(message.SagaID, stepName)
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	if reply, done := outbox.replies[entryID]; done {
+		return nil, reply.Name
+	}
+	if outbox.running[entryID] {
+		return errSagaStepRunning, ""
+	}
+	reply := fencedReply(message, stepName, topic)
+	outbox.replies[entryID] = reply
+	return nil, reply.Name
+}
+
+func sendReply(reply *SagaMessage, topic string) error {
+	return SendSagaMessage(reply, topic)
+}
+
+// StartOutboxRelay publishes the pending entries of the outboxes in the order
+// they were written and marks them sent. An entry may be published more than
+// once, e.g. by several replicas, the lockmaster ignores duplicate replies.
+func StartOutboxRelay(outboxes []*mongo.Collection) {
+	for _, outbox := range outboxes {
+		index := mongo.IndexModel{Keys: bson.D{{Key: "sent", Value: 1}, {Key: "created", Value: 1}}}
+		_, indexErr := outbox.Indexes().CreateOne(context.Background(), index)
+		if indexErr != nil {
+			slog.Error("Create outbox index error", LogError, indexErr)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(OUTBOX_RELAY_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, outbox := range outboxes {
+				relayOutbox(outbox)
+			}
+		}
+	}()
+}
+
+func relayOutbox(outbox *mongo.Collection) {
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created", Value: 1}}).
+		SetLimit(outboxRelayBatchSize)
+	cursor, findErr := outbox.Find(context.Background(), bson.M{"sent": false}, findOptions)
+	if findErr != nil {
+		slog.Error("Read outbox error", LogError, findErr)
+		return
+	}
+	var entries []OutboxEntry
+	decodeErr := cursor.All(context.Background(), &entries)
+	if decodeErr != nil {
+		slog.Error("Decode outbox error", LogError, decodeErr)
+		return
+	}
+
+	for _, entry := range entries {
+		slog.Debug("Sending outbox message", LogTopic, entry.Topic, "message", entry.Name, LogSagaID, entry.SagaID)
+		key := entry.Key
+		if key == "" {
+			// written before entries had a key
+			key = strconv.FormatInt(entry.SagaID, 10)
+		}
+		sendErr := sendMessageBytes([]byte(entry.Message), entry.Topic, key)
+		if sendErr != nil {
+			// retry on the next tick, the entry stays pending
+			slog.Warn("Send outbox message error", LogTopic, entry.Topic, LogSagaID, entry.SagaID, LogError, sendErr)
+			return
+		}
+
+		filter := bson.M{"_id": entry.ID, "sent": false}
+		update := bson.M{"$set": bson.M{"sent": true}}
+		_, updateErr := outbox.UpdateOne(context.Background(), filter, update)
+		if updateErr != nil {
+			slog.Error("Mark outbox message sent error", "entry", entry.ID, LogError, updateErr)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SAGA_LANES is how many saga messages of a topic are handled at once. The
+// messages of a key are handled in order on the same lane, so a message that
+// is tried again with backoff only holds up the keys of its lane.
+const SAGA_LANES = 16
+
+// SagaAction handles a saga message and returns the reply and the topic to
+// send it to, or no reply. An error is tried again with backoff and the
+// message is dead-lettered when it keeps failing.
+type SagaAction func(ctx context.Context, message *SagaMessage) (error, *SagaMessage, string)
+
+// SetUpSagaListener receives the saga messages of the services on the
+// transport of the process and sends the replies of action. The lockmaster
+// reads the -ack topics and writes the -syn topics, the other services the
+// other way around. The replicas of a service share a group, so each message
+// is handled by one replica. The action runs in the trace of the message.
+func SetUpSagaListener(services []string, inLockMaster bool, action SagaAction) {
+	subscriptionMap := make(map[string]Subscription)
+
+	var receiveName string
+
+	if inLockMaster {
+		receiveName = "-ack"
+	} else {
+		receiveName = "-syn"
+	}
+
+	for _, serviceName := range services {
+		receiveTopic := serviceName + receiveName
+		subscribeErr, subscription := Subscribe(receiveTopic, ServiceName+"-saga-group")
+		if subscribeErr != nil {
+			Fatal("Subscribe error", LogTopic, receiveTopic, LogError, subscribeErr)
+		}
+		subscriptionMap[receiveTopic] = subscription
+		defer subscription.Close()
+	}
+	// the service is ready once it receives its saga messages
+	MarkReady()
+
+	// Create a context to control the consumer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle OS signals for graceful termination
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	for topic, subscription := range subscriptionMap {
+		go func(topic string, subscription Subscription) {
+			topicCtx := WithLogFields(ctx, slog.String(LogTopic, topic))
+			deadLetterService := "lockmaster"
+			if !inLockMaster {
+				deadLetterService = strings.TrimSuffix(topic, receiveName)
+			}
+			commits := newCommitQueue(subscription)
+			lanes := startLanes(ctx, func(m *Message) {
+				handleReceivedMessage(topicCtx, m, topic, deadLetterService, action)
+				// handled, replied to or dead-lettered
+				commits.done(topicCtx, m)
+			})
+
+			for {
+				select {
+				case <-signals:
+					slog.InfoContext(topicCtx, "Received interrupt signal, shutting down")
+					return
+				default:
+					receiveErr, m := subscription.Receive(ctx)
+					if receiveErr != nil {
+						if errors.Is(receiveErr, context.Canceled) {
+							slog.InfoContext(topicCtx, "Consumer context canceled, shutting down")
+							return
+						}
+						slog.ErrorContext(topicCtx, "Read message error", LogError, receiveErr)
+						continue
+					}
+
+					slog.DebugContext(topicCtx, "Received message", "payload", string(m.Value))
+					commits.add(m)
+					select {
+					case lanes[laneOf(m.Key)] <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(topic, subscription)
+	}
+
+	// Wait for termination signal
+	<-signals
+	slog.Info("Received interrupt signal, shutting down")
+}
+
+// handleReceivedMessage runs action on a received saga message and sends its
+// reply. An action that fails or panics and a reply that cannot be sent are
+// tried again with backoff. A message that cannot be parsed or keeps failing
+// is sent to the dead-letter topic of service instead of being dropped. Every
+// attempt is a span in the trace of the message, the reply continues it. The
+// records logged by action carry the topic, saga and order of the message.
+func handleReceivedMessage(ctx context.Context, m *Message, topic string, service string, action SagaAction) {
+	parseErr, _ := ParseSagaMessage(string(m.Value))
+	if parseErr != nil {
+		sendDeadLetter(ctx, service, m, fmt.Errorf("parse: %w", parseErr), 1)
+		return
+	}
+
+	var message, returnMessage *SagaMessage
+	var senderName string
+	var actionCtx context.Context
+	actionErr, attempts := retryWithBackoff(ctx, func() error {
+		// parse again, a failed attempt may have changed the message
+		_, message = ParseSagaMessage(string(m.Value))
+		var span trace.Span
+		actionCtx, span = startSagaSpan(ExtractTraceContext(withMessageLogFields(ctx, topic, message), message), topic, message)
+		var runErr error
+		runErr, returnMessage, senderName = runAction(actionCtx, action, message)
+		EndSpan(span, runErr)
+		return runErr
+	})
+	if actionErr != nil {
+		sendDeadLetter(actionCtx, service, m, actionErr, attempts)
+		return
+	}
+
+	if returnMessage == nil || senderName == "" {
+		return
+	}
+
+	if returnMessage.CorrelationID == "" {
+		returnMessage.CorrelationID = message.CorrelationID
+	}
+	returnMessage.ReplyTo = ReplyTopic(senderName)
+	InjectTraceContext(actionCtx, returnMessage)
+
+	// the lockmaster creates the saga of a START message
+	sendCtx := WithLogFields(actionCtx, slog.Int64(LogSagaID, returnMessage.SagaID))
+	slog.DebugContext(sendCtx, "Sending message", "to_topic", senderName, "message", returnMessage.Name)
+
+	sendErr, sendAttempts := retryWithBackoff(sendCtx, func() error {
+		return SendSagaMessage(returnMessage, senderName)
+	})
+	if sendErr != nil {
+		sendDeadLetter(sendCtx, service, m, sendErr, sendAttempts)
+	}
+}
+
+// runAction returns a panic of action as an error
+func runAction(ctx context.Context, action SagaAction, message *SagaMessage) (actionErr error, returnMessage *SagaMessage, senderName string) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			actionErr = fmt.Errorf("action panicked: %v", recovered)
+		}
+	}()
+	return action(ctx, message)
+}
+
+// startLanes starts SAGA_LANES goroutines that handle the messages sent to
+// them until ctx is done. A lane queues some messages, receiving only waits
+// when the lane of a message is full.
+func startLanes(ctx context.Context, handle func(m *Message)) []chan *Message {
+	lanes := make([]chan *Message, SAGA_LANES)
+	for i := range lanes {
+		lanes[i] = make(chan *Message, 64)
+		go func(lane chan *Message) {
+			for {
+				select {
+				case m := <-lane:
+					handle(m)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(lanes[i])
+	}
+	return lanes
+}
+
+// laneOf returns the lane of the messages of key
+func laneOf(key string) int {
+	return int(crc32.ChecksumIEEE([]byte(key)) % SAGA_LANES)
+}
+
+// commitQueue commits the messages of a subscription, which are handled out
+// of order on the lanes. A commit covers the earlier messages of the
+// partition, so a message is committed once it and every message received
+// before it on its partition are handled.
+type commitQueue struct {
+	mu           sync.Mutex
+	subscription Subscription
+	// received messages of every partition that are not committed yet, in
+	// the order they were received
+	pending map[int][]*pendingCommit
+}
+
+type pendingCommit struct {
+	m    *Message
+	done bool
+}
+
+func newCommitQueue(subscription Subscription) *commitQueue {
+	return &commitQueue{subscription: subscription, pending: map[int][]*pendingCommit{}}
+}
+
+// add queues a received message before it is handled
+func (queue *commitQueue) add(m *Message) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.pending[m.Partition] = append(queue.pending[m.Partition], &pendingCommit{m: m})
+}
+
+// done marks the message handled and commits the handled messages at the
+// start of its partition
+func (queue *commitQueue) done(ctx context.Context, m *Message) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	pending := queue.pending[m.Partition]
+	for _, commit := range pending {
+		if commit.m == m {
+			commit.done = true
+			break
+		}
+	}
+	var last *Message
+	for len(pending) > 0 && pending[0].done {
+		last = pending[0].m
+		pending = pending[1:]
+	}
+	queue.pending[m.Partition] = pending
+	if last == nil {
+		return
+	}
+	// committed in order, a later commit must not be overtaken
+	commitErr := queue.subscription.Commit(ctx, last)
+	if commitErr != nil {
+		slog.ErrorContext(ctx, "Commit message error", LogError, commitErr)
+	}
+}
+
+// ReplyTopic returns the topic a participant answers on for a message sent by
+// the lockmaster, or an empty string for topics nobody replies to.
+func ReplyTopic(topic string) string {
+	if !strings.HasSuffix(topic, "-syn") {
+		return ""
+	}
+	return strings.TrimSuffix(topic, "-syn") + "-ack"
+}
@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingSubscription records the offsets committed on it
+type recordingSubscription struct {
+	Subscription
+	committed []int64
+}
+
+func (subscription *recordingSubscription) Commit(ctx context.Context, m *Message) error {
+	subscription.committed = append(subscription.committed, m.Offset)
+	return nil
+}
+
+func TestCommitQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		// offsets of partition 0 in the order they are handled
+		handled       []int64
+		wantCommitted []int64
+	}{
+		{name: "in order", handled: []int64{0, 1, 2}, wantCommitted: []int64{0, 1, 2}},
+		{name: "later message first", handled: []int64{2, 0, 1}, wantCommitted: []int64{0, 2}},
+		{name: "earlier message not handled", handled: []int64{1, 2}, wantCommitted: []int64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subscription := &recordingSubscription{}
+			queue := newCommitQueue(subscription)
+			messages := []*Message{{Offset: 0}, {Offset: 1}, {Offset: 2}}
+			for _, m := range messages {
+				queue.add(m)
+			}
+			// another partition is committed on its own
+			other := &Message{Partition: 1, Offset: 7}
+			queue.add(other)
+
+			for _, offset := range test.handled {
+				queue.done(context.Background(), messages[offset])
+			}
+			committed := subscription.committed
+			if len(committed) != len(test.wantCommitted) {
+				t.Fatalf("committed %v, want %v", committed, test.wantCommitted)
+			}
+			for i := range committed {
+				if committed[i] != test.wantCommitted[i] {
+					t.Fatalf("committed %v, want %v", committed, test.wantCommitted)
+				}
+			}
+
+			queue.done(context.Background(), other)
+			if last := subscription.committed[len(subscription.committed)-1]; last != 7 {
+				t.Errorf("committed %d for the other partition, want 7", last)
+			}
+		})
+	}
+}
+
+func TestHandleReceivedMessageDeadLetter(t *testing.T) {
+	UseTransport(NewMemoryTransport())
+	AppConfig = &Config{Messaging: MessagingConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+	subscribeErr, deadLetters := Subscribe(DeadLetterTopic("stock"), "test-dlq-group")
+	if subscribeErr != nil {
+		t.Fatalf("subscribe: %v", subscribeErr)
+	}
+
+	message := &SagaMessage{Name: "START-SUBTRACT-STOCK", SagaID: 1, Order: Order{OrderID: GetNewID().String()}}
+	value, encodeErr := EncodeSagaMessage(message)
+	if encodeErr != nil {
+		t.Fatalf("encode: %v", encodeErr)
+	}
+	attempts := 0
+	action := func(ctx context.Context, message *SagaMessage) (error, *SagaMessage, string) {
+		attempts++
+		return errors.New("database down"), nil, ""
+	}
+
+	handleReceivedMessage(context.Background(), &Message{Topic: "stock-syn", Key: message.Order.OrderID, Value: value}, "stock-syn", "stock", action)
+
+	if attempts != 3 {
+		t.Errorf("action ran %d times, want 3", attempts)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	receiveErr, m := deadLetters.Receive(ctx)
+	if receiveErr != nil {
+		t.Fatalf("no dead letter: %v", receiveErr)
+	}
+	parseErr, deadLetter := ParseDeadLetter(m.Value)
+	if parseErr != nil {
+		t.Fatalf("parse dead letter: %v", parseErr)
+	}
+	if deadLetter.Attempts != 3 || deadLetter.Topic != "stock-syn" || deadLetter.Error != "database down" {
+		t.Errorf("dead letter %+v, want 3 attempts on stock-syn with the error", deadLetter)
+	}
+}
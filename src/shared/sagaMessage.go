@@ -1,22 +1,127 @@
 package shared
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// Version of the saga message envelope written by EncodeSagaMessage
+const SAGA_MESSAGE_VERSION = 1
+
+// Name of the running service, sent as origin of every saga message
+var ServiceName string
+
 type SagaMessage struct {
 	Name   string
 	SagaID int64
 	Order  Order
+	// Saga the lockmaster runs the step for, steps like READD-STOCK belong to
+	// more than one saga
+	Saga string
+
+	// Envelope metadata, filled in by EncodeSagaMessage when left empty
+	MessageID     string
+	CorrelationID string
+	Origin        string
+	ReplyTo       string
+	Timestamp     time.Time
+	// W3C trace context of the span that sent the message
+	TraceContext map[string]string
+}
+
+type sagaEnvelope struct {
+	Version       int       `json:"version"`
+	MessageID     string    `json:"message_id"`
+	Timestamp     time.Time `json:"timestamp"`
+	CorrelationID string    `json:"correlation_id"`
+	Origin        string    `json:"origin"`
+	ReplyTo       string    `json:"reply_to,omitempty"`
+	Name          string    `json:"name"`
+	SagaID        int64     `json:"saga_id"`
+	Order         Order     `json:"order"`
+	// optional, so it stays version 1
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	Saga         string            `json:"saga,omitempty"`
+}
+
+// EncodeSagaMessage writes the message as the current envelope. The metadata
+// left empty is filled in the envelope only, the message is not changed, so a
+// message sent again gets a new message ID.
+func EncodeSagaMessage(sagaMessage *SagaMessage) ([]byte, error) {
+	message := *sagaMessage
+	if message.MessageID == "" {
+		message.MessageID = GetNewID().String()
+	}
+	if message.CorrelationID == "" {
+		message.CorrelationID = GetNewID().String()
+	}
+	if message.Origin == "" {
+		message.Origin = ServiceName
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now().UTC()
+	}
+
+	return json.Marshal(sagaEnvelope{
+		Version:       SAGA_MESSAGE_VERSION,
+		MessageID:     message.MessageID,
+		Timestamp:     message.Timestamp,
+		CorrelationID: message.CorrelationID,
+		Origin:        message.Origin,
+		ReplyTo:       message.ReplyTo,
+		Name:          message.Name,
+		SagaID:        message.SagaID,
+		Order:         message.Order,
+		TraceContext:  message.TraceContext,
+		Saga:          message.Saga,
+	})
 }
 
 func ParseSagaMessage(message string) (error, *SagaMessage) {
+	trimmed := bytes.TrimSpace([]byte(message))
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseSagaEnvelope(trimmed)
+	}
+	// TODO: remove once no service sends the legacy format anymore
+	return parseLegacySagaMessage(message)
+}
+
+func parseSagaEnvelope(message []byte) (error, *SagaMessage) {
+	var envelope sagaEnvelope
+	unmarshalErr := json.Unmarshal(message, &envelope)
+	if unmarshalErr != nil {
+		return unmarshalErr, nil
+	}
+	if envelope.Version < 1 || envelope.Version > SAGA_MESSAGE_VERSION {
+		return fmt.Errorf("unsupported saga message version: %d", envelope.Version), nil
+	}
+	if envelope.Name == "" {
+		return errors.New("saga message without name"), nil
+	}
+
+	return nil, &SagaMessage{
+		Name:          envelope.Name,
+		SagaID:        envelope.SagaID,
+		Order:         envelope.Order,
+		MessageID:     envelope.MessageID,
+		CorrelationID: envelope.CorrelationID,
+		Origin:        envelope.Origin,
+		ReplyTo:       envelope.ReplyTo,
+		Timestamp:     envelope.Timestamp,
+		TraceContext:  envelope.TraceContext,
+		Saga:          envelope.Saga,
+	}
+}
+
+// parseLegacySagaMessage parses the NAME_SAGAID_ORDERJSON format
+func parseLegacySagaMessage(message string) (error, *SagaMessage) {
 	parts := strings.SplitN(message, "_", 3)
 
-	if len(parts) < 2 {
+	if len(parts) < 3 {
 		return errors.New("not enough parts to scan"), nil
 	}
 
@@ -24,12 +129,10 @@ func ParseSagaMessage(message string) (error, *SagaMessage) {
 
 	unmarshalErr := json.Unmarshal([]byte(parts[2]), &order)
 	if unmarshalErr != nil {
-		fmt.Println("JSON Unmarshal error", unmarshalErr)
 		return unmarshalErr, nil
 	}
 	convErr, sagaIntID := ConvertStringToInt(parts[1])
 	if convErr != nil {
-		fmt.Println("Convert string to int error:", convErr)
 		return convErr, nil
 	}
 
@@ -44,8 +147,20 @@ func SagaMessageConvertStartToEnd(message *SagaMessage) *SagaMessage {
 	parts := strings.Split(message.Name, "-")
 	parts[0] = "END"
 	return &SagaMessage{
-		Name:   strings.Join(parts, "-"),
-		SagaID: message.SagaID,
-		Order:  message.Order,
+		Name:          strings.Join(parts, "-"),
+		SagaID:        message.SagaID,
+		Order:         message.Order,
+		Saga:          message.Saga,
+		CorrelationID: message.CorrelationID,
+	}
+}
+
+// SagaAbortName is the name of the reply that aborts the saga of a START
+// message. Messages that do not name their saga abort the checkout, the
+// lockmaster handles every ABORT of a saga the same way.
+func SagaAbortName(message *SagaMessage) string {
+	if message.Saga == "" {
+		return "ABORT-CHECKOUT-SAGA"
 	}
+	return "ABORT-" + message.Saga
 }
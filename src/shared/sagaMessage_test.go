@@ -0,0 +1,159 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeSagaMessageRoundTrip(t *testing.T) {
+	message := SagaMessage{
+		Name:          "START-SUBTRACT-STOCK",
+		SagaID:        7,
+		Order:         Order{OrderID: "order", UserID: "user", TotalCost: 20, Items: OrderItems{{ItemID: "item", Quantity: 2, UnitPrice: 10}}},
+		Saga:          "CHECKOUT-SAGA",
+		MessageID:     "message",
+		CorrelationID: "correlation",
+		Origin:        "lockmaster",
+		ReplyTo:       "stock-ack",
+		Timestamp:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		TraceContext:  map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+
+	encoded, encodeErr := EncodeSagaMessage(&message)
+	if encodeErr != nil {
+		t.Fatalf("encode: %v", encodeErr)
+	}
+	parseErr, parsed := ParseSagaMessage(string(encoded))
+	if parseErr != nil {
+		t.Fatalf("parse: %v", parseErr)
+	}
+
+	if parsed.Name != message.Name || parsed.SagaID != message.SagaID || parsed.Saga != message.Saga ||
+		parsed.MessageID != message.MessageID || parsed.CorrelationID != message.CorrelationID ||
+		parsed.Origin != message.Origin || parsed.ReplyTo != message.ReplyTo || !parsed.Timestamp.Equal(message.Timestamp) {
+		t.Errorf("parsed %+v, want %+v", parsed, message)
+	}
+	if parsed.Order.OrderID != "order" || parsed.Order.TotalCost != 20 || len(parsed.Order.Items) != 1 || parsed.Order.Items[0] != message.Order.Items[0] {
+		t.Errorf("parsed order %+v, want %+v", parsed.Order, message.Order)
+	}
+	if parsed.TraceContext["traceparent"] != message.TraceContext["traceparent"] {
+		t.Errorf("parsed trace context %v, want %v", parsed.TraceContext, message.TraceContext)
+	}
+}
+
+func TestEncodeSagaMessageDefaults(t *testing.T) {
+	ServiceName = "stock"
+	message := SagaMessage{Name: "END-SUBTRACT-STOCK", SagaID: 7}
+
+	encoded, encodeErr := EncodeSagaMessage(&message)
+	if encodeErr != nil {
+		t.Fatalf("encode: %v", encodeErr)
+	}
+	if message.MessageID != "" || message.CorrelationID != "" || message.Origin != "" || !message.Timestamp.IsZero() {
+		t.Errorf("encode changed the message to %+v", message)
+	}
+
+	_, parsed := ParseSagaMessage(string(encoded))
+	if parsed.MessageID == "" || parsed.CorrelationID == "" || parsed.Origin != "stock" || parsed.Timestamp.IsZero() {
+		t.Errorf("envelope metadata not filled in: %+v", parsed)
+	}
+	reencoded, _ := EncodeSagaMessage(&message)
+	_, reparsed := ParseSagaMessage(string(reencoded))
+	if reparsed.MessageID == parsed.MessageID {
+		t.Errorf("message sent again kept the message ID %s", parsed.MessageID)
+	}
+}
+
+func TestParseSagaMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     string
+		wantErr     bool
+		wantName    string
+		wantSagaID  int64
+		wantOrderID string
+	}{
+		{
+			name:        "envelope",
+			message:     `{"version":1,"message_id":"m","name":"START-MAKE-PAYMENT","saga_id":3,"order":{"order_id":"o"}}`,
+			wantName:    "START-MAKE-PAYMENT",
+			wantSagaID:  3,
+			wantOrderID: "o",
+		},
+		{
+			name:        "envelope after whitespace",
+			message:     "\n " + `{"version":1,"name":"END-MAKE-PAYMENT","saga_id":3,"order":{"order_id":"o"}}`,
+			wantName:    "END-MAKE-PAYMENT",
+			wantSagaID:  3,
+			wantOrderID: "o",
+		},
+		{
+			name:    "newer version",
+			message: `{"version":2,"name":"START-MAKE-PAYMENT","saga_id":3,"order":{}}`,
+			wantErr: true,
+		},
+		{
+			name:    "no version",
+			message: `{"name":"START-MAKE-PAYMENT","saga_id":3,"order":{}}`,
+			wantErr: true,
+		},
+		{
+			name:    "envelope without name",
+			message: `{"version":1,"saga_id":3,"order":{}}`,
+			wantErr: true,
+		},
+		{
+			name:    "broken envelope",
+			message: `{"version":1,`,
+			wantErr: true,
+		},
+		{
+			name:        "legacy",
+			message:     `START-SUBTRACT-STOCK_7_{"order_id":"o","user_id":"u_1"}`,
+			wantName:    "START-SUBTRACT-STOCK",
+			wantSagaID:  7,
+			wantOrderID: "o",
+		},
+		{
+			name:        "legacy without saga",
+			message:     `START-CHECKOUT-SAGA_-1_{"order_id":"o"}`,
+			wantName:    "START-CHECKOUT-SAGA",
+			wantSagaID:  -1,
+			wantOrderID: "o",
+		},
+		{
+			name:    "legacy with too few parts",
+			message: `START-SUBTRACT-STOCK_7`,
+			wantErr: true,
+		},
+		{
+			name:    "legacy with a broken saga ID",
+			message: `START-SUBTRACT-STOCK_x_{"order_id":"o"}`,
+			wantErr: true,
+		},
+		{
+			name:    "legacy with a broken order",
+			message: `START-SUBTRACT-STOCK_7_{"order_id":`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parseErr, parsed := ParseSagaMessage(test.message)
+			if test.wantErr {
+				if parseErr == nil {
+					t.Fatalf("parsed %+v, want an error", parsed)
+				}
+				return
+			}
+			if parseErr != nil {
+				t.Fatalf("parse: %v", parseErr)
+			}
+			if parsed.Name != test.wantName || parsed.SagaID != test.wantSagaID || parsed.Order.OrderID != test.wantOrderID {
+				t.Errorf("parsed %s of saga %d for order %s, want %s of saga %d for order %s",
+					parsed.Name, parsed.SagaID, parsed.Order.OrderID, test.wantName, test.wantSagaID, test.wantOrderID)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SAGA_STEP_LEASE is how long a claimed step may run. A claim that is older
+// and has no reply was left by a crashed process, the next delivery of the
+// step takes it over and runs the step again. The step gets a context that
+// ends with the lease, so a slow run stops writing before that.
+const SAGA_STEP_LEASE = 10 * time.Second
+
+// SAGA_STEPS_KEPT is how many saga steps a document remembers, see
+// UpdateOnceForSagaStep. A step runs again long before that many later steps
+// changed the same document.
+const SAGA_STEPS_KEPT = 100
+
+// SagaStep records that a participant processed a step of a saga. Reply is
+// empty while the step is still running. Steps are sharded by order.
+type SagaStep struct {
+	ID      string    `bson:"_id"`
+	SagaID  int64     `bson:"sagaid"`
+	OrderID string    `bson:"orderid"`
+	Name    string    `bson:"name"`
+	Reply   string    `bson:"reply"`
+	Claimed time.Time `bson:"claimed"`
+}
+
+// SagaStepID is the ID of the step of a message, the same for every delivery
+func SagaStepID(message *SagaMessage) string {
+	return SagaStepIDOf(message.SagaID, message.Name)
+}
+
+func SagaStepIDOf(sagaID int64, name string) string {
+	return strconv.FormatInt(sagaID, 10) + "_" + name
+}
+
+// fencedSagaStep is the record of a step that is aborted before it ran, for
+// FenceSagaStep
+func fencedSagaStep(message *SagaMessage, stepName string, now time.Time) SagaStep {
+	return SagaStep{
+		ID:      SagaStepIDOf(message.SagaID, stepName),
+		SagaID:  message.SagaID,
+		OrderID: message.Order.OrderID,
+		Name:    stepName,
+		Reply:   SagaAbortName(message),
+		Claimed: now,
+	}
+}
+
+// claimTime is the time of a claim as Mongo stores it, a claim is only
+// completed by the run that holds it
+func claimTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// leaseExpired reports whether a step is still running after its lease, so
+// it can be taken over
+func (step *SagaStep) leaseExpired(now time.Time) bool {
+	return step.Reply == "" && step.Claimed.Before(now.Add(-SAGA_STEP_LEASE))
+}
+
+// ClaimSagaStep records the step of a message before it is processed and
+// returns the time of the claim. When the step was claimed before, the
+// existing record is returned and the step must not be processed again,
+// unless its lease expired and it is taken over.
+func ClaimSagaStep(ctx context.Context, collection *mongo.Collection, message *SagaMessage) (error, *SagaStep, time.Time) {
+	now := claimTime()
+	step := SagaStep{
+		ID:      SagaStepID(message),
+		SagaID:  message.SagaID,
+		OrderID: message.Order.OrderID,
+		Name:    message.Name,
+		Claimed: now,
+	}
+	_, insertErr := collection.InsertOne(ctx, step)
+	if insertErr == nil {
+		return nil, nil, now
+	}
+	if !mongo.IsDuplicateKeyError(insertErr) {
+		return insertErr, nil, now
+	}
+
+	var existingStep SagaStep
+	findErr := collection.FindOne(ctx, bson.M{"_id": step.ID}).Decode(&existingStep)
+	if findErr != nil {
+		return findErr, nil, now
+	}
+	if !existingStep.leaseExpired(now) {
+		return nil, &existingStep, now
+	}
+
+	// only one delivery takes the claim over, steps claimed before claims had
+	// a lease have no claimed time
+	filter := bson.M{
+		"_id":   step.ID,
+		"reply": "",
+		"$or": bson.A{
+			bson.M{"claimed": bson.M{"$lt": now.Add(-SAGA_STEP_LEASE)}},
+			bson.M{"claimed": bson.M{"$exists": false}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"claimed": now}}
+	result, updateErr := collection.UpdateOne(ctx, filter, update)
+	if updateErr != nil {
+		return updateErr, nil, now
+	}
+	if result.MatchedCount == 0 {
+		return nil, &existingStep, now
+	}
+	// the changes of the crashed run carry the ID of the step, the new run
+	// does not apply them again
+	slog.WarnContext(ctx, "Taking over saga step of an expired claim", "step", step.ID)
+	return nil, nil, now
+}
+
+// FenceSagaStep keeps the step stepName of the saga of message from running
+// late, before a compensation undoes it. The lockmaster compensates a step
+// that timed out, which may never have arrived. A step that was not claimed,
+// or whose claim expired, is recorded as aborted, a late delivery then only
+// replays the abort. It returns the record of the step: its reply starts with
+// END- when the step ran and is empty while it still runs.
+func FenceSagaStep(ctx context.Context, collection *mongo.Collection, message *SagaMessage, stepName string) (error, *SagaStep) {
+	now := claimTime()
+	fence := fencedSagaStep(message, stepName, now)
+	_, insertErr := collection.InsertOne(ctx, fence)
+	if insertErr == nil {
+		return nil, &fence
+	}
+	if !mongo.IsDuplicateKeyError(insertErr) {
+		return insertErr, nil
+	}
+
+	var existingStep SagaStep
+	findErr := collection.FindOne(ctx, bson.M{"_id": fence.ID}).Decode(&existingStep)
+	if findErr != nil {
+		return findErr, nil
+	}
+	if !existingStep.leaseExpired(now) {
+		return nil, &existingStep
+	}
+
+	filter := bson.M{
+		"_id":   fence.ID,
+		"reply": "",
+		"$or": bson.A{
+			bson.M{"claimed": bson.M{"$lt": now.Add(-SAGA_STEP_LEASE)}},
+			bson.M{"claimed": bson.M{"$exists": false}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"reply": fence.Reply, "claimed": now}}
+	result, updateErr := collection.UpdateOne(ctx, filter, update)
+	if updateErr != nil {
+		return updateErr, nil
+	}
+	if result.MatchedCount == 0 {
+		// taken over by a delivery of the step in between, it runs
+		return nil, &existingStep
+	}
+	slog.WarnContext(ctx, "Fencing saga step of an expired claim", "step", fence.ID)
+	return nil, &fence
+}
+
+// ReleaseSagaStep removes the claim of a step that failed at claimed, so a
+// retry of its message runs the step again. A claim that was taken over stays.
+func ReleaseSagaStep(ctx context.Context, collection *mongo.Collection, message *SagaMessage, claimed time.Time) error {
+	_, deleteErr := collection.DeleteOne(ctx, bson.M{"_id": SagaStepID(message), "reply": "", "claimed": claimed})
+	return deleteErr
+}
+
+// CompleteSagaStep stores the reply of a step claimed at claimed. It reports
+// false when the claim was taken over or fenced in the meantime, the reply of
+// the step is then up to the new owner.
+func CompleteSagaStep(ctx context.Context, collection *mongo.Collection, message *SagaMessage, reply string, claimed time.Time) (error, bool) {
+	filter := bson.M{"_id": SagaStepID(message), "reply": "", "claimed": claimed}
+	update := bson.M{"$set": bson.M{"reply": reply}}
+	result, updateErr := collection.UpdateOne(ctx, filter, update)
+	if updateErr != nil {
+		return updateErr, false
+	}
+	return nil, result.MatchedCount > 0
+}
+
+// UpdateOnceForSagaStep applies update to the document of filter and records
+// the saga step stepID in the document in the same write. A step that runs
+// again, after a crash or when its claim was taken over, then does not change
+// the document twice. It reports whether the document matched, a document
+// that already has the step matches without being changed. Without stepID the
+// update is applied as it is. update must not push to the saga steps itself.
+func UpdateOnceForSagaStep(ctx context.Context, collection *mongo.Collection, documentID any, filter bson.M, update bson.M, stepID string) (error, bool) {
+	if stepID == "" {
+		result, updateErr := collection.UpdateOne(ctx, filter, update)
+		if updateErr != nil {
+			return updateErr, false
+		}
+		return nil, result.MatchedCount > 0
+	}
+
+	stepFilter := bson.M{"$and": bson.A{filter, bson.M{"sagasteps": bson.M{"$ne": stepID}}}}
+	stepUpdate := bson.M{"$push": bson.M{"sagasteps": bson.M{"$each": bson.A{stepID}, "$slice": -SAGA_STEPS_KEPT}}}
+	for operator, fields := range update {
+		stepUpdate[operator] = fields
+	}
+	result, updateErr := collection.UpdateOne(ctx, stepFilter, stepUpdate)
+	if updateErr != nil {
+		return updateErr, false
+	}
+	if result.MatchedCount > 0 {
+		return nil, true
+	}
+	applied, countErr := collection.CountDocuments(ctx, bson.M{"_id": documentID, "sagasteps": stepID})
+	if countErr != nil {
+		return countErr, false
+	}
+	return nil, applied > 0
+}
+
+// HasSagaStep reports whether the saga steps of a document contain stepID, for
+// the stores in memory
+func HasSagaStep(sagaSteps []string, stepID string) bool {
+	for _, sagaStep := range sagaSteps {
+		if sagaStep == stepID {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSagaStep returns a copy of the saga steps of a document with stepID and
+// at most SAGA_STEPS_KEPT steps, like UpdateOnceForSagaStep
+func AddSagaStep(sagaSteps []string, stepID string) []string {
+	added := append(append([]string{}, sagaSteps...), stepID)
+	if len(added) > SAGA_STEPS_KEPT {
+		added = added[len(added)-SAGA_STEPS_KEPT:]
+	}
+	return added
+}
+
+// RunSagaStepOnce runs a saga step at most once per saga, so redelivered
+// messages neither subtract stock nor charge credit twice. A duplicate gets the
+// reply of the first run, or no reply while the first run has not finished.
+// A run that did not finish within SAGA_STEP_LEASE is assumed to have crashed
+// and the step is run again. The step gets a context that ends with the
+// lease and writes its changes with UpdateOnceForSagaStep, so the changes
+// of the first run are not applied again. A step that fails or panics
+// releases its claim and returns the error, so the message is tried again
+// and dead-lettered in the end. A step without reply is left to time out.
+func RunSagaStepOnce(ctx context.Context, collection *mongo.Collection, message *SagaMessage, step func(ctx context.Context) (error, *SagaMessage)) (error, *SagaMessage) {
+	claim := func() (error, *SagaStep, time.Time) {
+		return ClaimSagaStep(ctx, collection, message)
+	}
+	complete := func(reply string, claimed time.Time) (error, bool) {
+		return CompleteSagaStep(ctx, collection, message, reply, claimed)
+	}
+	release := func(claimed time.Time) error {
+		return ReleaseSagaStep(ctx, collection, message, claimed)
+	}
+	return runSagaStepOnce(ctx, claim, complete, release, message, step)
+}
+
+// SagaStepStore records the saga steps a service has run, in Mongo or in
+// memory in local mode.
+type SagaStepStore interface {
+	RunSagaStepOnce(ctx context.Context, message *SagaMessage, step func(ctx context.Context) (error, *SagaMessage)) (error, *SagaMessage)
+	FenceSagaStep(ctx context.Context, message *SagaMessage, stepName string) (error, *SagaStep)
+}
+
+// ShardedSagaSteps are the saga steps of a service on its Mongo shards, each
+// on the shard of its order.
+type ShardedSagaSteps struct {
+	steps *ShardedCollection
+}
+
+func NewShardedSagaSteps(steps *ShardedCollection) *ShardedSagaSteps {
+	return &ShardedSagaSteps{steps: steps}
+}
+
+// RunSagaStepOnce is RunSagaStepOnce on the shard of the order of the message
+func (sagaSteps *ShardedSagaSteps) RunSagaStepOnce(ctx context.Context, message *SagaMessage, step func(ctx context.Context) (error, *SagaMessage)) (error, *SagaMessage) {
+	// ignore error, will not happen
+	_, orderID := ConvertStringToUUID(message.Order.OrderID)
+	moveErr, collection := sagaSteps.steps.Write(*orderID)
+	if moveErr != nil {
+		// a redelivery may miss the step record on the previous shard
+		slog.ErrorContext(ctx, "Move saga steps error", LogError, moveErr)
+		collection = sagaSteps.steps.Get(*orderID)
+	}
+	return RunSagaStepOnce(ctx, collection, message, step)
+}
+
+// FenceSagaStep is FenceSagaStep on the shard of the order of the message
+func (sagaSteps *ShardedSagaSteps) FenceSagaStep(ctx context.Context, message *SagaMessage, stepName string) (error, *SagaStep) {
+	// ignore error, will not happen
+	_, orderID := ConvertStringToUUID(message.Order.OrderID)
+	moveErr, collection := sagaSteps.steps.Write(*orderID)
+	if moveErr != nil {
+		return moveErr, nil
+	}
+	return FenceSagaStep(ctx, collection, message, stepName)
+}
+
+func runSagaStepOnce(ctx context.Context, claim func() (error, *SagaStep, time.Time), complete func(reply string, claimed time.Time) (error, bool), release func(claimed time.Time) error, message *SagaMessage, step func(ctx context.Context) (error, *SagaMessage)) (error, *SagaMessage) {
+	claimErr, previousStep, claimed := claim()
+	if claimErr != nil {
+		return fmt.Errorf("claim saga step: %w", claimErr), nil
+	}
+	if previousStep != nil {
+		if previousStep.Reply == "" {
+			slog.InfoContext(ctx, "Saga step is already running", "step", previousStep.ID)
+			return nil, nil
+		}
+		slog.InfoContext(ctx, "Saga step already done, replaying its reply", "step", previousStep.ID, "reply", previousStep.Reply)
+		returnMessage := SagaMessageConvertStartToEnd(message)
+		returnMessage.Name = previousStep.Reply
+		return nil, returnMessage
+	}
+
+	stepCtx, cancel := context.WithDeadline(ctx, claimed.Add(SAGA_STEP_LEASE))
+	defer cancel()
+	stepErr, returnMessage := runStep(stepCtx, step)
+	if stepErr != nil {
+		// the retry runs the step again, a release that fails leaves the
+		// claim to expire with its lease
+		releaseErr := release(claimed)
+		if releaseErr != nil {
+			slog.ErrorContext(ctx, "Release saga step error", "step", SagaStepID(message), LogError, releaseErr)
+		}
+		return stepErr, nil
+	}
+	if returnMessage == nil {
+		return nil, nil
+	}
+	completeErr, completed := complete(returnMessage.Name, claimed)
+	if completeErr != nil {
+		slog.ErrorContext(ctx, "Complete saga step error", "step", SagaStepID(message), LogError, completeErr)
+		return nil, returnMessage
+	}
+	if !completed {
+		slog.WarnContext(ctx, "Saga step was taken over, leaving the reply to the new run", "step", SagaStepID(message))
+		return nil, nil
+	}
+	return nil, returnMessage
+}
+
+// runStep returns a panic of step as an error
+func runStep(ctx context.Context, step func(ctx context.Context) (error, *SagaMessage)) (stepErr error, returnMessage *SagaMessage) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			stepErr = fmt.Errorf("saga step panicked: %v", recovered)
+		}
+	}()
+	return step(ctx)
+}
+
+// MemorySagaSteps are the saga steps of a service that keeps its data in
+// memory, they are lost with the process.
+type MemorySagaSteps struct {
+	mu    sync.Mutex
+	steps map[string]SagaStep
+}
+
+func NewMemorySagaSteps() *MemorySagaSteps {
+	return &MemorySagaSteps{steps: map[string]SagaStep{}}
+}
+
+// RunSagaStepOnce is RunSagaStepOnce on the steps in memory
+func (sagaSteps *MemorySagaSteps) RunSagaStepOnce(ctx context.Context, message *SagaMessage, step func(ctx context.Context) (error, *SagaMessage)) (error, *SagaMessage) {
+	stepID := SagaStepID(message)
+	claim := func() (error, *SagaStep, time.Time) {
+		sagaSteps.mu.Lock()
+		defer sagaSteps.mu.Unlock()
+		now := claimTime()
+		if existingStep, found := sagaSteps.steps[stepID]; found && !existingStep.leaseExpired(now) {
+			return nil, &existingStep, now
+		}
+		sagaSteps.steps[stepID] = SagaStep{
+			ID:      stepID,
+			SagaID:  message.SagaID,
+			OrderID: message.Order.OrderID,
+			Name:    message.Name,
+			Claimed: now,
+		}
+		return nil, nil, now
+	}
+	complete := func(reply string, claimed time.Time) (error, bool) {
+		sagaSteps.mu.Lock()
+		defer sagaSteps.mu.Unlock()
+		sagaStep := sagaSteps.steps[stepID]
+		if sagaStep.Reply != "" || !sagaStep.Claimed.Equal(claimed) {
+			return nil, false
+		}
+		sagaStep.Reply = reply
+		sagaSteps.steps[stepID] = sagaStep
+		return nil, true
+	}
+	release := func(claimed time.Time) error {
+		sagaSteps.mu.Lock()
+		defer sagaSteps.mu.Unlock()
+		if sagaStep := sagaSteps.steps[stepID]; sagaStep.Reply == "" && sagaStep.Claimed.Equal(claimed) {
+			delete(sagaSteps.steps, stepID)
+		}
+		return nil
+	}
+	return runSagaStepOnce(ctx, claim, complete, release, message, step)
+}
+
+// FenceSagaStep is FenceSagaStep on the steps in memory
+func (sagaSteps *MemorySagaSteps) FenceSagaStep(ctx context.Context, message *SagaMessage, stepName string) (error, *SagaStep) {
+	sagaSteps.mu.Lock()
+	defer sagaSteps.mu.Unlock()
+	now := claimTime()
+	fence := fencedSagaStep(message, stepName, now)
+	if existingStep, found := sagaSteps.steps[fence.ID]; found && !existingStep.leaseExpired(now) {
+		return nil, &existingStep
+	}
+	sagaSteps.steps[fence.ID] = fence
+	return nil, &fence
+}
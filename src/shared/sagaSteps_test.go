@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// expireClaim moves the claim of the step of message back by twice the lease,
+// as if its run crashed
+func expireClaim(sagaSteps *MemorySagaSteps, message *SagaMessage) {
+	sagaSteps.mu.Lock()
+	defer sagaSteps.mu.Unlock()
+	step := sagaSteps.steps[SagaStepID(message)]
+	step.Claimed = step.Claimed.Add(-2 * SAGA_STEP_LEASE)
+	sagaSteps.steps[step.ID] = step
+}
+
+func replyWith(message *SagaMessage, name string) func(ctx context.Context) (error, *SagaMessage) {
+	return func(ctx context.Context) (error, *SagaMessage) {
+		reply := SagaMessageConvertStartToEnd(message)
+		reply.Name = name
+		return nil, reply
+	}
+}
+
+// getReply runs the step of message once and fails the test on an error
+func getReply(t *testing.T, sagaSteps *MemorySagaSteps, message *SagaMessage, step func(ctx context.Context) (error, *SagaMessage)) *SagaMessage {
+	t.Helper()
+	stepErr, reply := sagaSteps.RunSagaStepOnce(context.Background(), message, step)
+	if stepErr != nil {
+		t.Fatalf("run step: %v", stepErr)
+	}
+	return reply
+}
+
+func TestRunSagaStepOnceTakeover(t *testing.T) {
+	sagaSteps := NewMemorySagaSteps()
+	message := &SagaMessage{Name: "START-SUBTRACT-STOCK", SagaID: 1, Order: Order{OrderID: GetNewID().String()}}
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	firstReply := make(chan *SagaMessage)
+	go func() {
+		_, reply := sagaSteps.RunSagaStepOnce(context.Background(), message, func(ctx context.Context) (error, *SagaMessage) {
+			if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+				t.Error("step runs without the deadline of its lease")
+			}
+			close(started)
+			<-finish
+			return replyWith(message, "END-SUBTRACT-STOCK")(ctx)
+		})
+		firstReply <- reply
+	}()
+	<-started
+
+	notRun := func(ctx context.Context) (error, *SagaMessage) {
+		t.Error("step ran while its claim is held")
+		return nil, nil
+	}
+	if reply := getReply(t, sagaSteps, message, notRun); reply != nil {
+		t.Fatalf("duplicate got %s while the step runs, want no reply", reply.Name)
+	}
+
+	expireClaim(sagaSteps, message)
+	reply := getReply(t, sagaSteps, message, replyWith(message, "ABORT-SUBTRACT-STOCK"))
+	if reply == nil || reply.Name != "ABORT-SUBTRACT-STOCK" {
+		t.Fatalf("takeover got %v, want ABORT-SUBTRACT-STOCK", reply)
+	}
+
+	close(finish)
+	if reply := <-firstReply; reply != nil {
+		t.Fatalf("run that lost its claim replied %s", reply.Name)
+	}
+	reply = getReply(t, sagaSteps, message, notRun)
+	if reply == nil || reply.Name != "ABORT-SUBTRACT-STOCK" {
+		t.Fatalf("redelivery got %v, want the reply of the takeover", reply)
+	}
+}
+
+func TestFenceSagaStep(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply of the step before the fence, "running" while it runs and
+		// "expired" when its claim expired
+		step      string
+		wantReply string
+	}{
+		{name: "step never ran", step: "", wantReply: "ABORT-CHECKOUT-SAGA"},
+		{name: "step ran", step: "END-SUBTRACT-STOCK", wantReply: "END-SUBTRACT-STOCK"},
+		{name: "step is running", step: "running", wantReply: ""},
+		{name: "claim of the step expired", step: "expired", wantReply: "ABORT-CHECKOUT-SAGA"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sagaSteps := NewMemorySagaSteps()
+			order := Order{OrderID: GetNewID().String()}
+			stepMessage := &SagaMessage{Name: "START-SUBTRACT-STOCK", SagaID: 1, Order: order}
+			switch test.step {
+			case "":
+			case "running", "expired":
+				getReply(t, sagaSteps, stepMessage, func(ctx context.Context) (error, *SagaMessage) { return nil, nil })
+				if test.step == "expired" {
+					expireClaim(sagaSteps, stepMessage)
+				}
+			default:
+				getReply(t, sagaSteps, stepMessage, replyWith(stepMessage, test.step))
+			}
+
+			compensation := &SagaMessage{Name: "START-READD-STOCK", SagaID: 1, Saga: "CHECKOUT-SAGA", Order: order}
+			fenceErr, step := sagaSteps.FenceSagaStep(context.Background(), compensation, "START-SUBTRACT-STOCK")
+			if fenceErr != nil {
+				t.Fatalf("fence: %v", fenceErr)
+			}
+			if step.Reply != test.wantReply {
+				t.Fatalf("fenced step has reply %q, want %q", step.Reply, test.wantReply)
+			}
+			// a late delivery of the step does not run it
+			if step.Reply != "" {
+				reply := getReply(t, sagaSteps, stepMessage, replyWith(stepMessage, "END-SUBTRACT-STOCK"))
+				if reply == nil || reply.Name != test.wantReply {
+					t.Fatalf("late delivery got %v, want %s", reply, test.wantReply)
+				}
+			}
+		})
+	}
+}
+
+func TestRunSagaStepOnceFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		step func(ctx context.Context) (error, *SagaMessage)
+	}{
+		{name: "step fails", step: func(ctx context.Context) (error, *SagaMessage) { return errors.New("database down"), nil }},
+		{name: "step panics", step: func(ctx context.Context) (error, *SagaMessage) { panic("nil map") }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sagaSteps := NewMemorySagaSteps()
+			message := &SagaMessage{Name: "START-SUBTRACT-STOCK", SagaID: 1, Order: Order{OrderID: GetNewID().String()}}
+
+			stepErr, reply := sagaSteps.RunSagaStepOnce(context.Background(), message, test.step)
+			if stepErr == nil || reply != nil {
+				t.Fatalf("failed step returned %v and %v, want an error", stepErr, reply)
+			}
+			// the claim is released, the retry runs the step
+			reply = getReply(t, sagaSteps, message, replyWith(message, "END-SUBTRACT-STOCK"))
+			if reply == nil || reply.Name != "END-SUBTRACT-STOCK" {
+				t.Fatalf("retry got %v, want END-SUBTRACT-STOCK", reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type ShardingConfig struct {
+	VirtualNodes int                      `yaml:"virtual_nodes" env:"SHARDING_VIRTUAL_NODES"`
+	Services     map[string]ServiceShards `yaml:"services"`
+}
+
+// ServiceShards lists the URIs of the shards, or gives a uri_pattern that is
+// formatted with the shard index for each of the first shards shards.
+type ServiceShards struct {
+	URIs       []string `yaml:"uris"`
+	URIPattern string   `yaml:"uri_pattern"`
+	Shards     int      `yaml:"shards"`
+	// Placement before resharding, nil when the service is not resharding
+	Previous *PreviousShards `yaml:"previous"`
+}
+
+type PreviousShards struct {
+	Shards int `yaml:"shards"`
+	// "ring" (default) or "modulo", the crc32 % shards placement of old
+	Hashing string `yaml:"hashing"`
+}
+
+// ShardMap places the keys of a service on its Mongo shards. While resharding
+// it also knows where keys were placed before.
+type ShardMap struct {
+	URIs     []string
+	current  shardPlacement
+	previous shardPlacement
+	// names the move from the previous to the current placement, a later
+	// resharding is recorded apart from it
+	reshardingName string
+}
+
+func (serviceShards *ServiceShards) shardURIs() []string {
+	if len(serviceShards.URIs) > 0 {
+		return serviceShards.URIs
+	}
+	if serviceShards.URIPattern == "" {
+		return nil
+	}
+	uris := make([]string, serviceShards.Shards)
+	for i := range uris {
+		uris[i] = fmt.Sprintf(serviceShards.URIPattern, i)
+	}
+	return uris
+}
+
+func NewShardMap(config *ShardingConfig, service string) (error, *ShardMap) {
+	serviceShards, found := config.Services[service]
+	uris := serviceShards.shardURIs()
+	if !found || len(uris) == 0 {
+		return fmt.Errorf("no shards configured for %s", service), nil
+	}
+	virtualNodes := config.VirtualNodes
+	if virtualNodes <= 0 {
+		virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+
+	shardMap := ShardMap{
+		URIs:    uris,
+		current: NewHashRing(len(uris), virtualNodes),
+	}
+	previous := serviceShards.Previous
+	if previous == nil {
+		return nil, &shardMap
+	}
+	if previous.Shards <= 0 || previous.Shards > len(uris) {
+		return fmt.Errorf("%s: previous shards must be between 1 and %d", service, len(uris)), nil
+	}
+	switch previous.Hashing {
+	case "", "ring":
+		shardMap.previous = NewHashRing(previous.Shards, virtualNodes)
+	case "modulo":
+		shardMap.previous = moduloPlacement{numShards: previous.Shards}
+	default:
+		return fmt.Errorf("%s: unknown previous hashing %q", service, previous.Hashing), nil
+	}
+	hashing := previous.Hashing
+	if hashing == "" {
+		hashing = "ring"
+	}
+	shardMap.reshardingName = fmt.Sprintf("%d %s to %d ring of %d", previous.Shards, hashing, len(uris), virtualNodes)
+	return nil, &shardMap
+}
+
+func (shardMap *ShardMap) GetShard(key uuid.UUID) int {
+	return shardMap.current.GetShard(key)
+}
+
+func (shardMap *ShardMap) Resharding() bool {
+	return shardMap.previous != nil
+}
+
+// ConnectShards connects to every shard of the map, in order. The latency of
+// the commands is recorded per shard index and every shard is a dependency of
+// the probes.
+func ConnectShards(ctx context.Context, shardMap *ShardMap) (error, []*mongo.Client) {
+	clients := make([]*mongo.Client, len(shardMap.URIs))
+	for i, mongoURL := range shardMap.URIs {
+		slog.Info("Connecting to Mongo shard", LogShard, i)
+		client, connectErr := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL).SetMonitor(MongoMonitor(ServiceName, i)))
+		if connectErr != nil {
+			return connectErr, nil
+		}
+		clients[i] = client
+		AddHealthCheck(fmt.Sprintf("mongo_shard_%d", i), func(ctx context.Context) error {
+			return client.Ping(ctx, readpref.Primary())
+		})
+	}
+	return nil, clients
+}
+
+// ShardedCollection is a collection spread over the shards of a service. Its
+// documents are placed by the uuid in keyField, stored as uuid for "_id" and
+// as string otherwise.
+type ShardedCollection struct {
+	shardMap    *ShardMap
+	keyField    string
+	collections []*mongo.Collection
+	// set once the background pass of any replica moved every document to its
+	// owner
+	resharded atomic.Bool
+}
+
+func NewShardedCollection(shardMap *ShardMap, clients []*mongo.Client, database string, collection string, keyField string) *ShardedCollection {
+	collections := make([]*mongo.Collection, len(clients))
+	for i, client := range clients {
+		collections[i] = client.Database(database).Collection(collection)
+	}
+	return &ShardedCollection{
+		shardMap:    shardMap,
+		keyField:    keyField,
+		collections: collections,
+	}
+}
+
+func (sharded *ShardedCollection) keyFilter(key uuid.UUID) bson.M {
+	if sharded.keyField == "_id" {
+		return bson.M{"_id": key}
+	}
+	return bson.M{sharded.keyField: key.String()}
+}
+
+// All returns the collections of all shards.
+func (sharded *ShardedCollection) All() []*mongo.Collection {
+	return sharded.collections
+}
+
+// Get returns the collection of the shard that owns the key, e.g. to insert a
+// new document.
+func (sharded *ShardedCollection) Get(key uuid.UUID) *mongo.Collection {
+	return sharded.collections[sharded.shardMap.GetShard(key)]
+}
+
+// resharding reports whether documents of the collection may still be on
+// their previous shard
+func (sharded *ShardedCollection) resharding() bool {
+	return sharded.shardMap.Resharding() && !sharded.resharded.Load()
+}
+
+// Read returns the collection to read the documents of a key from. While
+// resharding, that is the previous owner until the documents were moved.
+func (sharded *ShardedCollection) Read(key uuid.UUID) *mongo.Collection {
+	owner := sharded.Get(key)
+	if !sharded.resharding() {
+		return owner
+	}
+	previous := sharded.collections[sharded.shardMap.previous.GetShard(key)]
+	if previous == owner {
+		return owner
+	}
+	count, countErr := owner.CountDocuments(context.Background(), sharded.keyFilter(key), options.Count().SetLimit(1))
+	if countErr != nil || count > 0 {
+		return owner
+	}
+	return previous
+}
+
+// Write returns the collection of the owner of the key to update its
+// documents. While resharding, the documents are moved to the owner first.
+func (sharded *ShardedCollection) Write(key uuid.UUID) (error, *mongo.Collection) {
+	owner := sharded.Get(key)
+	if !sharded.resharding() {
+		return nil, owner
+	}
+	previous := sharded.collections[sharded.shardMap.previous.GetShard(key)]
+	if previous == owner {
+		return nil, owner
+	}
+	moveErr := moveDocuments(previous, owner, sharded.keyFilter(key))
+	if moveErr != nil {
+		return moveErr, nil
+	}
+	return nil, owner
+}
+
+// moveDocuments copies documents to their owner before deleting them, so a
+// document that is moved twice at the same time is neither lost nor doubled.
+// Moves are safe to run again, by Write and the resharding passes alike.
+func moveDocuments(from *mongo.Collection, to *mongo.Collection, filter interface{}) error {
+	cursor, findErr := from.Find(context.Background(), filter)
+	if findErr != nil {
+		return findErr
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		moveErr := moveDocument(from, to, cursor.Current)
+		if moveErr != nil {
+			return moveErr
+		}
+	}
+	return cursor.Err()
+}
+
+var errDocumentChanged = errors.New("document keeps changing on its previous shard")
+
+// moveDocument inserts the document on its owner unless the owner has it, and
+// deletes it from its previous shard only while it is unchanged, the whole
+// document serving as its version. A write that reached the previous shard
+// meanwhile, e.g. from a replica that does not reshard yet, is copied over the
+// copy of the move and the move is tried again.
+func moveDocument(from *mongo.Collection, to *mongo.Collection, document bson.Raw) error {
+	ctx := context.Background()
+	id := document.Lookup("_id")
+	for attempt := 0; attempt < 3; attempt++ {
+		insertIfMissing := bson.M{"$setOnInsert": withoutID(document)}
+		_, upsertErr := to.UpdateOne(ctx, bson.M{"_id": id}, insertIfMissing, options.Update().SetUpsert(true))
+		// a concurrent move inserted it first
+		if upsertErr != nil && !mongo.IsDuplicateKeyError(upsertErr) {
+			return upsertErr
+		}
+
+		deleteResult, deleteErr := from.DeleteOne(ctx, unchangedFilter(document))
+		if deleteErr != nil {
+			return deleteErr
+		}
+		if deleteResult.DeletedCount > 0 {
+			return nil
+		}
+		var changed bson.Raw
+		findErr := from.FindOne(ctx, bson.M{"_id": id}).Decode(&changed)
+		if errors.Is(findErr, mongo.ErrNoDocuments) {
+			// moved by someone else
+			return nil
+		}
+		if findErr != nil {
+			return findErr
+		}
+		// the copy of the owner is only replaced while nobody wrote it
+		_, replaceErr := to.ReplaceOne(ctx, unchangedFilter(document), changed)
+		if replaceErr != nil {
+			return replaceErr
+		}
+		document = changed
+	}
+	return errDocumentChanged
+}
+
+// withoutID returns the fields of the document but its _id, which an upsert
+// takes from its filter
+func withoutID(document bson.Raw) bson.D {
+	elements, _ := document.Elements()
+	fields := make(bson.D, 0, len(elements))
+	for _, element := range elements {
+		if element.Key() == "_id" {
+			continue
+		}
+		fields = append(fields, bson.E{Key: element.Key(), Value: element.Value()})
+	}
+	return fields
+}
+
+// unchangedFilter matches the document only while it is exactly the same
+func unchangedFilter(document bson.Raw) bson.M {
+	return bson.M{
+		"_id":   document.Lookup("_id"),
+		"$expr": bson.M{"$eq": bson.A{"$$ROOT", bson.M{"$literal": document}}},
+	}
+}
+
+func (sharded *ShardedCollection) documentKey(document bson.Raw) (error, uuid.UUID) {
+	value, lookupErr := document.LookupErr(sharded.keyField)
+	if lookupErr != nil {
+		return lookupErr, uuid.Nil
+	}
+	switch value.Type {
+	case bsontype.Binary:
+		_, data := value.Binary()
+		key, parseErr := uuid.FromBytes(data)
+		return parseErr, key
+	case bsontype.String:
+		key, parseErr := uuid.Parse(value.StringValue())
+		return parseErr, key
+	}
+	return errors.New("shard key is neither uuid nor string"), uuid.Nil
+}
+
+// StartResharding moves all documents that are not on the shard of their key
+// in the background. Documents of keys that are written meanwhile are moved
+// by Write. One replica runs the pass of a collection at a time and records
+// in the resharding collection of shard 0 when it is done, the other replicas
+// wait for that, so the pass runs once and not once per replica or restart.
+func StartResharding(collections ...*ShardedCollection) {
+	go func() {
+		for _, sharded := range collections {
+			if !sharded.shardMap.Resharding() {
+				continue
+			}
+			sharded.runResharding()
+		}
+	}()
+}
+
+// RESHARDING_LEASE is how long a replica holds the pass of a collection
+// without renewing it, after that another replica takes it over. Passes that
+// overlap after a takeover are still safe, every move is.
+const RESHARDING_LEASE = time.Minute
+
+const reshardingCheckInterval = 10 * time.Second
+
+// reshardingState records the pass of a collection in the resharding
+// collection of shard 0
+type reshardingState struct {
+	ID      string    `bson:"_id"`
+	Claimed time.Time `bson:"claimed,omitempty"`
+	Done    bool      `bson:"done"`
+}
+
+func (sharded *ShardedCollection) reshardingStates() *mongo.Collection {
+	return sharded.collections[0].Database().Collection("resharding")
+}
+
+func (sharded *ShardedCollection) reshardingID() string {
+	return sharded.collections[0].Name() + ": " + sharded.shardMap.reshardingName
+}
+
+// runResharding waits until the pass of the collection is done, running it
+// whenever no other replica holds it
+func (sharded *ShardedCollection) runResharding() {
+	name := sharded.collections[0].Name()
+	for {
+		claimErr, done, claimed := sharded.claimResharding()
+		if claimErr != nil {
+			slog.Error("Resharding: claim error", "collection", name, LogError, claimErr)
+		} else if done {
+			sharded.resharded.Store(true)
+			slog.Info("Resharding done", "collection", name)
+			return
+		} else if claimed {
+			passed := sharded.reshard()
+			endErr := sharded.endResharding(passed)
+			if endErr != nil {
+				slog.Error("Resharding: record pass error", "collection", name, LogError, endErr)
+			} else if passed {
+				// every document is on its owner now, writes only ever go there
+				sharded.resharded.Store(true)
+				return
+			}
+		}
+		time.Sleep(reshardingCheckInterval)
+	}
+}
+
+// claimResharding takes the pass of the collection unless it is done or
+// another replica holds it
+func (sharded *ShardedCollection) claimResharding() (err error, done bool, claimed bool) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":  sharded.reshardingID(),
+		"done": false,
+		"$or": bson.A{
+			bson.M{"claimed": nil},
+			bson.M{"claimed": bson.M{"$lt": now.Add(-RESHARDING_LEASE)}},
+		},
+	}
+	claim := bson.M{"$set": bson.M{"claimed": now}}
+	_, claimErr := sharded.reshardingStates().UpdateOne(ctx, filter, claim, options.Update().SetUpsert(true))
+	if claimErr == nil {
+		return nil, false, true
+	}
+	// the state exists and did not match, it is done or held
+	if !mongo.IsDuplicateKeyError(claimErr) {
+		return claimErr, false, false
+	}
+	var state reshardingState
+	findErr := sharded.reshardingStates().FindOne(ctx, bson.M{"_id": sharded.reshardingID()}).Decode(&state)
+	if findErr != nil {
+		return findErr, false, false
+	}
+	return nil, state.Done, false
+}
+
+// renewResharding keeps the pass claimed while it runs
+func (sharded *ShardedCollection) renewResharding() error {
+	claim := bson.M{"$set": bson.M{"claimed": time.Now().UTC()}}
+	_, renewErr := sharded.reshardingStates().UpdateOne(context.Background(), bson.M{"_id": sharded.reshardingID()}, claim)
+	return renewErr
+}
+
+// endResharding records the pass done, or releases it to be run again
+func (sharded *ShardedCollection) endResharding(done bool) error {
+	update := bson.M{"$set": bson.M{"done": true}}
+	if !done {
+		update = bson.M{"$unset": bson.M{"claimed": ""}}
+	}
+	_, endErr := sharded.reshardingStates().UpdateOne(context.Background(), bson.M{"_id": sharded.reshardingID()}, update)
+	return endErr
+}
+
+// reshard moves every document to its owner and reports whether all were
+func (sharded *ShardedCollection) reshard() bool {
+	moved := 0
+	failed := 0
+	renewed := time.Now()
+	for shard, collection := range sharded.collections {
+		cursor, findErr := collection.Find(context.Background(), bson.M{})
+		if findErr != nil {
+			slog.Error("Resharding: read shard error", "collection", collection.Name(), LogShard, shard, LogError, findErr)
+			return false
+		}
+		for cursor.Next(context.Background()) {
+			if time.Since(renewed) > RESHARDING_LEASE/3 {
+				renewErr := sharded.renewResharding()
+				if renewErr != nil {
+					slog.Warn("Resharding: renew claim error", "collection", collection.Name(), LogError, renewErr)
+				}
+				renewed = time.Now()
+			}
+			keyErr, key := sharded.documentKey(cursor.Current)
+			if keyErr != nil {
+				slog.Warn("Resharding: document has no shard key", "collection", collection.Name(), LogShard, shard, "document", cursor.Current.Lookup("_id").String(), LogError, keyErr)
+				failed++
+				continue
+			}
+			owner := sharded.shardMap.GetShard(key)
+			if owner == shard {
+				continue
+			}
+			moveErr := moveDocument(collection, sharded.collections[owner], cursor.Current)
+			if moveErr != nil {
+				slog.Error("Resharding: move error", "collection", collection.Name(), LogShard, shard, "to_shard", owner, LogError, moveErr)
+				failed++
+				continue
+			}
+			moved++
+		}
+		cursorErr := cursor.Err()
+		cursor.Close(context.Background())
+		if cursorErr != nil {
+			slog.Error("Resharding: read shard error", "collection", collection.Name(), LogShard, shard, LogError, cursorErr)
+			return false
+		}
+	}
+	if failed > 0 {
+		// keep reading and writing the previous shards of what was not moved
+		slog.Warn("Resharding pass with failures", "collection", sharded.collections[0].Name(), "moved", moved, "failed", failed)
+		return false
+	}
+	slog.Info("Resharding done", "collection", sharded.collections[0].Name(), "moved", moved)
+	return true
+}
@@ -0,0 +1,192 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const testNamespace = "db.orders"
+
+// newTestShardedCollection returns the orders on five shards of the mock
+// client, resharding from crc32 % 3 unless previous is nil
+func newTestShardedCollection(t *testing.T, client *mongo.Client, previous *PreviousShards) *ShardedCollection {
+	t.Helper()
+	config := ShardingConfig{Services: map[string]ServiceShards{
+		"order": {URIPattern: "mongodb://orderdb-%d", Shards: 5, Previous: previous},
+	}}
+	mapErr, shardMap := NewShardMap(&config, "order")
+	if mapErr != nil {
+		t.Fatalf("shard map: %v", mapErr)
+	}
+	clients := []*mongo.Client{client, client, client, client, client}
+	return NewShardedCollection(shardMap, clients, "db", "orders", "_id")
+}
+
+// getMovedKey returns a key whose previous shard is not its owner
+func getMovedKey(sharded *ShardedCollection) uuid.UUID {
+	for {
+		key := GetNewID()
+		if sharded.shardMap.previous.GetShard(key) != sharded.shardMap.GetShard(key) {
+			return key
+		}
+	}
+}
+
+func countResponse(count int) bson.D {
+	if count == 0 {
+		return mtest.CreateCursorResponse(0, testNamespace, mtest.FirstBatch)
+	}
+	return mtest.CreateCursorResponse(0, testNamespace, mtest.FirstBatch, bson.D{{Key: "n", Value: count}})
+}
+
+func TestShardedCollectionRead(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	previous := &PreviousShards{Shards: 3, Hashing: "modulo"}
+
+	tests := []struct {
+		name      string
+		previous  *PreviousShards
+		resharded bool
+		// documents of the key on its owner, -1 when the owner is not asked
+		ownerCount   int
+		wantPrevious bool
+	}{
+		{name: "not resharding", previous: nil, ownerCount: -1},
+		{name: "moved to the owner", previous: previous, ownerCount: 1},
+		{name: "not moved yet", previous: previous, ownerCount: 0, wantPrevious: true},
+		{name: "resharding done", previous: previous, resharded: true, ownerCount: -1},
+	}
+
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			sharded := newTestShardedCollection(mt.T, mt.Client, test.previous)
+			sharded.resharded.Store(test.resharded)
+			key := GetNewID()
+			if test.previous != nil {
+				key = getMovedKey(sharded)
+			}
+			if test.ownerCount >= 0 {
+				mt.AddMockResponses(countResponse(test.ownerCount))
+			}
+
+			read := sharded.Read(key)
+
+			want := sharded.Get(key)
+			if test.wantPrevious {
+				want = sharded.collections[sharded.shardMap.previous.GetShard(key)]
+			}
+			if read != want {
+				mt.Errorf("read from the wrong shard, want the previous shard %v", test.wantPrevious)
+			}
+			if asked := len(mt.GetAllStartedEvents()) > 0; asked != (test.ownerCount >= 0) {
+				mt.Errorf("asked the owner %v, want %v", asked, test.ownerCount >= 0)
+			}
+		})
+	}
+}
+
+func TestShardedCollectionWrite(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("moves the documents of the key first", func(mt *mtest.T) {
+		sharded := newTestShardedCollection(mt.T, mt.Client, &PreviousShards{Shards: 3, Hashing: "modulo"})
+		key := getMovedKey(sharded)
+		document := bson.D{{Key: "_id", Value: key.String()}, {Key: "paid", Value: false}}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, testNamespace, mtest.FirstBatch, document),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		writeErr, written := sharded.Write(key)
+		if writeErr != nil {
+			mt.Fatalf("write: %v", writeErr)
+		}
+		if written != sharded.Get(key) {
+			mt.Errorf("write returned another shard than the owner")
+		}
+
+		commands := []string{}
+		for _, started := range mt.GetAllStartedEvents() {
+			commands = append(commands, started.CommandName)
+			switch started.CommandName {
+			case "update":
+				// inserted only when the owner does not have it
+				update := started.Command.Lookup("updates", "0")
+				if upsert, _ := update.Document().Lookup("upsert").BooleanOK(); !upsert {
+					mt.Errorf("copy is no upsert: %s", update)
+				}
+				if _, setOnInsertErr := update.Document().LookupErr("u", "$setOnInsert"); setOnInsertErr != nil {
+					mt.Errorf("copy does not only set on insert: %s", update)
+				}
+			case "delete":
+				// only deleted while unchanged
+				if _, exprErr := started.Command.LookupErr("deletes", "0", "q", "$expr"); exprErr != nil {
+					mt.Errorf("delete does not match the whole document: %s", started.Command)
+				}
+			}
+		}
+		if len(commands) != 3 || commands[0] != "find" || commands[1] != "update" || commands[2] != "delete" {
+			mt.Errorf("ran %v, want find, update and delete", commands)
+		}
+	})
+
+	mt.Run("owner on the previous shard", func(mt *mtest.T) {
+		sharded := newTestShardedCollection(mt.T, mt.Client, &PreviousShards{Shards: 3, Hashing: "modulo"})
+		var key uuid.UUID
+		for key = GetNewID(); sharded.shardMap.previous.GetShard(key) != sharded.shardMap.GetShard(key); key = GetNewID() {
+		}
+
+		writeErr, written := sharded.Write(key)
+		if writeErr != nil || written != sharded.Get(key) {
+			mt.Fatalf("write returned %v, want the owner", writeErr)
+		}
+		if started := mt.GetAllStartedEvents(); len(started) != 0 {
+			mt.Errorf("ran %d commands, want none", len(started))
+		}
+	})
+}
+
+func TestMoveDocumentChanged(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("copies a change made during the move", func(mt *mtest.T) {
+		from := mt.Client.Database("db").Collection("orders")
+		to := mt.Client.Database("db").Collection("orders")
+		document := bson.D{{Key: "_id", Value: "order"}, {Key: "paid", Value: false}}
+		changed := bson.D{{Key: "_id", Value: "order"}, {Key: "paid", Value: true}}
+		raw, _ := bson.Marshal(document)
+		mt.AddMockResponses(
+			// copy, then the delete misses the changed document
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateCursorResponse(0, testNamespace, mtest.FirstBatch, changed),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			// the change is moved
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		moveErr := moveDocument(from, to, raw)
+		if moveErr != nil {
+			mt.Fatalf("move: %v", moveErr)
+		}
+		commands := []string{}
+		for _, started := range mt.GetAllStartedEvents() {
+			commands = append(commands, started.CommandName)
+		}
+		want := []string{"update", "delete", "find", "update", "update", "delete"}
+		if len(commands) != len(want) {
+			mt.Fatalf("ran %v, want %v", commands, want)
+		}
+		for i := range want {
+			if commands[i] != want[i] {
+				mt.Fatalf("ran %v, want %v", commands, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracingShutdownTimeout = 5 * time.Second
+
+// the global tracer, it follows the provider set by SetUpTracing
+var tracer = otel.Tracer("main")
+
+// HTTPClient sends the trace context of the request along, the services call
+// each other with it
+var HTTPClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// SetUpTracing installs the tracer provider of the service with the exporter
+// of the config, and propagates the W3C trace context. The returned function
+// flushes the spans that are not exported yet.
+func SetUpTracing(service string) func() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporterErr, exporter := newSpanExporter(&AppConfig.Tracing)
+	if exporterErr != nil {
+		Fatal("Set up tracing error", LogError, exporterErr)
+	}
+	if exporter == nil {
+		return func() {}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(AppConfig.Tracing.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		shutdownErr := provider.Shutdown(ctx)
+		if shutdownErr != nil {
+			slog.Error("Flush spans error", LogError, shutdownErr)
+		}
+	}
+}
+
+// newSpanExporter returns the exporter of the config, or nil when tracing is
+// off
+func newSpanExporter(config *TracingConfig) (error, sdktrace.SpanExporter) {
+	switch config.Exporter {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, exporterErr := otlptracehttp.New(context.Background(), options...)
+		return exporterErr, exporter
+	case "stdout":
+		var writer io.Writer = os.Stdout
+		if config.File != "" {
+			file, openErr := os.OpenFile(config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if openErr != nil {
+				return openErr, nil
+			}
+			writer = file
+		}
+		exporter, exporterErr := stdouttrace.New(stdouttrace.WithWriter(writer))
+		return exporterErr, exporter
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", config.Exporter), nil
+	}
+}
+
+// StartSpan starts a span of the service as a child of the span in ctx
+func StartSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, options...)
+}
+
+// EndSpan ends the span, as failed when err is set
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext stores the trace context of ctx in the envelope of the
+// message, so the service that receives it continues the trace
+func InjectTraceContext(ctx context.Context, message *SagaMessage) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		message.TraceContext = carrier
+	}
+}
+
+// ExtractTraceContext returns ctx with the trace context of the message
+func ExtractTraceContext(ctx context.Context, message *SagaMessage) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(message.TraceContext))
+}
+
+// startSagaSpan starts the span of a saga message handled by the service
+func startSagaSpan(ctx context.Context, topic string, message *SagaMessage) (context.Context, trace.Span) {
+	return StartSpan(ctx, message.Name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingDestinationName(topic),
+			attribute.Int64("saga.id", message.SagaID),
+			attribute.String("saga.correlation_id", message.CorrelationID),
+			attribute.String("order.id", message.Order.OrderID),
+		),
+	)
+}
+
+// TracedContext reports whether ctx belongs to a sampled trace, so background
+// work such as polling and resharding does not start traces of its own
+func TracedContext(ctx context.Context) bool {
+	return trace.SpanContextFromContext(ctx).IsSampled()
+}
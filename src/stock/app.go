@@ -1,151 +1,144 @@
-package main
+package stock
 
 import (
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"main/shared"
 )
 
-type ItemChange struct {
-	itemID *uuid.UUID
-	amount int64
-}
-
-var clients [5]*mongo.Client
-var collections [5]*mongo.Collection
-
-func main() {
-	go shared.SetUpKafkaListener(
-		[]string{"stock"}, false,
-		func(message *shared.SagaMessage) (*shared.SagaMessage, string) {
+var itemStore ItemStore
+var sagaSteps shared.SagaStepStore
 
-			returnMessage := shared.SagaMessageConvertStartToEnd(message)
-
-			// TODO: remove code duplication
-
-			if message.Name == "START-SUBTRACT-STOCK" {
-				changes := make([]ItemChange, len(message.Order.Items))
-
-				for i, stringID := range message.Order.Items {
-					// ignore error, will not happen
-					_, itemID := shared.ConvertStringToUUID(stringID)
-
-					changes[i] = ItemChange{
-						itemID: itemID,
-						amount: 1,
-					}
-				}
-
-				clientError, serverError := subtract(changes)
-				if clientError != nil || serverError != nil {
-					returnMessage.Name = "ABORT-CHECKOUT-SAGA"
-				}
-
-				return returnMessage, "stock-ack"
-			}
-
-			if message.Name == "START-READD-STOCK" {
-				changes := make([]ItemChange, len(message.Order.Items))
-
-				for i, stringID := range message.Order.Items {
-					// ignore error, will not happen
-					_, itemID := shared.ConvertStringToUUID(stringID)
-
-					changes[i] = ItemChange{
-						itemID: itemID,
-						amount: 1,
-					}
-				}
-
-				clientError, serverError := add(changes)
-				if clientError != nil || serverError != nil {
-					returnMessage.Name = "ABORT-CHECKOUT-SAGA"
-				}
-
-				return returnMessage, "stock-ack"
-			}
-
-			return nil, ""
-		},
-	)
+// Run serves the stock service on its Mongo shards and Kafka.
+func Run() {
+	shared.ServiceName = "stock"
+	defer shared.SetUpTracing("stock")()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	setupErr := setupDBConnections(ctx)
+	setupErr, shards := connectMongoShards(ctx)
 	if setupErr != nil {
-		log.Fatal(setupErr)
-	}
-	for i := 0; i < 5; i++ {
-		defer clients[i].Disconnect(ctx)
+		shared.Fatal("Connect to the Mongo shards error", shared.LogError, setupErr)
 	}
+	defer shards.disconnect(ctx)
+	itemStore = &mongoItemStore{items: shards.items}
+	sagaSteps = shared.NewShardedSagaSteps(shards.sagaSteps)
+	shards.startResharding()
 
-	router := mux.NewRouter()
-	router.HandleFunc("/find/{item_id}", findHandler)
-	router.HandleFunc("/subtract/{item_id}/{amount}", subtractHandler)
-	router.HandleFunc("/add/{item_id}/{amount}", addHandler)
-	router.HandleFunc("/item/create/{price}", createHandler)
-	router.HandleFunc("/", defaultHandler)
+	go setUpSagaListener()
 
 	port := os.Getenv("PORT")
-	fmt.Printf("Current port is: %s\n", port)
 	if port == "" {
 		port = "8082"
 	}
 
 	// Set the listening address and port for the server
 	addr := fmt.Sprintf(":%s", port)
-	fmt.Printf("Starting stock service at %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, router))
+	slog.Info("Starting stock service", "addr", addr)
+	serveErr := http.ListenAndServe(addr, NewRouter())
+	shared.Fatal("Serve error", shared.LogError, serveErr)
 }
 
-func setupDBConnections(ctx context.Context) error {
-	for i := 0; i < 5; i++ {
-		mongoURL := fmt.Sprintf("mongodb://stockdb-service-%d:27017", i)
-		// mongoURL := "mongodb://localhost:27017"
-		fmt.Printf("%d MongoDB URL: %s", i, mongoURL)
-		var err error
-		var client *mongo.Client
-		client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
-
-		if err != nil {
-			return err
-		}
-		clients[i] = client
-		collections[i] = client.Database("stock").Collection("stock")
-	}
-	return nil
+// StartLocal starts the stock service on in-memory stores and returns its
+// routes, for the local mode.
+func StartLocal() http.Handler {
+	itemStore = newMemoryItemStore()
+	sagaSteps = shared.NewMemorySagaSteps()
+	go setUpSagaListener()
+	return NewRouter()
 }
 
-func getItem(documentID *uuid.UUID) (error, *shared.Item) {
-	stockCollection := getStockCollection(documentID)
-
-	var item shared.Item
-	err := stockCollection.FindOne(context.Background(), bson.M{"_id": documentID}).Decode(&item)
-	if err != nil {
-		return err, nil
-	}
-	item.ID = *documentID
-	item.ItemID = documentID.String()
-	return nil, &item
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+	shared.InstrumentRouter(router, "stock")
+	router.HandleFunc("/find/{item_id}", findHandler)
+	router.HandleFunc("/subtract/{item_id}/{amount}", subtractHandler)
+	router.HandleFunc("/add/{item_id}/{amount}", addHandler)
+	router.HandleFunc("/item/create/{price}", createHandler)
+	router.HandleFunc("/", defaultHandler)
+	return router
 }
 
-func getStockCollection(itemID *uuid.UUID) *mongo.Collection {
-	databaseNum := shared.HashUUID(*itemID)
-	return collections[databaseNum]
+func setUpSagaListener() {
+	shared.SetUpSagaListener(
+		[]string{"stock"}, false,
+		func(ctx context.Context, message *shared.SagaMessage) (error, *shared.SagaMessage, string) {
+
+			returnMessage := shared.SagaMessageConvertStartToEnd(message)
+
+			// TODO: remove code duplication
+
+			// a server error is tried again, the step runs again without
+			// changing an item twice
+
+			if message.Name == "START-SUBTRACT-STOCK" {
+				stepErr, reply := sagaSteps.RunSagaStepOnce(ctx, message, func(ctx context.Context) (error, *shared.SagaMessage) {
+					changes := getItemChanges(message.Order.Items)
+					clientError, serverError := subtract(ctx, itemStore, changes, shared.SagaStepID(message))
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				})
+				return stepErr, reply, "stock-ack"
+			}
+
+			if message.Name == "START-READD-STOCK" && !message.Order.Paid {
+				// the rollback of a checkout, which compensates a SUBTRACT-STOCK
+				// that timed out as well, it may never have run
+				fenceErr, subtractStep := sagaSteps.FenceSagaStep(ctx, message, "START-SUBTRACT-STOCK")
+				if fenceErr != nil {
+					return fmt.Errorf("fence saga step: %w", fenceErr), nil, ""
+				}
+				if subtractStep.Reply == "" {
+					// the lockmaster sends the compensation again when it times out
+					slog.InfoContext(ctx, "Saga step to compensate is still running", "step", subtractStep.ID)
+					return nil, nil, ""
+				}
+				// the items record what the subtract took off them, whatever
+				// its reply
+				stepErr, reply := sagaSteps.RunSagaStepOnce(ctx, message, func(ctx context.Context) (error, *shared.SagaMessage) {
+					changes := getItemChanges(message.Order.Items)
+					serverError := returnSubtracted(ctx, itemStore, changes, subtractStep.ID)
+					if serverError != nil {
+						return serverError, nil
+					}
+					return nil, returnMessage
+				})
+				return stepErr, reply, "stock-ack"
+			}
+
+			if message.Name == "START-READD-STOCK" {
+				stepErr, reply := sagaSteps.RunSagaStepOnce(ctx, message, func(ctx context.Context) (error, *shared.SagaMessage) {
+					changes := getItemChanges(getRestockItems(&message.Order))
+					clientError, serverError := add(ctx, itemStore, changes, shared.SagaStepID(message))
+					if serverError != nil {
+						return serverError, nil
+					}
+					if clientError != nil {
+						returnMessage.Name = shared.SagaAbortName(message)
+					}
+					return nil, returnMessage
+				})
+				return stepErr, reply, "stock-ack"
+			}
+
+			return nil, nil, ""
+		},
+	)
 }
 
 // Functions only used by http
@@ -153,32 +146,29 @@ func getStockCollection(itemID *uuid.UUID) *mongo.Collection {
 func findHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	itemID := vars["item_id"]
-	// fmt.Printf("item ID: %s", itemID)
 
 	convertDocIDErr, documentID := shared.ConvertStringToUUID(itemID)
 	if convertDocIDErr != nil {
-		fmt.Println("CONVERT DOC ERROR")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// fmt.Printf("Find: %s\n", itemID)
-	findErr, item := getItem(documentID)
+	findErr, item := itemStore.GetItem(r.Context(), documentID)
 	if findErr != nil {
-		fmt.Println("GET ITEM ERROR", findErr)
+		slog.InfoContext(r.Context(), "Get item error", shared.LogError, findErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	jsonEncodeErr := json.NewEncoder(w).Encode(item)
 	if jsonEncodeErr != nil {
-		fmt.Println("JSON ENCODE ERROR")
+		slog.ErrorContext(r.Context(), "Encode item error", shared.LogError, jsonEncodeErr)
 		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("defualt greeter of stock")
+	slog.DebugContext(r.Context(), "Default handler of stock", "url", r.URL.String())
 }
 
 func createHandler(w http.ResponseWriter, r *http.Request) {
@@ -186,11 +176,10 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 	price := vars["price"]
 	err, PriceInt := shared.ConvertStringToInt(price)
 	if err != nil {
-		fmt.Println(err)
+		slog.InfoContext(r.Context(), "Invalid price", shared.LogError, err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// fmt.Printf("Creating item with price %s\n", price)
 	documentID := shared.GetNewID()
 	stock := shared.Item{
 		ID:     documentID,
@@ -199,10 +188,9 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 		Price:  *PriceInt,
 	}
 
-	stockCollection := getStockCollection(&documentID)
-	_, insertErr := stockCollection.InsertOne(context.Background(), stock)
+	insertErr := itemStore.CreateItem(r.Context(), &stock)
 	if insertErr != nil {
-		fmt.Println(insertErr)
+		slog.ErrorContext(r.Context(), "Create item error", shared.LogError, insertErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -210,7 +198,7 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	jsonEncodeErr := json.NewEncoder(w).Encode(stock)
 	if jsonEncodeErr != nil {
-		fmt.Println(jsonEncodeErr)
+		slog.ErrorContext(r.Context(), "Encode item error", shared.LogError, jsonEncodeErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -233,11 +221,15 @@ func subtractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientError, serverError := subtract([]ItemChange{{
+	clientError, serverError := subtract(r.Context(), itemStore, []ItemChange{{
 		itemID: documentID,
 		amount: *intAmount,
-	}})
+	}}, "")
 
+	if errors.Is(clientError, errInsufficientStock) {
+		http.Error(w, clientError.Error(), http.StatusBadRequest)
+		return
+	}
 	if clientError != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -248,107 +240,34 @@ func subtractHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func subtract(changes []ItemChange) (clientError error, serverError error) {
-	amountDone := 0
-	changesDone := make([]ItemChange, len(changes))
-
-	for i, change := range changes {
-		getItemErr, item := getItem(change.itemID)
-		if getItemErr != nil {
-			clientError = getItemErr
-			break
-		}
-		if item.Stock < change.amount {
-			clientError = errors.New("not enough stock to subtract")
-			break
-		}
-		update := bson.M{
-			"$inc": bson.M{
-				"stock": -change.amount,
-			},
-		}
-
-		stockCollection := getStockCollection(change.itemID)
-		result := shared.UpdateRecord(stockCollection, bson.M{"_id": change.itemID}, update)
-		if result.Err() != nil {
-			log.Printf("Update stock error: %s", result.Err())
-			serverError = result.Err()
-			break
-		}
-
-		amountDone++
-		changesDone[i] = change
-	}
-
-	for i := 0; i < amountDone; i++ {
-		changeDone := changesDone[i]
-
-		update := bson.M{
-			"$inc": bson.M{
-				"stock": changeDone.amount,
-			},
-		}
-
-		stockCollection := getStockCollection(changeDone.itemID)
-		result := shared.UpdateRecord(stockCollection, bson.M{"_id": changeDone.itemID}, update)
-		if result.Err() != nil {
-			log.Printf("Redo stock error: %s", result.Err())
-			serverError = result.Err()
-		}
-	}
-
-	return
-}
-
 func addHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	itemID := vars["item_id"]
 	amount := vars["amount"]
 	convIntErr, intAmount := shared.ConvertStringToInt(amount)
 	if convIntErr != nil {
-		log.Print(convIntErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	convStringErr, documentID := shared.ConvertStringToUUID(itemID)
 	if convStringErr != nil {
-		log.Print(convStringErr)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	clientError, serverError := add([]ItemChange{{
+	clientError, serverError := add(r.Context(), itemStore, []ItemChange{{
 		itemID: documentID,
 		amount: *intAmount,
-	}})
+	}}, "")
 
 	if clientError != nil {
-		log.Print(clientError)
+		slog.InfoContext(r.Context(), "Add stock error", shared.LogError, clientError)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	if serverError != nil {
-		log.Print(serverError)
+		slog.ErrorContext(r.Context(), "Add stock error", shared.LogError, serverError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
-
-func add(changes []ItemChange) (clientError error, serverError error) {
-	for _, change := range changes {
-		filter := bson.M{"_id": change.itemID}
-		update := bson.M{
-			"$inc": bson.M{
-				"stock": change.amount,
-			},
-		}
-		stockCollection := getStockCollection(change.itemID)
-		result := shared.UpdateRecord(stockCollection, filter, update)
-		if result.Err() != nil {
-			log.Print(result.Err())
-			serverError = result.Err()
-			return
-		}
-	}
-	return
-}
@@ -0,0 +1,130 @@
+package stock
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+type ItemChange struct {
+	itemID *uuid.UUID
+	amount int64
+}
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// The stock functions take the store, so they run the same on Mongo and in
+// memory. The ones run by saga steps take the ID of the step, which makes them
+// safe to run again, and an empty ID otherwise.
+
+// subtract takes the changes off the stock of their items, all or none. The
+// items subtracted before a failing one are added back.
+func subtract(ctx context.Context, items ItemStore, changes []ItemChange, stepID string) (clientError error, serverError error) {
+	changesDone := []ItemChange{}
+
+	for _, change := range changes {
+		subtractErr, subtracted := items.SubtractStock(ctx, change.itemID, change.amount, stepID)
+		if subtractErr != nil {
+			slog.ErrorContext(ctx, "Subtract stock error", shared.LogError, subtractErr)
+			serverError = subtractErr
+			break
+		}
+		if !subtracted {
+			getItemErr, _ := items.GetItem(ctx, change.itemID)
+			if getItemErr != nil {
+				clientError = getItemErr
+			} else {
+				clientError = errInsufficientStock
+			}
+			break
+		}
+		changesDone = append(changesDone, change)
+	}
+
+	if clientError == nil && serverError == nil {
+		return
+	}
+
+	// undo the items subtracted before the failing one
+	for _, changeDone := range changesDone {
+		var addErr error
+		if stepID != "" {
+			addErr = items.ReturnStock(ctx, changeDone.itemID, changeDone.amount, stepID)
+		} else {
+			addErr, _ = items.AddStock(ctx, changeDone.itemID, changeDone.amount, "")
+		}
+		if addErr != nil {
+			slog.ErrorContext(ctx, "Add back stock error", shared.LogError, addErr)
+			serverError = addErr
+		}
+	}
+	return
+}
+
+func add(ctx context.Context, items ItemStore, changes []ItemChange, stepID string) (clientError error, serverError error) {
+	for _, change := range changes {
+		addErr, added := items.AddStock(ctx, change.itemID, change.amount, stepID)
+		if addErr != nil {
+			slog.ErrorContext(ctx, "Add stock error", shared.LogError, addErr)
+			serverError = addErr
+			return
+		}
+		if !added {
+			clientError = errItemNotFound
+			return
+		}
+	}
+	return
+}
+
+// returnSubtracted adds back what the subtract of the step subtractStepID took
+// off the changes. Items it did not subtract from, because it failed, never
+// ran or already added them back, are left as they are.
+func returnSubtracted(ctx context.Context, items ItemStore, changes []ItemChange, subtractStepID string) (serverError error) {
+	for _, change := range changes {
+		returnErr := items.ReturnStock(ctx, change.itemID, change.amount, subtractStepID)
+		if returnErr != nil {
+			slog.ErrorContext(ctx, "Return stock error", shared.LogError, returnErr)
+			return returnErr
+		}
+	}
+	return nil
+}
+
+// getRestockItems returns the items a READD-STOCK adds back. The cancel saga of
+// a paid order restocks what it was paid for, a checkout that rolls back what
+// it subtracted. Orders paid before the paid items were kept fall back to
+// their items, which no longer change once paid.
+func getRestockItems(order *shared.Order) shared.OrderItems {
+	if order.Paid && len(order.PaidItems) > 0 {
+		return order.PaidItems
+	}
+	return order.Items
+}
+
+// getItemChanges sums the quantities of the items per item, in the order the
+// items first appear.
+func getItemChanges(items shared.OrderItems) []ItemChange {
+	changes := []ItemChange{}
+	changeIndex := map[string]int{}
+
+	for _, line := range items {
+		if i, found := changeIndex[line.ItemID]; found {
+			changes[i].amount += line.Quantity
+			continue
+		}
+		// ignore error, will not happen
+		_, itemID := shared.ConvertStringToUUID(line.ItemID)
+
+		changeIndex[line.ItemID] = len(changes)
+		changes = append(changes, ItemChange{
+			itemID: itemID,
+			amount: line.Quantity,
+		})
+	}
+	return changes
+}
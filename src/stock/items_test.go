@@ -0,0 +1,332 @@
+package stock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// createTestItems creates an item per stock in the store and returns their IDs
+func createTestItems(t *testing.T, items ItemStore, stocks ...int64) []*uuid.UUID {
+	t.Helper()
+	itemIDs := make([]*uuid.UUID, len(stocks))
+	for i, stock := range stocks {
+		itemID := shared.GetNewID()
+		createErr := items.CreateItem(context.Background(), &shared.Item{ID: itemID, ItemID: itemID.String(), Stock: stock, Price: 10})
+		if createErr != nil {
+			t.Fatalf("create item: %v", createErr)
+		}
+		itemIDs[i] = &itemID
+	}
+	return itemIDs
+}
+
+func getTestStock(t *testing.T, items ItemStore, itemID *uuid.UUID) int64 {
+	t.Helper()
+	getErr, item := items.GetItem(context.Background(), itemID)
+	if getErr != nil {
+		t.Fatalf("get item: %v", getErr)
+	}
+	return item.Stock
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name    string
+		stocks  []int64
+		amounts []int64
+		// subtract from an item that does not exist after the others
+		unknownItem     bool
+		wantStocks      []int64
+		wantClientError error
+	}{
+		{
+			name:       "one item",
+			stocks:     []int64{5},
+			amounts:    []int64{2},
+			wantStocks: []int64{3},
+		},
+		{
+			name:       "all stock of every item",
+			stocks:     []int64{5, 3},
+			amounts:    []int64{5, 3},
+			wantStocks: []int64{0, 0},
+		},
+		{
+			name:            "not enough stock of the last item",
+			stocks:          []int64{5, 3, 1},
+			amounts:         []int64{2, 3, 2},
+			wantStocks:      []int64{5, 3, 1},
+			wantClientError: errInsufficientStock,
+		},
+		{
+			name:            "unknown item",
+			stocks:          []int64{5},
+			amounts:         []int64{2},
+			unknownItem:     true,
+			wantStocks:      []int64{5},
+			wantClientError: errItemNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := newMemoryItemStore()
+			itemIDs := createTestItems(t, items, test.stocks...)
+			changes := []ItemChange{}
+			for i, itemID := range itemIDs {
+				changes = append(changes, ItemChange{itemID: itemID, amount: test.amounts[i]})
+			}
+			if test.unknownItem {
+				unknownID := shared.GetNewID()
+				changes = append(changes, ItemChange{itemID: &unknownID, amount: 1})
+			}
+
+			clientError, serverError := subtract(context.Background(), items, changes, "")
+			if serverError != nil {
+				t.Fatalf("server error: %v", serverError)
+			}
+			if !errors.Is(clientError, test.wantClientError) {
+				t.Fatalf("client error %v, want %v", clientError, test.wantClientError)
+			}
+			for i, itemID := range itemIDs {
+				if stock := getTestStock(t, items, itemID); stock != test.wantStocks[i] {
+					t.Errorf("stock of item %d is %d, want %d", i, stock, test.wantStocks[i])
+				}
+			}
+		})
+	}
+}
+
+// TestSagaStepStock runs the stock functions of saga steps again, as after a
+// crash or a takeover of the step, no item may change twice
+func TestSagaStepStock(t *testing.T) {
+	const subtractStep = "1_START-SUBTRACT-STOCK"
+
+	tests := []struct {
+		name    string
+		stocks  []int64
+		amounts []int64
+		// run by the steps in order: subtract, return or add
+		runs       []string
+		wantStocks []int64
+	}{
+		{
+			name:       "subtract twice",
+			stocks:     []int64{5, 3},
+			amounts:    []int64{2, 3},
+			runs:       []string{"subtract", "subtract"},
+			wantStocks: []int64{3, 0},
+		},
+		{
+			name:       "return what was subtracted",
+			stocks:     []int64{5, 3},
+			amounts:    []int64{2, 3},
+			runs:       []string{"subtract", "return", "return"},
+			wantStocks: []int64{5, 3},
+		},
+		{
+			name:       "no subtract after the return",
+			stocks:     []int64{5},
+			amounts:    []int64{2},
+			runs:       []string{"subtract", "return", "subtract"},
+			wantStocks: []int64{5},
+		},
+		{
+			name:       "return without subtract",
+			stocks:     []int64{5},
+			amounts:    []int64{2},
+			runs:       []string{"return"},
+			wantStocks: []int64{5},
+		},
+		{
+			name:       "return after a failed subtract",
+			stocks:     []int64{5, 1},
+			amounts:    []int64{2, 2},
+			runs:       []string{"subtract", "subtract", "return"},
+			wantStocks: []int64{5, 1},
+		},
+		{
+			name:       "add twice",
+			stocks:     []int64{5},
+			amounts:    []int64{2},
+			runs:       []string{"add", "add"},
+			wantStocks: []int64{7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := newMemoryItemStore()
+			itemIDs := createTestItems(t, items, test.stocks...)
+			changes := []ItemChange{}
+			for i, itemID := range itemIDs {
+				changes = append(changes, ItemChange{itemID: itemID, amount: test.amounts[i]})
+			}
+
+			for _, run := range test.runs {
+				var serverError error
+				switch run {
+				case "subtract":
+					_, serverError = subtract(context.Background(), items, changes, subtractStep)
+				case "return":
+					serverError = returnSubtracted(context.Background(), items, changes, subtractStep)
+				case "add":
+					_, serverError = add(context.Background(), items, changes, "1_START-READD-STOCK")
+				}
+				if serverError != nil {
+					t.Fatalf("%s: server error: %v", run, serverError)
+				}
+			}
+			for i, itemID := range itemIDs {
+				if stock := getTestStock(t, items, itemID); stock != test.wantStocks[i] {
+					t.Errorf("stock of item %d is %d, want %d", i, stock, test.wantStocks[i])
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentSubtract subtracts and adds stock at the same time, no
+// subtraction may take the stock below zero and no change may get lost
+func TestConcurrentSubtract(t *testing.T) {
+	const initialStock = 100
+	const subtracters = 50
+	const subtractAmount = 3
+	const adders = 20
+
+	items := newMemoryItemStore()
+	itemID := createTestItems(t, items, initialStock)[0]
+
+	var subtracted atomic.Int64
+	var wait sync.WaitGroup
+	for i := 0; i < subtracters; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			clientError, serverError := subtract(context.Background(), items, []ItemChange{{itemID: itemID, amount: subtractAmount}}, "")
+			if serverError != nil {
+				t.Errorf("server error: %v", serverError)
+				return
+			}
+			if clientError == nil {
+				subtracted.Add(subtractAmount)
+			} else if !errors.Is(clientError, errInsufficientStock) {
+				t.Errorf("client error: %v", clientError)
+			}
+		}()
+	}
+	for i := 0; i < adders; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			clientError, serverError := add(context.Background(), items, []ItemChange{{itemID: itemID, amount: 1}}, "")
+			if clientError != nil || serverError != nil {
+				t.Errorf("add: %v %v", clientError, serverError)
+			}
+		}()
+	}
+	wait.Wait()
+
+	stock := getTestStock(t, items, itemID)
+	if stock < 0 {
+		t.Fatalf("stock is %d", stock)
+	}
+	if want := initialStock + adders - subtracted.Load(); stock != want {
+		t.Errorf("stock is %d, want %d after subtracting %d", stock, want, subtracted.Load())
+	}
+	// without the adds 33 subtractions fit into the stock
+	if subtracted.Load() < initialStock/subtractAmount*subtractAmount {
+		t.Errorf("only %d subtracted", subtracted.Load())
+	}
+}
+
+func TestGetItemChanges(t *testing.T) {
+	itemA := shared.GetNewID()
+	itemB := shared.GetNewID()
+
+	tests := []struct {
+		name  string
+		items shared.OrderItems
+		want  []ItemChange
+	}{
+		{
+			name:  "no items",
+			items: nil,
+			want:  []ItemChange{},
+		},
+		{
+			name: "one line per item",
+			items: shared.OrderItems{
+				{ItemID: itemA.String(), Quantity: 2, UnitPrice: 10},
+				{ItemID: itemB.String(), Quantity: 1, UnitPrice: 5},
+			},
+			want: []ItemChange{{itemID: &itemA, amount: 2}, {itemID: &itemB, amount: 1}},
+		},
+		{
+			name: "lines of the same item are summed",
+			items: shared.OrderItems{
+				{ItemID: itemB.String(), Quantity: 1},
+				{ItemID: itemA.String(), Quantity: 2},
+				{ItemID: itemB.String(), Quantity: 3},
+			},
+			want: []ItemChange{{itemID: &itemB, amount: 4}, {itemID: &itemA, amount: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := getItemChanges(test.items)
+			if len(changes) != len(test.want) {
+				t.Fatalf("got %d changes, want %d", len(changes), len(test.want))
+			}
+			for i, change := range changes {
+				if *change.itemID != *test.want[i].itemID || change.amount != test.want[i].amount {
+					t.Errorf("change %d is %v %d, want %v %d", i, *change.itemID, change.amount, *test.want[i].itemID, test.want[i].amount)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRestockItems(t *testing.T) {
+	items := shared.OrderItems{{ItemID: "a", Quantity: 3}}
+	paidItems := shared.OrderItems{{ItemID: "a", Quantity: 2}}
+
+	tests := []struct {
+		name  string
+		order shared.Order
+		want  shared.OrderItems
+	}{
+		{
+			name:  "rollback of a checkout",
+			order: shared.Order{Items: items},
+			want:  items,
+		},
+		{
+			name:  "cancel of a paid order",
+			order: shared.Order{Paid: true, Items: items, PaidItems: paidItems},
+			want:  paidItems,
+		},
+		{
+			name:  "cancel of an order paid before paid items were kept",
+			order: shared.Order{Paid: true, Items: items},
+			want:  items,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restockItems := getRestockItems(&test.order)
+			if len(restockItems) != len(test.want) || restockItems[0] != test.want[0] {
+				t.Errorf("restocks %v, want %v", restockItems, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package stock
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+// memoryItemStore keeps the items in memory, for the local mode and tests
+type memoryItemStore struct {
+	mu    sync.Mutex
+	items map[uuid.UUID]shared.Item
+}
+
+func newMemoryItemStore() *memoryItemStore {
+	return &memoryItemStore{items: map[uuid.UUID]shared.Item{}}
+}
+
+func (store *memoryItemStore) CreateItem(ctx context.Context, item *shared.Item) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.items[item.ID] = *item
+	return nil
+}
+
+func (store *memoryItemStore) GetItem(ctx context.Context, itemID *uuid.UUID) (error, *shared.Item) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	item, found := store.items[*itemID]
+	if !found {
+		return errItemNotFound, nil
+	}
+	return nil, &item
+}
+
+// updateStock changes the stock of the item when it matches, once for the
+// step like shared.UpdateOnceForSagaStep. It is called with the lock held.
+func (store *memoryItemStore) updateStock(itemID *uuid.UUID, matches func(item *shared.Item) bool, amount int64, stepID string) bool {
+	item, found := store.items[*itemID]
+	if !found {
+		return false
+	}
+	if stepID != "" && shared.HasSagaStep(item.SagaSteps, stepID) {
+		return true
+	}
+	if !matches(&item) {
+		return false
+	}
+	item.Stock += amount
+	if stepID != "" {
+		item.SagaSteps = shared.AddSagaStep(item.SagaSteps, stepID)
+	}
+	store.items[*itemID] = item
+	return true
+}
+
+func (store *memoryItemStore) AddStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return nil, store.updateStock(itemID, func(item *shared.Item) bool { return true }, amount, stepID)
+}
+
+func (store *memoryItemStore) SubtractStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) (error, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return nil, store.updateStock(itemID, func(item *shared.Item) bool { return item.Stock >= amount }, -amount, stepID)
+}
+
+func (store *memoryItemStore) ReturnStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	subtracted := func(item *shared.Item) bool { return shared.HasSagaStep(item.SagaSteps, stepID) }
+	store.updateStock(itemID, subtracted, amount, returnedStepID(stepID))
+	return nil
+}
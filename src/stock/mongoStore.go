@@ -0,0 +1,108 @@
+package stock
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"main/shared"
+)
+
+// mongoShards are the collections of the service on its Mongo shards
+type mongoShards struct {
+	clients   []*mongo.Client
+	items     *shared.ShardedCollection
+	sagaSteps *shared.ShardedCollection
+}
+
+// mongoItemStore stores the items on the Mongo shards of the service
+type mongoItemStore struct {
+	items *shared.ShardedCollection
+}
+
+func connectMongoShards(ctx context.Context) (error, *mongoShards) {
+	loadErr, shardMap := shared.NewShardMap(&shared.AppConfig.Sharding, "stock")
+	if loadErr != nil {
+		return loadErr, nil
+	}
+	connectErr, clients := shared.ConnectShards(ctx, shardMap)
+	if connectErr != nil {
+		return connectErr, nil
+	}
+	return nil, &mongoShards{
+		clients:   clients,
+		items:     shared.NewShardedCollection(shardMap, clients, "stock", "stock", "_id"),
+		sagaSteps: shared.NewShardedCollection(shardMap, clients, "stock", "saga_steps", "orderid"),
+	}
+}
+
+func (shards *mongoShards) disconnect(ctx context.Context) {
+	for _, client := range shards.clients {
+		client.Disconnect(ctx)
+	}
+}
+
+func (shards *mongoShards) startResharding() {
+	shared.StartResharding(shards.items, shards.sagaSteps)
+}
+
+func (store *mongoItemStore) CreateItem(ctx context.Context, item *shared.Item) error {
+	_, insertErr := store.items.Get(item.ID).InsertOne(ctx, item)
+	return insertErr
+}
+
+func (store *mongoItemStore) GetItem(ctx context.Context, documentID *uuid.UUID) (error, *shared.Item) {
+	stockCollection := store.items.Read(*documentID)
+
+	var item shared.Item
+	err := stockCollection.FindOne(ctx, bson.M{"_id": documentID}).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errItemNotFound, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+	item.ID = *documentID
+	item.ItemID = documentID.String()
+	return nil, &item
+}
+
+// updateStock changes the stock in one update, once for the step, and reports
+// whether it matched
+func (store *mongoItemStore) updateStock(ctx context.Context, itemID *uuid.UUID, filter bson.M, amount int64, stepID string) (error, bool) {
+	moveErr, stockCollection := store.items.Write(*itemID)
+	if moveErr != nil {
+		return moveErr, false
+	}
+	update := bson.M{
+		"$inc": bson.M{
+			"stock": amount,
+		},
+	}
+	return shared.UpdateOnceForSagaStep(ctx, stockCollection, itemID, filter, update, stepID)
+}
+
+func (store *mongoItemStore) AddStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) (error, bool) {
+	return store.updateStock(ctx, itemID, bson.M{"_id": itemID}, amount, stepID)
+}
+
+func (store *mongoItemStore) SubtractStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) (error, bool) {
+	// check and decrement in one update
+	filter := bson.M{
+		"_id":   itemID,
+		"stock": bson.M{"$gte": amount},
+	}
+	return store.updateStock(ctx, itemID, filter, -amount, stepID)
+}
+
+func (store *mongoItemStore) ReturnStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) error {
+	filter := bson.M{
+		"_id":       itemID,
+		"sagasteps": stepID,
+	}
+	returnErr, _ := store.updateStock(ctx, itemID, filter, amount, returnedStepID(stepID))
+	return returnErr
+}
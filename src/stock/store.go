@@ -0,0 +1,38 @@
+package stock
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+
+	"main/shared"
+)
+
+var errItemNotFound = errors.New("item not found")
+
+// ItemStore stores the items of the service, on the Mongo shards or in
+// memory in local mode. Every function is atomic on its item. The bool
+// results report whether the item matched, a missing item is no error.
+//
+// The changes of a saga step carry its ID, stepID, and are applied at most
+// once per item, see shared.UpdateOnceForSagaStep. They are empty outside of
+// sagas.
+type ItemStore interface {
+	CreateItem(ctx context.Context, item *shared.Item) error
+	// GetItem returns errItemNotFound for a missing item
+	GetItem(ctx context.Context, itemID *uuid.UUID) (error, *shared.Item)
+	AddStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) (error, bool)
+	// SubtractStock does not match when the item has less stock than amount,
+	// so concurrent subtracts cannot take the stock below zero.
+	SubtractStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) (error, bool)
+	// ReturnStock adds back the amount the step stepID subtracted, once. An
+	// item the step did not subtract from is left as it is.
+	ReturnStock(ctx context.Context, itemID *uuid.UUID, amount int64, stepID string) error
+}
+
+// returnedStepID marks the stock of a step as returned, by the step itself
+// when it fails or by its compensation
+func returnedStepID(stepID string) string {
+	return stepID + "_RETURNED"
+}
@@ -1,5 +1,7 @@
 import time
 import unittest
+import uuid
+from concurrent.futures import ThreadPoolExecutor
 
 import utils as tu
 
@@ -150,6 +152,201 @@ class TestMicroservices(unittest.TestCase):
         credit: int = tu.find_user(user_id)['credit']
         self.assertEqual(credit, 5)
 
+    def test_cancel_order(self):
+        user: dict = tu.create_user()
+        user_id: str = user['user_id']
+        add_credit_response = tu.add_credit_to_user(user_id, 15)
+        self.assertTrue(tu.status_code_is_success(add_credit_response))
+
+        item: dict = tu.create_item(5)
+        item_id: str = item['item_id']
+        add_stock_response = tu.add_stock(item_id, 10)
+        self.assertTrue(tu.status_code_is_success(add_stock_response))
+
+        order: dict = tu.create_order(user_id)
+        order_id: str = order['order_id']
+        add_item_response = tu.add_item_to_order(order_id, item_id)
+        self.assertTrue(tu.status_code_is_success(add_item_response))
+
+        # unpaid orders cannot be cancelled
+        cancel_response = tu.cancel_order(order_id)
+        self.assertTrue(tu.status_code_is_failure(cancel_response))
+
+        tu.checkout_order(order_id)
+        time.sleep(2)
+        self.assertEqual(bool(tu.find_order(order_id)['paid']), True)
+
+        # paid orders cannot be removed
+        remove_response = tu.remove_order(order_id)
+        self.assertTrue(tu.status_code_is_failure(remove_response))
+
+        cancel_response = tu.cancel_order(order_id)
+        self.assertTrue(tu.status_code_is_success(cancel_response))
+        time.sleep(2)
+
+        order: dict = tu.find_order(order_id)
+        self.assertEqual(bool(order['paid']), False)
+        self.assertEqual(bool(order['cancelled']), True)
+
+        credit: int = tu.find_user(user_id)['credit']
+        self.assertEqual(credit, 15)
+
+        stock: int = tu.find_item(item_id)['stock']
+        self.assertEqual(stock, 10)
+
+    def test_order_item_quantities(self):
+        user: dict = tu.create_user()
+        user_id: str = user['user_id']
+        add_credit_response = tu.add_credit_to_user(user_id, 100)
+        self.assertTrue(tu.status_code_is_success(add_credit_response))
+
+        item: dict = tu.create_item(5)
+        item_id: str = item['item_id']
+        add_stock_response = tu.add_stock(item_id, 10)
+        self.assertTrue(tu.status_code_is_success(add_stock_response))
+
+        order: dict = tu.create_order(user_id)
+        order_id: str = order['order_id']
+
+        add_item_response = tu.add_item_to_order(order_id, item_id, 3)
+        self.assertTrue(tu.status_code_is_success(add_item_response))
+        add_item_response = tu.add_item_to_order(order_id, item_id)
+        self.assertTrue(tu.status_code_is_success(add_item_response))
+
+        order = tu.find_order(order_id)
+        self.assertEqual(len(order['items']), 1)
+        self.assertEqual(order['items'][0]['quantity'], 4)
+        self.assertEqual(order['total_cost'], 20)
+
+        # removing more than the order contains fails
+        remove_item_response = tu.remove_item_from_order(order_id, item_id, 5)
+        self.assertTrue(tu.status_code_is_failure(remove_item_response))
+
+        remove_item_response = tu.remove_item_from_order(order_id, item_id)
+        self.assertTrue(tu.status_code_is_success(remove_item_response))
+
+        order = tu.find_order(order_id)
+        self.assertEqual(order['items'][0]['quantity'], 3)
+        self.assertEqual(order['total_cost'], 15)
+
+        tu.checkout_order(order_id)
+        time.sleep(2)
+        self.assertEqual(bool(tu.find_order(order_id)['paid']), True)
+
+        stock: int = tu.find_item(item_id)['stock']
+        self.assertEqual(stock, 7)
+
+        credit: int = tu.find_user(user_id)['credit']
+        self.assertEqual(credit, 85)
+
+    def test_async_checkout(self):
+        user: dict = tu.create_user()
+        user_id: str = user['user_id']
+        add_credit_response = tu.add_credit_to_user(user_id, 15)
+        self.assertTrue(tu.status_code_is_success(add_credit_response))
+
+        item: dict = tu.create_item(5)
+        item_id: str = item['item_id']
+        add_stock_response = tu.add_stock(item_id, 10)
+        self.assertTrue(tu.status_code_is_success(add_stock_response))
+
+        order: dict = tu.create_order(user_id)
+        order_id: str = order['order_id']
+        add_item_response = tu.add_item_to_order(order_id, item_id, 2)
+        self.assertTrue(tu.status_code_is_success(add_item_response))
+
+        checkout_response = tu.checkout_order_async(order_id)
+        self.assertEqual(checkout_response.status_code, 202)
+        checkout: dict = checkout_response.json()
+        self.assertEqual(checkout['order_id'], order_id)
+        self.assertEqual(checkout['state'], 'pending')
+
+        time.sleep(2)
+        checkout_response = tu.find_checkout(checkout['checkout_id'])
+        self.assertTrue(tu.status_code_is_success(checkout_response.status_code))
+        checkout = checkout_response.json()
+        self.assertEqual(checkout['state'], 'succeeded')
+        self.assertEqual(checkout['status'], 200)
+        self.assertEqual(bool(tu.find_order(order_id)['paid']), True)
+
+        credit: int = tu.find_user(user_id)['credit']
+        self.assertEqual(credit, 5)
+
+        unknown_response = tu.find_checkout(str(uuid.uuid4()))
+        self.assertEqual(unknown_response.status_code, 404)
+
+    def test_idempotent_checkout(self):
+        user: dict = tu.create_user()
+        user_id: str = user['user_id']
+        add_credit_response = tu.add_credit_to_user(user_id, 15)
+        self.assertTrue(tu.status_code_is_success(add_credit_response))
+
+        item: dict = tu.create_item(5)
+        item_id: str = item['item_id']
+        add_stock_response = tu.add_stock(item_id, 10)
+        self.assertTrue(tu.status_code_is_success(add_stock_response))
+
+        order: dict = tu.create_order(user_id)
+        order_id: str = order['order_id']
+        add_item_response = tu.add_item_to_order(order_id, item_id, 2)
+        self.assertTrue(tu.status_code_is_success(add_item_response))
+
+        key = str(uuid.uuid4())
+        checkout_response = tu.checkout_order_idempotent(order_id, key, run_async=True)
+        self.assertEqual(checkout_response.status_code, 202)
+        checkout: dict = checkout_response.json()
+
+        # another checkout of the order while the first one runs
+        conflict_response = tu.checkout_order_idempotent(order_id, str(uuid.uuid4()))
+        self.assertEqual(conflict_response.status_code, 409)
+
+        # the retry joins the first checkout
+        retry_response = tu.checkout_order_idempotent(order_id, key)
+        self.assertTrue(tu.status_code_is_success(retry_response.status_code))
+        retry_response = tu.checkout_order_idempotent(order_id, key, run_async=True)
+        self.assertEqual(retry_response.json()['checkout_id'], checkout['checkout_id'])
+
+        credit: int = tu.find_user(user_id)['credit']
+        self.assertEqual(credit, 5)
+        stock: int = tu.find_item(item_id)['stock']
+        self.assertEqual(stock, 8)
+
+        other_order: dict = tu.create_order(user_id)
+        reuse_response = tu.checkout_order_idempotent(other_order['order_id'], key)
+        self.assertEqual(reuse_response.status_code, 422)
+
+    def test_concurrent_subtract_stock(self):
+        item: dict = tu.create_item(5)
+        item_id: str = item['item_id']
+        add_stock_response = tu.add_stock(item_id, 10)
+        self.assertTrue(tu.status_code_is_success(add_stock_response))
+
+        # many concurrent subtracts of one item must not oversell it
+        with ThreadPoolExecutor(max_workers=20) as executor:
+            responses = list(executor.map(lambda _: tu.subtract_stock(item_id, 1), range(50)))
+
+        self.assertEqual(len([r for r in responses if tu.status_code_is_success(r)]), 10)
+        self.assertEqual(len([r for r in responses if tu.status_code_is_failure(r)]), 40)
+
+        stock: int = tu.find_item(item_id)['stock']
+        self.assertEqual(stock, 0)
+
+    def test_concurrent_pay(self):
+        user: dict = tu.create_user()
+        user_id: str = user['user_id']
+        add_credit_response = tu.add_credit_to_user(user_id, 10)
+        self.assertTrue(tu.status_code_is_success(add_credit_response))
+
+        # many concurrent payments of one user must not overdraw the credit
+        with ThreadPoolExecutor(max_workers=20) as executor:
+            responses = list(executor.map(lambda _: tu.payment_pay(user_id, str(uuid.uuid4()), 1), range(50)))
+
+        self.assertEqual(len([r for r in responses if tu.status_code_is_success(r)]), 10)
+        self.assertEqual(len([r for r in responses if tu.status_code_is_failure(r)]), 40)
+
+        credit: int = tu.find_user(user_id)['credit']
+        self.assertEqual(credit, 0)
+
 
 if __name__ == '__main__':
     unittest.main()
@@ -48,8 +48,12 @@ def create_order(user_id: str) -> dict:
     return requests.post(f"{ORDER_URL}/orders/create/{user_id}").json()
 
 
-def add_item_to_order(order_id: str, item_id: str) -> int:
-    return requests.post(f"{ORDER_URL}/orders/addItem/{order_id}/{item_id}").status_code
+def add_item_to_order(order_id: str, item_id: str, quantity: int = 1) -> int:
+    return requests.post(f"{ORDER_URL}/orders/addItem/{order_id}/{item_id}/{quantity}").status_code
+
+
+def remove_item_from_order(order_id: str, item_id: str, quantity: int = 1) -> int:
+    return requests.post(f"{ORDER_URL}/orders/removeItem/{order_id}/{item_id}/{quantity}").status_code
 
 
 def find_order(order_id: str) -> dict:
@@ -60,6 +64,28 @@ def checkout_order(order_id: str) -> requests.Response:
     return requests.post(f"{ORDER_URL}/orders/checkout/{order_id}")
 
 
+def checkout_order_async(order_id: str) -> requests.Response:
+    return requests.post(f"{ORDER_URL}/orders/checkout/{order_id}", params={"async": "true"})
+
+
+def checkout_order_idempotent(order_id: str, idempotency_key: str, run_async: bool = False) -> requests.Response:
+    params = {"async": "true"} if run_async else {}
+    return requests.post(f"{ORDER_URL}/orders/checkout/{order_id}", params=params,
+                         headers={"Idempotency-Key": idempotency_key})
+
+
+def find_checkout(checkout_id: str) -> requests.Response:
+    return requests.get(f"{ORDER_URL}/orders/checkout/checkout/{checkout_id}")
+
+
+def cancel_order(order_id: str) -> int:
+    return requests.post(f"{ORDER_URL}/orders/cancel/{order_id}").status_code
+
+
+def remove_order(order_id: str) -> int:
+    return requests.delete(f"{ORDER_URL}/orders/remove/{order_id}").status_code
+
+
 ########################################################################################################################
 #   STATUS CHECKS
 ########################################################################################################################